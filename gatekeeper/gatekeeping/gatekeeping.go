@@ -14,6 +14,9 @@ const (
 	cloudflareIPV6s = "https://www.cloudflare.com/ips-v6"
 )
 
+// HeaderSourceIP is the request header the IP of the client is forwarded to the keymanager in, for its audit log
+const HeaderSourceIP = "X-KeyMan-Source-IP"
+
 var rangesOfCloudFlareIPs []*net.IPNet
 
 func getRangesOfCloudFlareIPs() ([]*net.IPNet, error) {
@@ -111,3 +114,20 @@ func MakeDomainLock(lockIP string) func(*gin.Context) {
 		)
 	}
 }
+
+// sourceIP returns the IP of the client which made the request, which is the connecting IP Cloudflare passes on when the request came through it
+func sourceIP(request *http.Request) string {
+	if connectingIP := request.Header.Get("Cf-Connecting-Ip"); connectingIP != "" {
+		return connectingIP
+	}
+
+	return parseRemoteAddr(request)
+}
+
+// ForwardSourceIP sets the IP of the client in the X-KeyMan-Source-IP header of the request, replacing any value the client sent
+// so that it cannot pass itself off as another IP in the audit log of the keymanager
+func ForwardSourceIP(c *gin.Context) {
+	c.Request.Header.Set(HeaderSourceIP, sourceIP(c.Request))
+
+	c.Next()
+}
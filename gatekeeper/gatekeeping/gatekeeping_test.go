@@ -117,3 +117,69 @@ func TestDomainLocking(t *testing.T) {
 		}
 	}
 }
+
+// Need to test the following:
+// If the request came through Cloudflare then the "Cf-Connecting-Ip" header is forwarded as the source IP,
+// otherwise the originating IP is forwarded without its port,
+// and a source IP header sent by the client is always replaced
+func TestForwardSourceIP(t *testing.T) {
+	tests := []struct {
+		ExpectedSourceIP, RequestDomain string
+		Headers                         map[string]string
+	}{
+		// Testing for a connecting IP header
+		{
+			ExpectedSourceIP: "192.168.1.1",
+			RequestDomain:    "103.21.244.1:443",
+			Headers: map[string]string{
+				"Cf-Connecting-Ip": "192.168.1.1",
+			},
+		},
+		// Testing for no connecting IP header and a request IP with an attached port
+		{
+			ExpectedSourceIP: "192.168.1.1",
+			RequestDomain:    "192.168.1.1:9900",
+			Headers:          map[string]string{},
+		},
+		// Testing for a source IP header sent by the client
+		{
+			ExpectedSourceIP: "192.168.1.1",
+			RequestDomain:    "192.168.1.1",
+			Headers: map[string]string{
+				HeaderSourceIP: "10.0.0.1",
+			},
+		},
+	}
+
+	for _, testItem := range tests {
+		var forwardedSourceIP string
+
+		router := gin.New()
+
+		router.Use(ForwardSourceIP)
+
+		router.GET("/", func(c *gin.Context) {
+			forwardedSourceIP = c.GetHeader(HeaderSourceIP)
+
+			c.String(200, "OK")
+		})
+
+		mockRequest, err := http.NewRequest("GET", "/", &bytes.Reader{})
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.RemoteAddr = testItem.RequestDomain
+
+		for headerKey, headerValue := range testItem.Headers {
+			mockRequest.Header.Set(headerKey, headerValue)
+		}
+
+		router.ServeHTTP(httptest.NewRecorder(), mockRequest)
+
+		if forwardedSourceIP != testItem.ExpectedSourceIP {
+			t.Errorf(`ForwardSourceIP forwarded "%s", "%s" was expected for IP "%s" and headers %v`, forwardedSourceIP, testItem.ExpectedSourceIP, testItem.RequestDomain, testItem.Headers)
+		}
+	}
+}
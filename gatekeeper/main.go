@@ -27,7 +27,7 @@ func main() {
 
 	router := gin.Default()
 
-	router.Use(gatekeeping.MakeDomainLock(*lockingFlag))
+	router.Use(gatekeeping.MakeDomainLock(*lockingFlag), gatekeeping.ForwardSourceIP)
 
 	router.NoRoute(func(c *gin.Context) {
 		KeyManReverseProxy.ServeHTTP(c.Writer, c.Request)
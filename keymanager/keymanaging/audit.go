@@ -0,0 +1,641 @@
+package keymanaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrAuditKeyRequired = errors.New("an audit log needs an audit key to hash its records with")
+
+var ErrInvalidTrustedProxy = errors.New("the trusted proxies must be IP addresses or CIDR ranges")
+
+var errAuditFailed = errors.New(ErrorAuditFailed)
+
+// HeaderSourceIP is the request header the gatekeeper forwards the IP of the client in, it is recorded in the audit log when the request
+// comes from one of the trusted proxies
+const HeaderSourceIP = "X-KeyMan-Source-IP"
+
+// The operations recorded in the audit log
+const (
+	AuditCreate      = "create"
+	AuditCreateToken = "create-token"
+	AuditDelete      = "delete"
+	AuditDestroy     = "destroy"
+	AuditList        = "list"
+	AuditLookupToken = "lookup-token"
+	AuditRead        = "read"
+	AuditRestore     = "restore"
+	AuditRevokeToken = "revoke-token"
+	AuditRollback    = "rollback"
+	AuditTransaction = "transaction"
+	AuditUnwrap      = "unwrap"
+	AuditUpdate      = "update"
+	AuditWatch       = "watch"
+)
+
+// The results recorded in the audit log, a request fails when it is answered with a status of 400 or above
+const (
+	AuditFailure = "failure"
+	AuditSuccess = "success"
+)
+
+// AuditRecord is a single request recorded in the audit log; the names of the keys are HMAC'd with the audit key rather than recorded as they
+// are, and every record holds the hash of the record before it, so that editing or removing a record breaks the chain of hashes after it
+type AuditRecord struct {
+	Actor        string    `json:"actor"`
+	Hash         string    `json:"hash"`
+	Keys         []string  `json:"keys,omitempty"`
+	Operation    string    `json:"operation"`
+	PreviousHash string    `json:"previousHash"`
+	Result       string    `json:"result"`
+	Sequence     int64     `json:"sequence"`
+	SourceIP     string    `json:"sourceIp"`
+	Status       int       `json:"status"`
+	Time         time.Time `json:"time"`
+	TokenID      string    `json:"tokenId,omitempty"`
+}
+
+// AuditHead is the last record of the audit log, it is kept in a file next to the log along with a HMAC so that records cannot be removed
+// from the end of the log without it being noticed
+type AuditHead struct {
+	Hash     string `json:"hash"`
+	MAC      string `json:"mac"`
+	Sequence int64  `json:"sequence"`
+}
+
+// auditLog appends the records of requests to a file, continuing the chain of hashes of the records already in it
+type auditLog struct {
+	file     *os.File
+	head     AuditHead
+	headPath string
+	key      []byte
+	mutex    sync.Mutex
+}
+
+// auditOperations maps the method and route of the audited requests to the operation recorded for them
+var auditOperations = map[string]string{
+	"DELETE /key/*path":       AuditDelete,
+	"GET /key/*path":          AuditRead,
+	"GET /keys":               AuditList,
+	"GET /metadata/*path":     AuditRead,
+	"GET /trash":              AuditList,
+	"GET /versions/*path":     AuditRead,
+	"GET /watch":              AuditWatch,
+	"POST /auth/token/create": AuditCreateToken,
+	"POST /auth/token/lookup": AuditLookupToken,
+	"POST /auth/token/revoke": AuditRevokeToken,
+	"POST /destroy/*path":     AuditDestroy,
+	"POST /key":               AuditCreate,
+	"POST /keys":              AuditRead,
+	"POST /restore/*path":     AuditRestore,
+	"POST /rollback/*path":    AuditRollback,
+	"POST /txn":               AuditTransaction,
+	"POST /sys/unwrap":        AuditUnwrap,
+	"PUT /key/*path":          AuditUpdate,
+}
+
+// parseTrustedProxies reads the IP addresses and CIDR ranges of the proxies trusted to forward the IP of the client
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To16())
+
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+
+		if err != nil {
+			return nil, ErrInvalidTrustedProxy
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// sourceIP returns the IP the request came from, which is the IP forwarded in the X-KeyMan-Source-IP header when the request was made by
+// a trusted proxy, such as the gatekeeper, and otherwise the address the request was made from, since anyone else could set the header
+func (s *Server) sourceIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+
+	forwarded, remote := c.GetHeader(HeaderSourceIP), net.ParseIP(host)
+
+	for _, network := range s.trustedProxies {
+		if forwarded != "" && remote != nil && network.Contains(remote) {
+			return forwarded
+		}
+	}
+
+	return host
+}
+
+// auditHeadPath is the path of the file holding the head of the audit log at the path
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// mac returns the hex encoded HMAC-SHA256 of the parts with the audit key, the parts are separated so that they cannot run into each other
+func mac(key []byte, parts ...string) string {
+	hash := hmac.New(sha256.New, key)
+
+	for _, part := range parts {
+		hash.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// HashKeyName returns the HMAC of the name of a key as it is recorded in the audit log, so that the records of a key can be found
+// by anyone holding the audit key
+func HashKeyName(auditKey []byte, key string) string {
+	return mac(auditKey, "key", key)
+}
+
+// hash returns the hash of the record chained to the hash of the record before it, the hash of the record itself is left out
+func (ar AuditRecord) hash(key []byte) string {
+	ar.Hash = ""
+
+	body, _ := json.Marshal(ar)
+
+	return mac(key, "record", ar.PreviousHash, string(body))
+}
+
+// sign sets the HMAC of the head, which covers its sequence and hash
+func (ah *AuditHead) sign(key []byte) {
+	ah.MAC = mac(key, "head", strconv.FormatInt(ah.Sequence, 10), ah.Hash)
+}
+
+// readAuditHead reads the head of the audit log at the path, a zero head is returned when the log has not been written to yet
+func readAuditHead(path string, key []byte) (AuditHead, error) {
+	var head AuditHead
+
+	data, err := ioutil.ReadFile(auditHeadPath(path))
+
+	if os.IsNotExist(err) {
+		return head, nil
+	}
+
+	if err != nil {
+		return head, err
+	}
+
+	if err = json.Unmarshal(data, &head); err != nil {
+		return head, fmt.Errorf("the head of the audit log could not be read: %v", err)
+	}
+
+	expected := head
+
+	if expected.sign(key); !hmac.Equal([]byte(head.MAC), []byte(expected.MAC)) {
+		return head, errors.New("the head of the audit log has been tampered with")
+	}
+
+	return head, nil
+}
+
+// VerifyAuditLog checks that every record of the audit log at the path follows on from the one before it and has not been edited,
+// and that the log ends with the record its head names, so records removed from anywhere in the log are noticed; the head of the log
+// is returned, and an error describing the first problem found if the log has been tampered with. A keymanager stopping part way through
+// appending a record can leave the log one record ahead of its head, or end it with an unfinished line, neither of which is tampering
+func VerifyAuditLog(path string, auditKey []byte) (AuditHead, error) {
+	last, _, err := verifyAuditLog(path, auditKey)
+
+	return last, err
+}
+
+// verifyAuditLog verifies the audit log at the path like VerifyAuditLog, also returning the length of the records which were finished
+func verifyAuditLog(path string, auditKey []byte) (AuditHead, int64, error) {
+	var last AuditHead
+
+	head, err := readAuditHead(path, auditKey)
+
+	if err != nil {
+		return last, 0, err
+	}
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) && head.Sequence == 0 {
+		return last, 0, nil
+	}
+
+	if err != nil {
+		return last, 0, err
+	}
+
+	defer file.Close()
+
+	reader, length := bufio.NewReader(file), int64(0)
+
+	var previousHash string
+
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+
+		if err == io.EOF && len(data) != 0 && last.Sequence >= head.Sequence {
+			// The line was never finished, so its request was never answered and it is left out
+			break
+		}
+
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+
+		if err != nil && err != io.EOF {
+			return last, 0, err
+		}
+
+		var record AuditRecord
+
+		if err := json.Unmarshal(data, &record); err != nil {
+			return last, 0, fmt.Errorf("line %d of the audit log could not be read: %v", line, err)
+		}
+
+		switch {
+		case record.Sequence != last.Sequence+1:
+			return last, 0, fmt.Errorf("line %d of the audit log is record %d, expected record %d", line, record.Sequence, last.Sequence+1)
+		case record.PreviousHash != last.Hash:
+			return last, 0, fmt.Errorf("record %d of the audit log does not follow on from record %d", record.Sequence, last.Sequence)
+		case !hmac.Equal([]byte(record.Hash), []byte(record.hash(auditKey))):
+			return last, 0, fmt.Errorf("record %d of the audit log has been edited", record.Sequence)
+		}
+
+		previousHash, last.Hash, last.Sequence = last.Hash, record.Hash, record.Sequence
+
+		length += int64(len(data))
+	}
+
+	switch {
+	case last.Sequence == head.Sequence && last.Hash == head.Hash:
+	case last.Sequence == head.Sequence+1 && previousHash == head.Hash:
+		// The record was written but the keymanager stopped before its head was, the record being chained to the head shows it is genuine
+	default:
+		return last, 0, fmt.Errorf("the audit log ends with record %d, but its head is record %d, so records have been removed from its end", last.Sequence, head.Sequence)
+	}
+
+	last.sign(auditKey)
+
+	return last, length, nil
+}
+
+// openAuditLog opens the audit log at the path for appending, it is verified first so that the chain is only continued from an intact log;
+// an unfinished line at the end of the log is removed and a head left behind by the last record is brought up to it
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	if len(key) == 0 {
+		return nil, ErrAuditKeyRequired
+	}
+
+	head, length, err := verifyAuditLog(path, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	al := &auditLog{file: file, head: head, headPath: auditHeadPath(path), key: key}
+
+	if err = file.Truncate(length); err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	if stored, _ := readAuditHead(path, key); stored != head {
+		if err = al.writeHead(head); err != nil {
+			file.Close()
+
+			return nil, err
+		}
+	}
+
+	return al, nil
+}
+
+// append chains the record to the last record of the log and writes it, followed by the new head of the log; both are synced to the disk
+// before it returns, so a record which has been appended is never lost
+func (al *auditLog) append(record AuditRecord) error {
+	al.mutex.Lock()
+
+	defer al.mutex.Unlock()
+
+	record.PreviousHash, record.Sequence = al.head.Hash, al.head.Sequence+1
+
+	for index, key := range record.Keys {
+		record.Keys[index] = HashKeyName(al.key, key)
+	}
+
+	record.Hash = record.hash(al.key)
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = al.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if err = al.file.Sync(); err != nil {
+		return err
+	}
+
+	head := AuditHead{Hash: record.Hash, Sequence: record.Sequence}
+
+	head.sign(al.key)
+
+	if err = al.writeHead(head); err != nil {
+		return err
+	}
+
+	al.head = head
+
+	return nil
+}
+
+// writeHead replaces the head of the log, it is written to a temporary file which is synced and renamed over the old head, so a crash
+// leaves either the old head or the new one behind
+func (al *auditLog) writeHead(head AuditHead) error {
+	data, err := json.Marshal(head)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(al.headPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(al.headPath+".tmp", al.headPath); err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(al.headPath))
+}
+
+// syncDirectory syncs the directory so that the files renamed into it stay renamed after a crash
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer directory.Close()
+
+	return directory.Sync()
+}
+
+func (al *auditLog) close() error {
+	al.mutex.Lock()
+
+	defer al.mutex.Unlock()
+
+	return al.file.Close()
+}
+
+// peekBody reads the body of the request for the middleware handlers and puts it back for the handler to read, nil is returned when
+// it cannot be read
+func peekBody(c *gin.Context) []byte {
+	if c.Request.Body == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err != nil {
+		return nil
+	}
+
+	return body
+}
+
+// requestedKeys returns the keys the request is for, read from the body field each route takes them in for the routes which take them
+// there: "key" for creating a key, "keys" for reading many and the keys of the "operations" for a transaction; the key a PUT writes is
+// the one in its path, the body only naming it when the path is empty
+func requestedKeys(c *gin.Context) []string {
+	switch c.Request.Method + " " + c.FullPath() {
+	case "POST /key", "PUT /key/*path":
+		var SingleRequest RequestSingle
+
+		json.Unmarshal(peekBody(c), &SingleRequest)
+
+		if written, _ := writtenKey(c, SingleRequest.Key); written != "" {
+			return []string{written}
+		}
+
+		return nil
+	case "POST /keys":
+		var ManyRequest RequestMany
+
+		json.Unmarshal(peekBody(c), &ManyRequest)
+
+		return ManyRequest.Keys
+	case "POST /txn":
+		var TxnRequest RequestTxn
+
+		json.Unmarshal(peekBody(c), &TxnRequest)
+
+		var keys []string
+
+		for _, operation := range TxnRequest.Operations {
+			keys = append(keys, operation.Key)
+		}
+
+		return keys
+	}
+
+	if key := keyParam(c); key != "" {
+		return []string{key}
+	}
+
+	return nil
+}
+
+// auditWriter holds back the response to an audited request until the request has been recorded, so that nothing is sent for a request
+// which could not be recorded; a streamed response is recorded when it is first flushed, and is sent as it is written from then on
+type auditWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	failed   bool
+	record   func() error
+	recorded bool
+}
+
+// finish records the request once, whatever is written after a failed record is dropped
+func (aw *auditWriter) finish() {
+	if !aw.recorded {
+		aw.recorded, aw.failed = true, aw.record() != nil
+	}
+}
+
+func (aw *auditWriter) Write(data []byte) (int, error) {
+	switch {
+	case !aw.recorded:
+		return aw.body.Write(data)
+	case aw.failed:
+		return 0, errAuditFailed
+	}
+
+	return aw.ResponseWriter.Write(data)
+}
+
+func (aw *auditWriter) WriteString(data string) (int, error) {
+	return aw.Write([]byte(data))
+}
+
+func (aw *auditWriter) WriteHeaderNow() {
+	if aw.recorded && !aw.failed {
+		aw.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (aw *auditWriter) Flush() {
+	if aw.finish(); aw.failed {
+		return
+	}
+
+	aw.ResponseWriter.Write(aw.body.Bytes())
+
+	aw.body.Reset()
+
+	aw.ResponseWriter.Flush()
+}
+
+// Audit records every request it handles in the audit log before its response is sent, along with the token it was made with and from
+// where, the keys it was for and how it turned out; it does nothing when the server has no audit log. When a request cannot be recorded
+// its response is replaced by a HTTP/500 status and the server is sealed, since every request which follows would go unrecorded as well
+func (s *Server) Audit(c *gin.Context) {
+	if s.auditLog == nil {
+		c.Next()
+
+		return
+	}
+
+	record := AuditRecord{
+		Keys:      requestedKeys(c),
+		Operation: auditOperations[c.Request.Method+" "+c.FullPath()],
+		SourceIP:  s.sourceIP(c),
+		Time:      time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+
+	defer cancel()
+
+	c.Request = c.Request.WithContext(ctx)
+
+	header := http.Header{}
+
+	for name, values := range c.Writer.Header() {
+		header[name] = values
+	}
+
+	writer := &auditWriter{ResponseWriter: c.Writer}
+
+	writer.record = func() error {
+		record.Actor, record.Result, record.Status = actor(c), AuditSuccess, writer.Status()
+
+		if t := requestToken(c); t != nil {
+			record.TokenID = t.ID
+		}
+
+		if record.Status >= 400 {
+			record.Result = AuditFailure
+		}
+
+		err := s.auditLog.append(record)
+
+		if err != nil {
+			s.logger.Printf("%s %s could not be audited, its response has been withheld and the keymanager sealed: %v", c.Request.Method, c.Request.URL.Path, err)
+
+			// Stopping the handler ends a streamed response, which has nothing left to be sent
+			cancel()
+
+			s.Seal()
+		}
+
+		return err
+	}
+
+	c.Writer = writer
+
+	c.Next()
+
+	c.Writer = writer.ResponseWriter
+
+	if writer.finish(); !writer.failed {
+		c.Writer.Write(writer.body.Bytes())
+
+		return
+	}
+
+	if c.Writer.Written() {
+		return
+	}
+
+	for name := range c.Writer.Header() {
+		delete(c.Writer.Header(), name)
+	}
+
+	for name, values := range header {
+		c.Writer.Header()[name] = values
+	}
+
+	c.AbortWithStatusJSON(500, Response{true, ErrorAuditFailed})
+}
@@ -0,0 +1,292 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var testAuditKey = []byte("fedcba9876543210fedcba9876543210")
+
+// Need to test the following:
+// If a request for the keys is made then a record is appended to the audit log with the name of its token, the source IP forwarded by the gatekeeper,
+//     or the address the request was made from when it was not made by a trusted proxy,
+//     the operation, the HMAC'd names of the keys read from the body field of its route, whatever the other fields name, and the result,
+//     including for requests rejected while the server is sealed,
+//     and neither the names nor the values of the keys appear in the log
+// If the server is restarted then the records carry on from the last record of the log
+// If a record of the log is edited or removed, including from the end of the log, or the log is verified with the wrong key,
+//     then the verification fails and a server cannot be started with the log
+// If the keymanager stopped after writing a record but before its head, or part way through a record, then the log is still intact,
+//     and a server started with it removes the unfinished record and brings the head up to the last record
+// If no audit key is provided with the audit log, or a trusted proxy is not an IP address or CIDR range, then the server cannot be created
+func TestAuditLog(t *testing.T) {
+	directory, err := ioutil.TempDir("", "TestAuditLog")
+
+	if err != nil {
+		t.Fatal("could not create the directory for the audit log:", err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	path, store := filepath.Join(directory, "audit.log"), storage.NewMemory()
+
+	options := Options{AuditKey: testAuditKey, AuditLog: path, MasterKey: testMasterKey, TrustedProxies: []string{"192.0.2.0/24"}}
+
+	server, err := NewServer(store, options, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	bearer := testToken(t, server, "tester")
+
+	remoteAddr := "192.0.2.1:40000"
+
+	serve := func(server *Server, method, path, body string) int {
+		mockRequest, err := http.NewRequest(method, path, strings.NewReader(body))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+bearer)
+		mockRequest.Header.Set(HeaderSourceIP, "203.0.113.7")
+
+		mockRequest.RemoteAddr = remoteAddr
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		server.Handler().ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code
+	}
+
+	serve(server, "POST", "/key", `{"key": "TestAuditLog/password", "value": "hunter2"}`)
+	serve(server, "GET", "/key/TestAuditLog/password", "")
+	serve(server, "GET", "/key/TestAuditLog/missing", "")
+	serve(server, "POST", "/keys", `{"key": "TestAuditLog/decoy", "keys": ["TestAuditLog/password", "TestAuditLog/missing"]}`)
+	serve(server, "GET", "/sys/seal-status", "")
+
+	server.Seal()
+
+	serve(server, "GET", "/key/TestAuditLog/password", "")
+
+	server.Close()
+
+	expectedRecords := []AuditRecord{
+		{Actor: "tester", Keys: []string{"TestAuditLog/password"}, Operation: AuditCreate, Result: AuditSuccess, Status: 201},
+		{Actor: "tester", Keys: []string{"TestAuditLog/password"}, Operation: AuditRead, Result: AuditSuccess, Status: 200},
+		{Actor: "tester", Keys: []string{"TestAuditLog/missing"}, Operation: AuditRead, Result: AuditFailure, Status: 400},
+		{Actor: "tester", Keys: []string{"TestAuditLog/password", "TestAuditLog/missing"}, Operation: AuditRead, Result: AuditSuccess, Status: 200},
+		{Actor: "192.0.2.1", Keys: []string{"TestAuditLog/password"}, Operation: AuditRead, Result: AuditFailure, Status: 503},
+	}
+
+	log, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal("could not read the audit log:", err)
+	}
+
+	if bytes.Contains(log, []byte("TestAuditLog")) || bytes.Contains(log, []byte("hunter2")) {
+		t.Errorf("the audit log holds the names or values of the keys:\n%s", log)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+
+	if len(lines) != len(expectedRecords) {
+		t.Fatalf("the audit log holds %d records, expected %d:\n%s", len(lines), len(expectedRecords), log)
+	}
+
+	for index, expectedRecord := range expectedRecords {
+		var record AuditRecord
+
+		json.Unmarshal([]byte(lines[index]), &record)
+
+		valid := record.Actor == expectedRecord.Actor && record.SourceIP == "203.0.113.7" && record.Sequence == int64(index+1) && record.Operation == expectedRecord.Operation &&
+			record.Result == expectedRecord.Result && record.Status == expectedRecord.Status && len(record.Keys) == len(expectedRecord.Keys)
+
+		for keyIndex := 0; valid && keyIndex < len(record.Keys); keyIndex++ {
+			valid = record.Keys[keyIndex] == HashKeyName(testAuditKey, expectedRecord.Keys[keyIndex])
+		}
+
+		if !valid {
+			t.Errorf("record %d of the audit log = %+v, expected %+v", index+1, record, expectedRecord)
+		}
+	}
+
+	if head, err := VerifyAuditLog(path, testAuditKey); err != nil || head.Sequence != 5 {
+		t.Fatalf("VerifyAuditLog() = %+v, %v, expected the log to be intact with 5 records", head, err)
+	}
+
+	restarted, err := NewServer(store, options, nil)
+
+	if err != nil {
+		t.Fatal("could not restart the server:", err)
+	}
+
+	serve(restarted, "PUT", "/key/", `{"key": "TestAuditLog/password", "value": "rotated"}`)
+
+	remoteAddr = "198.51.100.9:40000"
+
+	serve(restarted, "DELETE", "/key/TestAuditLog/password", "")
+
+	restarted.Close()
+
+	if head, err := VerifyAuditLog(path, testAuditKey); err != nil || head.Sequence != 7 {
+		t.Errorf("VerifyAuditLog() after restarting = %+v, %v, expected the log to be intact with 7 records", head, err)
+	}
+
+	log, _ = ioutil.ReadFile(path)
+
+	lines = strings.Split(strings.TrimSpace(string(log)), "\n")
+
+	var updated AuditRecord
+
+	json.Unmarshal([]byte(lines[5]), &updated)
+
+	if updated.Operation != AuditUpdate || len(updated.Keys) != 1 || updated.Keys[0] != HashKeyName(testAuditKey, "TestAuditLog/password") {
+		t.Errorf("record 6 of the audit log = %+v, expected the update of TestAuditLog/password", updated)
+	}
+
+	var untrusted AuditRecord
+
+	json.Unmarshal([]byte(lines[6]), &untrusted)
+
+	if untrusted.SourceIP != "198.51.100.9" {
+		t.Errorf("the source IP of record 7 of the audit log = %s, expected the forwarded IP to be ignored for a request which was not made by a trusted proxy", untrusted.SourceIP)
+	}
+
+	tamperings := map[string][]string{
+		"an edited record":              append(append([]string{}, lines[:2]...), append([]string{strings.Replace(lines[2], `"status":400`, `"status":200`, 1)}, lines[3:]...)...),
+		"a removed record":              append(append([]string{}, lines[:2]...), lines[3:]...),
+		"a record removed from the end": lines[:len(lines)-1],
+		"every record removed":          {},
+	}
+
+	for description, tampered := range tamperings {
+		if err := ioutil.WriteFile(path, []byte(strings.Join(tampered, "\n")+"\n"), 0600); err != nil {
+			t.Fatal("could not write the audit log:", err)
+		}
+
+		if _, err := VerifyAuditLog(path, testAuditKey); err == nil {
+			t.Errorf("VerifyAuditLog() with %s succeeded, expected it to fail", description)
+		}
+
+		if tamperedServer, err := NewServer(store, options, nil); err == nil {
+			tamperedServer.Close()
+
+			t.Errorf("NewServer() with %s succeeded, expected it to fail", description)
+		}
+	}
+
+	var beforeLast AuditRecord
+
+	json.Unmarshal([]byte(lines[len(lines)-2]), &beforeLast)
+
+	staleHead := AuditHead{Hash: beforeLast.Hash, Sequence: beforeLast.Sequence}
+
+	staleHead.sign(testAuditKey)
+
+	staleHeadData, _ := json.Marshal(staleHead)
+
+	ioutil.WriteFile(auditHeadPath(path), staleHeadData, 0600)
+	ioutil.WriteFile(path, append(append([]byte{}, log...), `{"actor":"unfinis`...), 0600)
+
+	if head, err := VerifyAuditLog(path, testAuditKey); err != nil || head.Sequence != 7 {
+		t.Errorf("VerifyAuditLog() after a crash = %+v, %v, expected the log to be intact with 7 records", head, err)
+	}
+
+	recovered, err := NewServer(store, options, nil)
+
+	if err != nil {
+		t.Fatal("could not restart the server after a crash:", err)
+	}
+
+	recovered.Close()
+
+	if recoveredLog, _ := ioutil.ReadFile(path); !bytes.Equal(recoveredLog, log) {
+		t.Errorf("the audit log after recovering from a crash =\n%s\nexpected the unfinished line to be removed", recoveredLog)
+	}
+
+	if head, err := readAuditHead(path, testAuditKey); err != nil || head.Sequence != 7 {
+		t.Errorf("the head of the audit log after recovering from a crash = %+v, %v, expected record 7", head, err)
+	}
+
+	if _, err := VerifyAuditLog(path, []byte("not the audit key")); err == nil {
+		t.Error("VerifyAuditLog() with the wrong key succeeded, expected it to fail")
+	}
+
+	if _, err := NewServer(store, Options{AuditLog: path, MasterKey: testMasterKey}, nil); err != ErrAuditKeyRequired {
+		t.Errorf("NewServer() without an audit key = %v, expected %v", err, ErrAuditKeyRequired)
+	}
+
+	if _, err := NewServer(store, Options{MasterKey: testMasterKey, TrustedProxies: []string{"gatekeeper"}}, nil); err != ErrInvalidTrustedProxy {
+		t.Errorf("NewServer() with a trusted proxy which is not an IP address = %v, expected %v", err, ErrInvalidTrustedProxy)
+	}
+}
+
+// Need to test the following:
+// If a request cannot be recorded in the audit log then a HTTP/500 status is returned in place of its response, which is never sent,
+//     and the server is sealed
+// If a streamed request cannot be recorded in the audit log then nothing is streamed, and the stream is ended
+func TestAuditFailure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "TestAuditFailure")
+
+	if err != nil {
+		t.Fatal("could not create the directory for the audit log:", err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	server, err := NewServer(storage.NewMemory(), Options{AuditKey: testAuditKey, AuditLog: filepath.Join(directory, "audit.log"), MasterKey: testMasterKey, RootToken: testRootToken}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	defer server.Close()
+
+	server.keys.set("TestAuditFailure", "hunter2", writeOptions{})
+
+	// Closing the file of the audit log makes every record appended to it fail
+	server.auditLog.file.Close()
+
+	for _, path := range []string{"/key/TestAuditFailure", "/watch?values=true"} {
+		if err := server.Unseal(testMasterKey); err != nil {
+			t.Fatal("could not unseal the server:", err)
+		}
+
+		mockRequest, err := http.NewRequest("GET", path, nil)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		server.Handler().ServeHTTP(mockResponseWriter, mockRequest)
+
+		var response Response
+
+		json.NewDecoder(mockResponseWriter.Body).Decode(&response)
+
+		if mockResponseWriter.Code != 500 || response.Message != ErrorAuditFailed || mockResponseWriter.Header().Get("Content-Type") == "text/event-stream" {
+			t.Errorf("GET %s without an audit log to record it in = HTTP/%d %+v, expected HTTP/500 with %q", path, mockResponseWriter.Code, response, ErrorAuditFailed)
+		}
+
+		if !server.IsSealed() {
+			t.Errorf("the server is unsealed after GET %s could not be audited, expected it to be sealed", path)
+		}
+	}
+}
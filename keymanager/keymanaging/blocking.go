@@ -0,0 +1,131 @@
+package keymanaging
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderIndex is the response header holding the revision the keys were read at, it is passed back as the "index" of the next blocking query
+const HeaderIndex = "X-KeyMan-Index"
+
+// The time a blocking query waits for when no "wait" is provided, and the longest it can be asked to wait for
+const (
+	DefaultWait = 5 * time.Minute
+	MaxWait     = 10 * time.Minute
+)
+
+// currentRevision returns the revision of the last change to any key
+func (kd *keyData) currentRevision() (int64, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return readRevision(store, revisionKey)
+}
+
+// changedSince reports whether the key has been created, updated or deleted after the revision; a revision from before the retained
+// events counts as changed since it cannot be told otherwise
+func (kd *keyData) changedSince(key string, index int64) (bool, error) {
+	events, _, err := kd.events(key, index, false, nil)
+
+	if err == errRevisionCompacted {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, event := range events {
+		if event.Key == key {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// waitForChange blocks until the key changes after the revision, the wait is over or the context is done, whichever comes first
+func (kd *keyData) waitForChange(ctx context.Context, key string, index int64, wait time.Duration) error {
+	timeout := time.NewTimer(wait)
+
+	defer timeout.Stop()
+
+	for {
+		changed := kd.changes.wait()
+
+		if found, err := kd.changedSince(key, index); err != nil || found {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout.C:
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// parseBlockingQuery reads the "index" and "wait" query parameters of a blocking query, false is returned first when no index is provided
+// and the query does not block
+func parseBlockingQuery(c *gin.Context) (bool, int64, time.Duration, bool) {
+	query, wait := c.Query("index"), DefaultWait
+
+	if query == "" {
+		return false, 0, 0, true
+	}
+
+	index, err := strconv.ParseInt(query, 10, 64)
+
+	if err != nil || index < 0 {
+		return false, 0, 0, false
+	}
+
+	if waitQuery := c.Query("wait"); waitQuery != "" {
+		if wait, err = time.ParseDuration(waitQuery); err != nil || wait <= 0 || wait > MaxWait {
+			return false, 0, 0, false
+		}
+	}
+
+	return true, index, wait, true
+}
+
+// blockOnKey makes a read of the key a blocking query when an "index" is provided, waiting until the key changes after that revision
+// or the "wait" is over before the key is read, in the style of Consul; the revision the key is read at is set as the X-KeyMan-Index header.
+// False is returned when the request has been aborted
+func (s *Server) blockOnKey(c *gin.Context, key string) bool {
+	blocking, index, wait, valid := parseBlockingQuery(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidWait})
+
+		return false
+	}
+
+	if blocking {
+		if err := s.keys.waitForChange(c.Request.Context(), key, index, wait); err != nil {
+			s.abortWithError(c, err.Error(), err)
+
+			return false
+		}
+	}
+
+	revision, err := s.keys.currentRevision()
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return false
+	}
+
+	c.Writer.Header().Set(HeaderIndex, strconv.FormatInt(revision, 10))
+
+	return true
+}
@@ -0,0 +1,94 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// If a key is read then the revision it was read at is returned in the X-KeyMan-Index header
+// If the index provided is older than the last change to the key then its value is returned right away
+// If the key has not changed since the index provided then the value is only returned once the key changes, or once the wait is over,
+//     changes to other keys not ending the wait
+// If the index is not a whole number, or the wait is not a positive duration of at most 10m, then a HTTP/400 status is returned
+func TestBlockingQuery(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	server.keys.set("TestBlockingQuery", "first", writeOptions{})
+
+	type result struct {
+		code    int
+		elapsed time.Duration
+		index   string
+		value   string
+	}
+
+	serve := func(query string) <-chan result {
+		results := make(chan result, 1)
+
+		mockRequest, err := http.NewRequest("GET", "/key/TestBlockingQuery"+query, nil)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		go func() {
+			start, mockResponseWriter := time.Now(), httptest.NewRecorder()
+
+			handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+			var response ValueResponse
+
+			json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+			value, _ := response.Message.(string)
+
+			results <- result{mockResponseWriter.Code, time.Since(start), mockResponseWriter.Header().Get(HeaderIndex), value}
+		}()
+
+		return results
+	}
+
+	if read := <-serve(""); read.code != 200 || read.index != "1" || read.value != "first" {
+		t.Fatalf(`GET /key/TestBlockingQuery = HTTP/%d "%s" at index %s, expected HTTP/200 "first" at index 1`, read.code, read.value, read.index)
+	}
+
+	if read := <-serve("?index=0&wait=5s"); read.code != 200 || read.value != "first" || read.elapsed > time.Second {
+		t.Errorf(`GET /key/TestBlockingQuery?index=0 = HTTP/%d "%s" after %v, expected HTTP/200 "first" right away`, read.code, read.value, read.elapsed)
+	}
+
+	if read := <-serve("?index=1&wait=100ms"); read.code != 200 || read.value != "first" || read.index != "1" || read.elapsed < 100*time.Millisecond {
+		t.Errorf(`GET /key/TestBlockingQuery?index=1&wait=100ms = HTTP/%d "%s" at index %s after %v, expected HTTP/200 "first" at index 1 after the wait`, read.code, read.value, read.index, read.elapsed)
+	}
+
+	blocked := serve("?index=1&wait=5s")
+
+	time.Sleep(50 * time.Millisecond)
+
+	server.keys.set("TestBlockingQueryOther", "other", writeOptions{})
+
+	select {
+	case read := <-blocked:
+		t.Fatalf(`GET /key/TestBlockingQuery?index=1 = HTTP/%d "%s" after another key changed, expected it to keep waiting`, read.code, read.value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.keys.set("TestBlockingQuery", "second", writeOptions{})
+
+	if read := <-blocked; read.code != 200 || read.value != "second" || read.index != "3" || read.elapsed > 4*time.Second {
+		t.Errorf(`GET /key/TestBlockingQuery?index=1 = HTTP/%d "%s" at index %s after %v, expected HTTP/200 "second" at index 3 once the key changed`, read.code, read.value, read.index, read.elapsed)
+	}
+
+	for _, query := range []string{"?index=-1", "?index=latest", "?index=3&wait=20m", "?index=3&wait=soon", "?index=3&wait=-1s"} {
+		if read := <-serve(query); read.code != 400 {
+			t.Errorf("GET /key/TestBlockingQuery%s = HTTP/%d, expected HTTP/400", query, read.code)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errRevisionMismatch = errors.New(ErrorRevisionMismatch)
+
+// revisionKey is the storage key of the last revision handed out, every version written is stamped with the next one
+const revisionKey = "sys/revision"
+
+// RequestDelete is the struct representing the format that DELETE requests can optionally use to only delete a key at the "cas" revision
+type RequestDelete struct {
+	CAS *int64 `json:"cas,omitempty"`
+}
+
+// revisionMatch is the revision a key has to be at for a change to go ahead, "any" only requires that the key exists
+type revisionMatch struct {
+	any       bool
+	revisions []int64
+}
+
+// etag formats the revision as the strong entity tag of the key
+func etag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// nextRevision hands out the revision following the last one, within the transaction so that a discarded transaction does not use it up;
+// every change is recorded as an event at its own revision by recordEvent
+func nextRevision(txn storage.Txn) (int64, error) {
+	revision, err := readRevision(txn, revisionKey)
+
+	if err != nil {
+		return 0, err
+	}
+
+	revision++
+
+	return revision, txn.Put(revisionKey, []byte(strconv.FormatInt(revision, 10)))
+}
+
+// revision returns the revision of the current version of the key, keys written before revisions existed are at revision 0
+func (e *entry) revision() int64 {
+	return e.current().Revision
+}
+
+// matches reports whether the entry of a key is at one of the revisions, nil meaning that the key does not exist
+func (rm *revisionMatch) matches(e *entry) bool {
+	if rm == nil {
+		return true
+	}
+
+	if e == nil {
+		return false
+	}
+
+	if rm.any {
+		return true
+	}
+
+	for _, revision := range rm.revisions {
+		if revision == e.revision() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRevisionMatch reads the If-Match header and the "cas" revision of the body into the revisions a key has to be at, both have to
+// hold when both are provided; nil is returned when neither is provided
+func parseRevisionMatch(c *gin.Context, cas *int64) ([]*revisionMatch, bool) {
+	var matches []*revisionMatch
+
+	if header := strings.TrimSpace(c.GetHeader("If-Match")); header != "" {
+		ifMatch := &revisionMatch{}
+
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+			if tag == "*" {
+				ifMatch.any = true
+
+				continue
+			}
+
+			revision, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+
+			if err != nil || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				return nil, false
+			}
+
+			ifMatch.revisions = append(ifMatch.revisions, revision)
+		}
+
+		matches = append(matches, ifMatch)
+	}
+
+	if cas != nil {
+		matches = append(matches, &revisionMatch{revisions: []int64{*cas}})
+	}
+
+	return matches, true
+}
+
+// matchesRevisions reports whether the entry of a key is at every one of the revisions required
+func matchesRevisions(e *entry, matches []*revisionMatch) bool {
+	for _, match := range matches {
+		if !match.matches(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseDeleteRequest reads the optional body of a DELETE request, an empty body is the same as one without a "cas" revision
+func parseDeleteRequest(c *gin.Context) (RequestDelete, bool) {
+	var DeleteRequest RequestDelete
+
+	if c.Request.Body == nil {
+		return DeleteRequest, true
+	}
+
+	err := json.NewDecoder(c.Request.Body).Decode(&DeleteRequest)
+
+	return DeleteRequest, err == nil || err == io.EOF
+}
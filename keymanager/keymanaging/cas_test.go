@@ -0,0 +1,175 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Need to test the following:
+// If a key is read then its revision is returned as the ETag, and every write of any key moves the revision forward
+// If the If-Match header or the "cas" field matches the revision of the key then the update, rollback or deletion goes ahead and the new ETag is returned
+// If the If-Match header or the "cas" field does not match the revision of the key then a HTTP/412 status is returned and the key is left as it was
+// If the If-Match header is "*" then the change goes ahead as long as the key exists
+// If the If-Match header is not "*" or a list of quoted revisions then a HTTP/400 status is returned
+func TestCompareAndSwap(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	serve := func(method, path, ifMatch string, body interface{}) (int, string) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		if ifMatch != "" {
+			mockRequest.Header.Set("If-Match", ifMatch)
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Header().Get("ETag")
+	}
+
+	serve("POST", "/key", "", RequestSingle{Key: "TestCompareAndSwapOther", Value: "other"})
+
+	code, created := serve("POST", "/key", "", RequestSingle{Key: "TestCompareAndSwap", Value: "first"})
+
+	if code != 201 || created != `"2"` {
+		t.Fatalf(`POST /key = HTTP/%d with ETag %s, expected HTTP/201 with ETag "2"`, code, created)
+	}
+
+	if code, read := serve("GET", "/key/TestCompareAndSwap", "", nil); code != 200 || read != created {
+		t.Fatalf("GET /key/TestCompareAndSwap = HTTP/%d with ETag %s, expected HTTP/200 with ETag %s", code, read, created)
+	}
+
+	cas := func(revision int64) *int64 {
+		return &revision
+	}
+
+	tests := []struct {
+		Body               interface{}
+		ExpectedETag       string
+		ExpectedStatusCode int
+		ExpectedValue      string
+		IfMatch            string
+		Method             string
+	}{
+		{
+			Body:               RequestSingle{Key: "TestCompareAndSwap", Value: "second"},
+			ExpectedETag:       `"3"`,
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "second",
+			IfMatch:            `"1", "2"`,
+			Method:             "PUT",
+		},
+		{
+			Body:               RequestSingle{Key: "TestCompareAndSwap", Value: "stale"},
+			ExpectedStatusCode: 412,
+			ExpectedValue:      "second",
+			IfMatch:            `"2"`,
+			Method:             "PUT",
+		},
+		{
+			Body:               RequestSingle{CAS: cas(2), Key: "TestCompareAndSwap", Value: "stale"},
+			ExpectedStatusCode: 412,
+			ExpectedValue:      "second",
+			Method:             "PUT",
+		},
+		{
+			Body:               RequestSingle{CAS: cas(3), Key: "TestCompareAndSwap", Value: "third"},
+			ExpectedETag:       `"4"`,
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "third",
+			Method:             "PUT",
+		},
+		{
+			Body:               RequestSingle{Key: "TestCompareAndSwap", Value: "fourth"},
+			ExpectedETag:       `"5"`,
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "fourth",
+			IfMatch:            "*",
+			Method:             "PUT",
+		},
+		{
+			Body:               RequestSingle{Key: "TestCompareAndSwap", Value: "invalid"},
+			ExpectedStatusCode: 400,
+			ExpectedValue:      "fourth",
+			IfMatch:            "5",
+			Method:             "PUT",
+		},
+		{
+			ExpectedStatusCode: 412,
+			ExpectedValue:      "fourth",
+			IfMatch:            `"4"`,
+			Method:             "DELETE",
+		},
+		{
+			Body:               RequestDelete{CAS: cas(4)},
+			ExpectedStatusCode: 412,
+			ExpectedValue:      "fourth",
+			Method:             "DELETE",
+		},
+		{
+			Body:               RequestDelete{CAS: cas(5)},
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "",
+			Method:             "DELETE",
+		},
+	}
+
+	for index, test := range tests {
+		code, tag := serve(test.Method, "/key/TestCompareAndSwap", test.IfMatch, test.Body)
+
+		if code != test.ExpectedStatusCode || tag != test.ExpectedETag {
+			t.Errorf("%s /key/TestCompareAndSwap for test %d = HTTP/%d with ETag %s, expected HTTP/%d with ETag %s", test.Method, index, code, tag, test.ExpectedStatusCode, test.ExpectedETag)
+		}
+
+		if value, _, _ := server.keys.get("TestCompareAndSwap"); value != test.ExpectedValue {
+			t.Errorf(`keys["TestCompareAndSwap"] after test %d = "%s", expected "%s"`, index, value, test.ExpectedValue)
+		}
+	}
+
+	if code, _ := serve("PUT", "/key/TestCompareAndSwapMissing", "*", RequestSingle{Key: "TestCompareAndSwapMissing", Value: "missing"}); code != 400 {
+		t.Errorf("PUT /key/TestCompareAndSwapMissing with If-Match * = HTTP/%d, expected HTTP/400", code)
+	}
+
+	server.keys.set("TestCompareAndSwapRollback", "first", writeOptions{})
+	server.keys.set("TestCompareAndSwapRollback", "second", writeOptions{})
+
+	_, current := serve("GET", "/key/TestCompareAndSwapRollback", "", nil)
+
+	revision, _ := strconv.ParseInt(strings.Trim(current, `"`), 10, 64)
+
+	if code, _ := serve("POST", "/rollback/TestCompareAndSwapRollback", "", RequestRollback{CAS: cas(revision - 1), Version: 1}); code != 412 {
+		t.Errorf("POST /rollback/TestCompareAndSwapRollback with a stale cas = HTTP/%d, expected HTTP/412", code)
+	}
+
+	if value, _, _ := server.keys.get("TestCompareAndSwapRollback"); value != "second" {
+		t.Errorf(`keys["TestCompareAndSwapRollback"] after a rollback with a stale cas = "%s", expected "second"`, value)
+	}
+
+	if code, _ := serve("POST", "/rollback/TestCompareAndSwapRollback", "", RequestRollback{CAS: cas(revision), Version: 1}); code != 200 {
+		t.Errorf("POST /rollback/TestCompareAndSwapRollback with the current cas = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if value, _, _ := server.keys.get("TestCompareAndSwapRollback"); value != "first" {
+		t.Errorf(`keys["TestCompareAndSwapRollback"] after a rollback with the current cas = "%s", expected "first"`, value)
+	}
+}
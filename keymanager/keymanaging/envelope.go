@@ -0,0 +1,163 @@
+package keymanaging
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	ErrUnknownKEKVersion = errors.New("the key encryption key version which wrapped the value is not in the keyring")
+	ErrUnsealValue       = errors.New("the value could not be decrypted")
+)
+
+// keyring holds every version of the key encryption key (KEK), old versions are never removed so that
+// values wrapped by them, including values in old backups of the keys file, can always be opened
+type keyring struct {
+	Current int            `json:"current"`
+	KEKs    map[int][]byte `json:"keks"`
+}
+
+// sealedValue is a value encrypted with its own data encryption key (DEK), the DEK is stored alongside it
+// wrapped by the version of the KEK recorded in "KEKVersion"
+type sealedValue struct {
+	KEKVersion int    `json:"kekVersion"`
+	WrappedDEK []byte `json:"wrappedDek"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func newRandomKey() []byte {
+	key := make([]byte, 32)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+func newKeyring() *keyring {
+	return &keyring{
+		Current: 1,
+		KEKs:    map[int][]byte{1: newRandomKey()},
+	}
+}
+
+// clone copies the keyring so that a rotation can be prepared without changing the keyring in use
+func (kr *keyring) clone() *keyring {
+	clone := &keyring{Current: kr.Current, KEKs: make(map[int][]byte, len(kr.KEKs))}
+
+	for version, kek := range kr.KEKs {
+		clone.KEKs[version] = kek
+	}
+
+	return clone
+}
+
+// rotate adds a new KEK version to the keyring and makes it the current one
+func (kr *keyring) rotate() int {
+	kr.Current++
+	kr.KEKs[kr.Current] = newRandomKey()
+
+	return kr.Current
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return aead
+}
+
+// sealWithKey encrypts the plaintext with AES-256-GCM, the random nonce is prepended to the ciphertext
+func sealWithKey(key, plaintext, additionalData []byte) []byte {
+	aead := newGCM(key)
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+func openWithKey(key, sealed, additionalData []byte) ([]byte, error) {
+	aead := newGCM(key)
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrUnsealValue
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+
+	if err != nil {
+		return nil, ErrUnsealValue
+	}
+
+	return plaintext, nil
+}
+
+// seal encrypts the value for the given key with a new DEK and wraps that DEK with the current KEK
+func (kr *keyring) seal(key, value string) sealedValue {
+	dek := newRandomKey()
+
+	return sealedValue{
+		KEKVersion: kr.Current,
+		WrappedDEK: sealWithKey(kr.KEKs[kr.Current], dek, nil),
+		Ciphertext: sealWithKey(dek, []byte(value), []byte(key)),
+	}
+}
+
+func (kr *keyring) unwrapDEK(sv sealedValue) ([]byte, error) {
+	kek, exists := kr.KEKs[sv.KEKVersion]
+
+	if !exists {
+		return nil, ErrUnknownKEKVersion
+	}
+
+	return openWithKey(kek, sv.WrappedDEK, nil)
+}
+
+// open unwraps the DEK of the sealed value and uses it to decrypt the value for the given key
+func (kr *keyring) open(key string, sv sealedValue) (string, error) {
+	dek, err := kr.unwrapDEK(sv)
+
+	if err != nil {
+		return "", err
+	}
+
+	value, err := openWithKey(dek, sv.Ciphertext, []byte(key))
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// rewrap unwraps the DEK of the sealed value and wraps it again with the current KEK, the value itself is not re-encrypted
+func (kr *keyring) rewrap(sv sealedValue) (sealedValue, error) {
+	dek, err := kr.unwrapDEK(sv)
+
+	if err != nil {
+		return sv, err
+	}
+
+	return sealedValue{
+		KEKVersion: kr.Current,
+		WrappedDEK: sealWithKey(kr.KEKs[kr.Current], dek, nil),
+		Ciphertext: sv.Ciphertext,
+	}, nil
+}
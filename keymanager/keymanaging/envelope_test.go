@@ -0,0 +1,123 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// storedValue reads the sealed value of the current version of the key straight from the storage of the server
+func storedValue(t *testing.T, server *Server, key string) sealedValue {
+	e, err := readEntry(server.keys.storage, key)
+
+	if err != nil || e == nil {
+		t.Fatal("could not read the key from the storage:", err)
+	}
+
+	return e.current().Value
+}
+
+// Need to test the following:
+// Every value is sealed with its own data encryption key wrapped by the current key encryption key version
+// If the key encryption key is rotated then every data encryption key is rewrapped with the new version,
+//     the ciphertext of the values is unchanged, and the values can still be read
+// If the storage is reopened after the rotation then the rotated keyring is read back from it
+func TestRotateKEK(t *testing.T) {
+	store := storage.NewMemory()
+
+	server, err := NewServer(store, Options{MasterKey: testMasterKey}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	server.keys.set("TestRotateKEK", "first", writeOptions{})
+	server.keys.set("TestRotateKEKAgain", "second", writeOptions{})
+
+	if bytes.Equal(storedValue(t, server, "TestRotateKEK").WrappedDEK, storedValue(t, server, "TestRotateKEKAgain").WrappedDEK) {
+		t.Error("expected every value to be sealed with its own data encryption key")
+	}
+
+	ciphertextBefore := storedValue(t, server, "TestRotateKEK").Ciphertext
+
+	version, err := server.keys.rotateKEK()
+
+	if err != nil || version != 2 {
+		t.Fatalf("keys.rotateKEK() = %d, %v, expected 2, nil", version, err)
+	}
+
+	for key, expectedValue := range map[string]string{"TestRotateKEK": "first", "TestRotateKEKAgain": "second"} {
+		if sv := storedValue(t, server, key); sv.KEKVersion != 2 {
+			t.Errorf(`keys["%s"].KEKVersion = %d, expected 2`, key, sv.KEKVersion)
+		}
+
+		if value, _, _ := server.keys.get(key); value != expectedValue {
+			t.Errorf(`keys["%s"] = "%s", expected "%s"`, key, value, expectedValue)
+		}
+	}
+
+	if !bytes.Equal(ciphertextBefore, storedValue(t, server, "TestRotateKEK").Ciphertext) {
+		t.Error("expected the ciphertext of the value to be unchanged by the rotation")
+	}
+
+	server.Seal()
+
+	if err := server.Unseal(testMasterKey); err != nil {
+		t.Fatal("could not unseal the server again:", err)
+	}
+
+	if value, _, _ := server.keys.get("TestRotateKEK"); value != "first" || server.keys.keyring.Current != 2 {
+		t.Errorf(`keys["TestRotateKEK"] = "%s" with KEK version %d after unsealing again, expected "first" and version 2`, value, server.keys.keyring.Current)
+	}
+}
+
+// Need to test the following:
+// If the master key is not 32 bytes long then ErrInvalidMasterKey is returned
+// If the storage is empty then a new keyring is sealed with the master key and stored, without the keyring readable in it
+// If the keyring in the storage cannot be opened with the master key then ErrWrongMasterKey is returned and the server stays sealed
+// If the server is created without a storage or a way to open one then ErrStorageRequired is returned
+func TestUnseal(t *testing.T) {
+	store := storage.NewMemory()
+
+	server, err := NewServer(store, Options{}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	if !server.IsSealed() {
+		t.Error("expected a server created without a master key to start sealed")
+	}
+
+	if err := server.Unseal([]byte("too short")); err != ErrInvalidMasterKey {
+		t.Errorf("server.Unseal(short key) = %v, expected %v", err, ErrInvalidMasterKey)
+	}
+
+	if err := server.Unseal(testMasterKey); err != nil {
+		t.Fatal("could not unseal the empty storage:", err)
+	}
+
+	storedKeyring, exists, _ := store.Get(keyringKey)
+
+	keyringBytes, _ := json.Marshal(server.keys.keyring)
+
+	if !exists || bytes.Contains(storedKeyring, keyringBytes) || bytes.Contains(storedKeyring, []byte("keks")) {
+		t.Errorf(`store["%s"] = "%s", expected the keyring sealed with the master key`, keyringKey, storedKeyring)
+	}
+
+	server.Seal()
+
+	if err := server.Unseal([]byte("fedcba9876543210fedcba9876543210")); err != ErrWrongMasterKey {
+		t.Errorf("server.Unseal(wrong key) = %v, expected %v", err, ErrWrongMasterKey)
+	}
+
+	if _, _, err := server.keys.get("anything"); err != ErrSealed || !server.IsSealed() {
+		t.Errorf(`keys.get("anything") after a failed unseal = %v, expected %v`, err, ErrSealed)
+	}
+
+	if _, err := NewServer(nil, Options{MasterKey: testMasterKey}, nil); err != ErrStorageRequired {
+		t.Errorf("NewServer(nil, no OpenStorage) = %v, expected %v", err, ErrStorageRequired)
+	}
+}
@@ -0,0 +1,204 @@
+package keymanaging
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errKeyExpired = errors.New(ErrorKeyExpired)
+
+// reapBatchSize is the number of keys in the expiry index the reaper goes through in a single transaction, so that reaping many keys
+// does not hold up the writes made in the meantime
+const reapBatchSize = 100
+
+// expiryKey is the storage key the key is indexed under until it expires, the time is zero padded so that the keys expiring first are
+// listed first
+func expiryKey(expiresAt time.Time, key string) string {
+	return fmt.Sprintf("%s%020d/%s", expiryPrefix, expiresAt.UnixNano(), key)
+}
+
+// expired reports whether the key has outlived its expiry, keys without an expiry never expire
+func (e *entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// remainingTTL formats the time left until the key expires to the second, it is empty for keys without an expiry
+func (e *entry) remainingTTL(now time.Time) string {
+	if e.ExpiresAt == nil {
+		return ""
+	}
+
+	return e.ExpiresAt.Sub(now).Round(time.Second).String()
+}
+
+// parseExpiry reads when a written key expires, from either the "ttl" duration or the "expires_at" time of the request; nil is returned
+// when neither is provided, which leaves the expiry of an existing key as it was
+func parseExpiry(ttlDuration string, expiresAtTime *time.Time, now time.Time) (*time.Time, bool) {
+	switch {
+	case ttlDuration != "" && expiresAtTime != nil:
+		return nil, false
+	case ttlDuration != "":
+		ttl, err := time.ParseDuration(ttlDuration)
+
+		if err != nil || ttl <= 0 {
+			return nil, false
+		}
+
+		expiresAt := now.Add(ttl).UTC()
+
+		return &expiresAt, true
+	case expiresAtTime != nil:
+		if !expiresAtTime.After(now) {
+			return nil, false
+		}
+
+		expiresAt := expiresAtTime.UTC()
+
+		return &expiresAt, true
+	}
+
+	return nil, true
+}
+
+// reapExpired permanently removes every key which has outlived its expiry, returning how many were removed; expired keys are not moved
+// to the trash since whatever they held is no longer meant to be used. The keys are found through the expiry index, which is gone through
+// from the keys expiring first in batches of reapBatchSize, each in a transaction of its own reading only its batch of the index from where
+// the previous batch stopped, until a key which has not expired is reached
+func (kd *keyData) reapExpired() (int, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	now, reaped, after := time.Now(), 0, ""
+
+	for done := false; !done; {
+		batchReaped, batchAfter := 0, after
+
+		err = store.Transaction(func(txn storage.Txn) error {
+			batchReaped, batchAfter = 0, after
+
+			storageKeys, err := txn.ListAfter(expiryPrefix, after, reapBatchSize)
+
+			if err != nil {
+				return err
+			}
+
+			done = len(storageKeys) < reapBatchSize
+
+			for _, storageKey := range storageKeys {
+				batchAfter = storageKey
+
+				indexed := strings.SplitN(strings.TrimPrefix(storageKey, expiryPrefix), "/", 2)
+
+				expiresAt, err := strconv.ParseInt(indexed[0], 10, 64)
+
+				if err != nil || len(indexed) != 2 {
+					return fmt.Errorf("the expiry index holds the malformed key %s", storageKey)
+				}
+
+				if expiresAt > now.UnixNano() {
+					done = true
+
+					return nil
+				}
+
+				e, err := readEntry(txn, indexed[1])
+
+				if err != nil {
+					return err
+				}
+
+				if e == nil || e.ExpiresAt == nil || e.ExpiresAt.UnixNano() != expiresAt {
+					// The key was removed or its expiry changed without its place in the index being updated, which is only dropped
+					if err = txn.Delete(storageKey); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if err = deleteEntry(txn, indexed[1], e); err != nil {
+					return err
+				}
+
+				if _, err = kd.recordEvent(txn, EventDelete, indexed[1], 0); err != nil {
+					return err
+				}
+
+				batchReaped++
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return reaped, err
+		}
+
+		reaped, after = reaped+batchReaped, batchAfter
+	}
+
+	return reaped, nil
+}
+
+// reap removes the expired keys, tokens and wrapped responses, purges the trash and compacts the events once, nothing is done while the server is sealed
+func (s *Server) reap() {
+	if s.IsSealed() {
+		return
+	}
+
+	if reaped, err := s.keys.reapExpired(); err != nil {
+		s.logger.Printf("could not remove the expired keys: %v", err)
+	} else if reaped != 0 {
+		s.logger.Printf("removed %d expired keys", reaped)
+	}
+
+	if purged, err := s.keys.purgeTrash(); err != nil {
+		s.logger.Printf("could not purge the trash: %v", err)
+	} else if purged != 0 {
+		s.logger.Printf("purged %d deleted keys from the trash", purged)
+	}
+
+	if purged, err := s.keys.purgeExpiredTokens(); err != nil {
+		s.logger.Printf("could not remove the expired tokens: %v", err)
+	} else if purged != 0 {
+		s.logger.Printf("removed %d expired tokens", purged)
+	}
+
+	if purged, err := s.keys.purgeExpiredWrappings(); err != nil {
+		s.logger.Printf("could not remove the expired wrapped responses: %v", err)
+	} else if purged != 0 {
+		s.logger.Printf("removed %d expired wrapped responses", purged)
+	}
+
+	if compacted, err := s.keys.compactEvents(); err != nil {
+		s.logger.Printf("could not compact the events: %v", err)
+	} else if compacted != 0 {
+		s.logger.Printf("compacted %d events", compacted)
+	}
+}
+
+// startReaper reaps every interval in the background until the server is closed
+func (s *Server) startReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stopReaper:
+				return
+			case <-ticker.C:
+				s.reap()
+			}
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// Need to test the following:
+// If a key is created with a ttl then reading it returns when it expires and the time left until then
+// If both a ttl and expires_at are provided, or the ttl is not a positive duration, or expires_at is in the past, then a HTTP/400 status is returned
+// If a key has expired then reading or updating it returns a HTTP/410 status with the "ErrorKeyExpired" constant,
+//     and creating it again replaces it with a new key
+// If the server reaps in the background then expired keys are removed from the storage
+// If more keys have expired than are reaped in a single batch then every one of them is reaped, and a key whose expiry was pushed back
+//     is kept with only its new expiry left in the expiry index
+func TestKeyExpiry(t *testing.T) {
+	server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey, RootToken: testRootToken}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	handler := server.Handler()
+
+	serve := func(method, path string, body interface{}) (int, ValueResponse) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		var response ValueResponse
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+		return mockResponseWriter.Code, response
+	}
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	tests := []struct {
+		ExpectedStatusCode int
+		Request            RequestSingle
+	}{
+		{
+			ExpectedStatusCode: 400,
+			Request:            RequestSingle{Key: "TestKeyExpiry", TTL: "1h", ExpiresAt: &future, Value: "failure"},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Request:            RequestSingle{Key: "TestKeyExpiry", TTL: "-1h", Value: "failure"},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Request:            RequestSingle{Key: "TestKeyExpiry", TTL: "an hour", Value: "failure"},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Request:            RequestSingle{Key: "TestKeyExpiry", ExpiresAt: &past, Value: "failure"},
+		},
+		{
+			ExpectedStatusCode: 201,
+			Request:            RequestSingle{Key: "TestKeyExpiry", TTL: "1h", Value: "success"},
+		},
+		{
+			ExpectedStatusCode: 201,
+			Request:            RequestSingle{Key: "TestKeyExpiryAt", ExpiresAt: &future, Value: "success"},
+		},
+	}
+
+	for _, test := range tests {
+		if code, response := serve("POST", "/key", test.Request); code != test.ExpectedStatusCode {
+			t.Errorf(`POST /key with ttl "%s" and expires_at %v = HTTP/%d "%v", expected HTTP/%d`, test.Request.TTL, test.Request.ExpiresAt, code, response.Message, test.ExpectedStatusCode)
+		}
+	}
+
+	for _, key := range []string{"TestKeyExpiry", "TestKeyExpiryAt"} {
+		code, response := serve("GET", "/key/"+key, nil)
+
+		if remaining, err := time.ParseDuration(response.TTL); code != 200 || err != nil || remaining <= 59*time.Minute || remaining > time.Hour || response.ExpiresAt == nil {
+			t.Errorf(`GET /key/%s = HTTP/%d with ttl "%s" and expires_at %v, expected HTTP/200 with about an hour left`, key, code, response.TTL, response.ExpiresAt)
+		}
+	}
+
+	if code, _ := serve("PUT", "/key/TestKeyExpiry", RequestSingle{Key: "TestKeyExpiry", TTL: "1ms", Value: "expiring"}); code != 200 {
+		t.Fatalf("PUT /key/TestKeyExpiry = HTTP/%d, expected HTTP/200", code)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	for _, method := range []string{"GET", "PUT"} {
+		if code, response := serve(method, "/key/TestKeyExpiry", RequestSingle{Key: "TestKeyExpiry", Value: "failure"}); code != 410 || response.Message != ErrorKeyExpired {
+			t.Errorf(`%s /key/TestKeyExpiry once it has expired = HTTP/%d "%v", expected HTTP/410 "%s"`, method, code, response.Message, ErrorKeyExpired)
+		}
+	}
+
+	if code, _ := serve("POST", "/key", RequestSingle{Key: "TestKeyExpiry", Value: "recreated"}); code != 201 {
+		t.Errorf("POST /key for a key which has expired = HTTP/%d, expected HTTP/201", code)
+	}
+
+	if code, response := serve("GET", "/key/TestKeyExpiry", nil); code != 200 || response.Message != "recreated" || response.Version != 1 || response.TTL != "" {
+		t.Errorf(`GET /key/TestKeyExpiry once it is created again = HTTP/%d "%v" at version %d with ttl "%s", expected HTTP/200 "recreated" at version 1 without a ttl`, code, response.Message, response.Version, response.TTL)
+	}
+
+	expiredAt, pushedBackTo := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	for index := 0; index < reapBatchSize+5; index++ {
+		server.keys.set(fmt.Sprintf("TestKeyExpiryBatch/%d", index), "expired", writeOptions{expiresAt: &expiredAt})
+	}
+
+	server.keys.set("TestKeyExpiryPushedBack", "kept", writeOptions{expiresAt: &expiredAt})
+	server.keys.set("TestKeyExpiryPushedBack", "kept", writeOptions{expiresAt: &pushedBackTo})
+
+	if reaped, err := server.keys.reapExpired(); reaped != reapBatchSize+5 || err != nil {
+		t.Errorf("keys.reapExpired() = %d, %v; expected %d, nil", reaped, err, reapBatchSize+5)
+	}
+
+	if indexed, _ := server.keys.storage.List(expiryPrefix); len(indexed) != 2 || indexed[1] != expiryKey(pushedBackTo, "TestKeyExpiryPushedBack") {
+		t.Errorf("the expiry index holds %v after reaping, expected only TestKeyExpiryAt and the new expiry of TestKeyExpiryPushedBack", indexed)
+	}
+
+	store := storage.NewMemory()
+
+	reapingServer, err := NewServer(store, Options{MasterKey: testMasterKey, RootToken: testRootToken, ReapInterval: time.Millisecond}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the reaping server:", err)
+	}
+
+	defer reapingServer.Close()
+
+	expiresAt := time.Now().Add(time.Millisecond)
+
+	reapingServer.keys.set("TestKeyExpiry", "expiring", writeOptions{expiresAt: &expiresAt})
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, exists, _ := store.Get(keyPrefix + "TestKeyExpiry"); !exists {
+			return
+		}
+	}
+
+	t.Error("expected the expired key to be removed from the storage by the reaper")
+}
@@ -2,114 +2,419 @@ package keymanaging
 
 import (
 	"encoding/json"
-	"io"
-	"net/url"
-	"os"
+	"errors"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
 )
 
 const (
 	ErrorBadRequest       string = "could not find a handler for the provided request"
-	ErrorInvalidKey       string = "one or many character in the key provided make it invalid for creation; only numbers and letters are allowed"
+	ErrorInvalidKey       string = "one or many character in the key provided make it invalid for creation; keys are segments separated by \"/\", each made only of numbers, letters, \"-\", \"_\", \".\" and \"~\", which cannot be empty, \".\" or \"..\""
 	ErrorKeyAlreadyExists string = "the key provided for creation already exists"
 	ErrorKeyDoesNotExist  string = "the key provided does not exist"
+	ErrorKeyExpired       string = "the key provided has expired"
+	ErrorKeyMismatch      string = "the key in the body must be left out or be the key in the path"
+	ErrorKeysMissing      string = "one or many of the keys provided do not exist or could not be read"
+	ErrorKeyNotInTrash    string = "the key provided is not in the trash; it was never deleted, has been restored or destroyed, or was purged after the trash retention"
+	ErrorPersistFailed    string = "the change could not be written to the storage and has been rolled back"
+
+	ErrorInvalidIfMatch   string = "the If-Match header provided must be \"*\" or a list of quoted revisions such as \"12\""
+	ErrorRevisionMismatch string = "the key is not at the revision provided; it has been changed or deleted since, and has to be read again"
+
+	ErrorInvalidRevision   string = "the revision provided must be a whole number"
+	ErrorInvalidWait       string = "the index provided must be a whole number, and the wait provided a positive duration of at most 10m such as \"30s\""
+	ErrorRevisionCompacted string = "the changes since the revision provided are no longer retained; the keys have to be read again before watching from the current revision"
+
+	ErrorInvalidToken        string = "the token provided does not exist, has expired or has been revoked"
+	ErrorInvalidTokenRequest string = "a token needs a name, and none of the policies provided can be empty"
+	ErrorPermissionDenied    string = "the token provided is not allowed to make this request"
+	ErrorRevokeRootToken     string = "the root token cannot be revoked; it is removed by restarting the keymanager without it"
+	ErrorTokenRequired       string = "a token must be provided in the Authorization header as \"Bearer <token>\""
+
+	ErrorInvalidPolicy      string = "the policy provided must be an HCL or JSON document of path blocks, each with a valid glob and capabilities from read, create, update, delete, list and deny"
+	ErrorInvalidPolicyCheck string = "the operation checked must be one of read, create, update, delete or list, and exactly one of token and policies must be provided"
+	ErrorPolicyDoesNotExist string = "the policy provided does not exist"
+	ErrorRootPolicy         string = "the root policy is built in and cannot be written"
+
+	ErrorInvalidWrapTTL       string = "the X-Wrap-TTL header provided must be a positive duration such as \"5m\""
+	ErrorInvalidWrappingToken string = "the wrapping token provided does not exist; it was never created, or has expired and been removed"
+	ErrorWrappingTokenExpired string = "the wrapping token provided has expired without being unwrapped"
+	ErrorWrappingTokenUsed    string = "the wrapping token provided has already been unwrapped; if it was not unwrapped by you the wrapped response may have been intercepted"
+
+	ErrorInvalidWebhook      string = "the url provided must be an absolute http or https URL, and the events provided only create, update or delete"
+	ErrorWebhookDoesNotExist string = "the webhook provided does not exist"
+
+	ErrorInvalidFilter       string = "only one of glob and regex can be provided, and it must be a valid pattern; every tag filtered on must be named"
+	ErrorInvalidLimit        string = "the limit provided must be a whole number from 1 to 1000"
+	ErrorTooManyKeys         string = "at most 1000 keys can be read at once"
+	ErrorInvalidExpiry       string = "the ttl provided must be a positive duration such as \"90s\" or \"12h\", or the expires_at provided a time in the future; only one of them can be provided"
+	ErrorInvalidMaxVersions  string = "the number of versions to retain cannot be negative"
+	ErrorInvalidMetadata     string = "a key can carry at most 64 tags, the name of which cannot be empty or hold \":\""
+	ErrorInvalidValue        string = "only one of value, json and binary can be provided, a contentType only along with binary, and the schema provided must be a valid JSON Schema referring only to itself"
+	ErrorSchemaViolation     string = "the value provided does not match the JSON Schema of the key"
+	ErrorInvalidVersion      string = "the version provided must be a positive whole number"
+	ErrorVersionDoesNotExist string = "the version provided does not exist for the key; it was never written or is older than the versions retained"
+
+	ErrorInvalidOperation   string = "the op provided must be one of create, update, delete or check"
+	ErrorInvalidTxnLength   string = "a transaction must be made of 1 to 100 operations"
+	ErrorPreconditionFailed string = "a precondition of the transaction does not hold; none of its operations have been applied"
+
+	ErrorAuditFailed        string = "the request could not be recorded in the audit log, so its response has been withheld and the keymanager sealed"
+	ErrorInvalidUnsealShare string = "the unseal share provided is malformed or does not belong with the shares submitted so far"
+	ErrorSealed             string = "the keymanager is sealed; unseal shares must be submitted to /sys/unseal"
+	ErrorUnsealFailed       string = "the unseal shares submitted did not recover the master key; unsealing has to be started over"
 )
 
+var (
+	errKeyAlreadyExists = errors.New(ErrorKeyAlreadyExists)
+	errKeyDoesNotExist  = errors.New(ErrorKeyDoesNotExist)
+)
+
+var (
+	ErrInvalidMasterKey = errors.New("the master key must be exactly 32 bytes long")
+	ErrWrongMasterKey   = errors.New("the keyring in the storage could not be opened; the master key is wrong or the keyring has been tampered with")
+)
+
+// The storage keys everything is kept under, values are stored under "keyPrefix" followed by their key, and the keys which expire are
+// indexed under "expiryPrefix" followed by when they expire and their key, so that they are listed in the order they expire
+const (
+	expiryPrefix = "expiry/"
+	keyPrefix    = "key/"
+	keyringKey   = "sys/keyring"
+)
+
+// keyData is the barrier between the handlers and the storage: every value is sealed with the keyring before it is
+// put into the storage and opened after it is read back, so the storage itself never holds a plaintext value
 type keyData struct {
-	keys  map[string]string
-	mutex *sync.Mutex
+	changes        *changes
+	eventRetention int
+	keyring        *keyring
+	masterKey      []byte
+	maxVersions    int
+	mutex          *sync.RWMutex
+	storage        storage.Storage
+	trashRetention time.Duration
+	webhookCache   *webhookCache
 }
 
-var keys keyData
+// state returns the keyring and storage in use, or ErrSealed when the keymanager is sealed
+func (kd *keyData) state() (*keyring, storage.Storage, error) {
+	kd.mutex.RLock()
 
-func (kd keyData) cloneKeys() map[string]string {
-	var clone map[string]string
+	defer kd.mutex.RUnlock()
 
-	kd.mutex.Lock()
+	if kd.storage == nil {
+		return nil, nil, ErrSealed
+	}
 
-	for key, value := range kd.keys {
-		clone[key] = value
+	return kd.keyring, kd.storage, nil
+}
+
+// writeValue seals the value of the key and adds it to the entry of the key as a new version at the next revision, returning the version;
+// an expired key which has not been reaped yet is replaced as if it had been, errRevisionMismatch is returned when the key is not
+// at the revisions the options match, and a *schemaError when the value does not match the JSON Schema of the key
+func (kd *keyData) writeValue(txn storage.Txn, kr *keyring, key, value string, options writeOptions) (version, error) {
+	e, err := readEntry(txn, key)
+
+	if err != nil {
+		return version{}, err
 	}
 
-	kd.mutex.Unlock()
+	// A key which has expired but has not been reaped yet is as good as gone, so it is replaced by a key which is created in its place
+	if e != nil && e.expired(time.Now()) {
+		if options.mustExist {
+			return version{}, errKeyExpired
+		}
 
-	return clone
-}
+		e = nil
+	}
 
-func (kd *keyData) delete(key string) {
-	kd.mutex.Lock()
+	switch {
+	case options.mustExist && e == nil:
+		return version{}, errKeyDoesNotExist
+	case options.mustNotExist && e != nil:
+		return version{}, errKeyAlreadyExists
+	}
 
-	delete(kd.keys, key)
+	if !matchesRevisions(e, options.matches) {
+		return version{}, errRevisionMismatch
+	}
 
-	kd.mutex.Unlock()
-}
+	eventType := EventUpdate
 
-func (kd keyData) get(key string) (string, bool) {
-	kd.mutex.Lock()
+	if e == nil {
+		e, eventType = &entry{}, EventCreate
+	}
 
-	value, exists := kd.keys[key]
+	if options.expiresAt != nil {
+		e.ExpiresAt = options.expiresAt
+	}
 
-	kd.mutex.Unlock()
+	if options.maxVersions != 0 {
+		e.MaxVersions = options.maxVersions
+	}
+
+	options.metadata.apply(&e.Metadata)
+
+	if options.schema != nil {
+		e.Schema = options.schema
+
+		if removesSchema(options.schema) {
+			e.Schema = nil
+		}
+	}
+
+	if err = validate(e.Schema, value, options.valueType); err != nil {
+		return version{}, err
+	}
 
-	return value, exists
+	sealed := version{ContentType: options.contentType, Type: options.valueType, Value: kr.seal(key, value)}
+
+	if options.valueType == ValueTypeString {
+		sealed.Type = ""
+	}
+
+	number := 1
+
+	if len(e.Versions) != 0 {
+		number = e.current().Number + 1
+	}
+
+	revision, err := kd.recordEvent(txn, eventType, key, number)
+
+	if err != nil {
+		return version{}, err
+	}
+
+	v := e.add(sealed, options.actor, revision, kd.maxVersions)
+
+	return v, writeEntry(txn, key, e)
 }
 
-func (kd keyData) getMany(keys ...string) map[string]string {
-	keyData := make(map[string]string)
+func (kd *keyData) get(key string) (string, bool, error) {
+	value, v, e, err := kd.read(key, 0)
 
-	kd.mutex.Lock()
+	return v.text(value), e != nil, err
+}
 
-	defer kd.mutex.Unlock()
+// getMany reads the current values of the keys, sorting out the keys which do not exist and the keys which could not be read
+// along with why; an error is only returned when none of the keys can be read, such as while the keymanager is sealed
+func (kd *keyData) getMany(keys ...string) (ManyResponse, error) {
+	response := ManyResponse{Errors: make(map[string]string), Missing: make([]string, 0)}
+
+	values := make(map[string]string)
 
 	for _, key := range keys {
-		value, exists := kd.keys[key]
+		if _, read := values[key]; read {
+			continue
+		}
+
+		value, exists, err := kd.get(key)
 
-		if exists {
-			keyData[key] = value
+		switch err {
+		case nil:
+		case errKeyExpired, ErrUnsealValue:
+			response.Errors[key] = err.Error()
+
+			continue
+		default:
+			return ManyResponse{}, err
 		}
+
+		if !exists {
+			response.Missing = append(response.Missing, key)
+
+			continue
+		}
+
+		values[key] = value
 	}
 
-	return keyData
+	response.Message = values
+
+	return response, nil
 }
 
-func newKeyData() keyData {
+// newKeyData creates sealed key data retaining versions and deleted keys as the options set, it has no storage until it is unsealed
+func newKeyData(options Options) keyData {
 	return keyData{
-		keys:  make(map[string]string),
-		mutex: &sync.Mutex{},
+		changes:        newChanges(),
+		eventRetention: options.EventRetention,
+		maxVersions:    options.MaxVersions,
+		mutex:          &sync.RWMutex{},
+		trashRetention: options.TrashRetention,
+		webhookCache:   &webhookCache{},
 	}
 }
 
-func (kd keyData) set(key, value string) {
+// rotateKEK adds a new version of the key encryption key and rewraps the data encryption key of every value with it, including the values
+// in the trash and the secrets of the webhooks; the rewrapped values and the new keyring are written in a single transaction, so a failure leaves the storage and the keyring
+// in use as they were
+func (kd *keyData) rotateKEK() (int, error) {
 	kd.mutex.Lock()
 
-	kd.keys[key] = value
+	defer kd.mutex.Unlock()
 
-	kd.mutex.Unlock()
+	if kd.storage == nil {
+		return 0, ErrSealed
+	}
+
+	rotated := kd.keyring.clone()
+
+	version := rotated.rotate()
+
+	err := kd.storage.Transaction(func(txn storage.Txn) error {
+		storageKeys, err := txn.List(keyPrefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, storageKey := range storageKeys {
+			key := strings.TrimPrefix(storageKey, keyPrefix)
+
+			e, err := readEntry(txn, key)
+
+			if err != nil {
+				return err
+			}
+
+			if err = rewrapEntry(rotated, e); err != nil {
+				return err
+			}
+
+			if err = writeEntry(txn, key, e); err != nil {
+				return err
+			}
+		}
+
+		if storageKeys, err = txn.List(trashPrefix); err != nil {
+			return err
+		}
+
+		for _, storageKey := range storageKeys {
+			key := strings.TrimPrefix(storageKey, trashPrefix)
+
+			trashed, err := readTrashed(txn, key)
+
+			if err != nil {
+				return err
+			}
+
+			for index := range trashed {
+				if err = rewrapEntry(rotated, &trashed[index].Entry); err != nil {
+					return err
+				}
+			}
+
+			if err = writeTrashed(txn, key, trashed); err != nil {
+				return err
+			}
+		}
+
+		if err = rewrapWebhooks(txn, rotated); err != nil {
+			return err
+		}
+
+		return writeKeyring(txn, kd.masterKey, rotated)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	kd.keyring = rotated
+
+	return version, nil
 }
 
-// LoadKeyDataKeys tries to read from the provided reader into "keys.keys"
-func LoadKeyDataKeys(r io.Reader) error {
-	keys.mutex.Lock()
+// rewrapEntry rewraps the data encryption key of every version of the entry with the current key encryption key of the keyring
+func rewrapEntry(kr *keyring, e *entry) error {
+	var err error
+
+	for i := range e.Versions {
+		if e.Versions[i].Value, err = kr.rewrap(e.Versions[i].Value); err != nil {
+			return err
+		}
+	}
 
-	err := json.NewDecoder(r).Decode(&keys.keys)
+	return nil
+}
 
-	keys.mutex.Unlock()
+// set writes the value as a new version of the key, returning the version
+func (kd *keyData) set(key, value string, options writeOptions) (version, error) {
+	kr, store, err := kd.state()
 
-	return err
+	if err != nil {
+		return version{}, err
+	}
+
+	var v version
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		v, err = kd.writeValue(txn, kr, key, value, options)
+
+		return err
+	})
+
+	return v, err
 }
 
-// UnloadKeyDataKeys tries to write "keys.keys" to the provided writer
-func UnloadKeyDataKeys(w io.Writer) error {
-	keys.mutex.Lock()
+// writeKeyring seals the keyring with the master key and puts it into the storage, the storage key is used as the additional
+// authenticated data so that the keyring cannot be swapped with another value
+func writeKeyring(txn storage.Txn, masterKey []byte, kr *keyring) error {
+	data, err := json.Marshal(kr)
 
-	err := json.NewEncoder(w).Encode(&keys.keys)
+	if err != nil {
+		return err
+	}
+
+	return txn.Put(keyringKey, sealWithKey(masterKey, data, []byte(keyringKey)))
+}
 
-	keys.mutex.Unlock()
+// unseal opens the keyring in the storage with the master key, or creates a new keyring when the storage does not hold one yet,
+// and starts using the storage; a keyring which cannot be opened means that the master key is wrong
+func (kd *keyData) unseal(store storage.Storage, masterKey []byte) error {
+	if len(masterKey) != 32 {
+		return ErrInvalidMasterKey
+	}
+
+	data, exists, err := store.Get(keyringKey)
+
+	if err != nil {
+		return err
+	}
+
+	kr := newKeyring()
+
+	if exists {
+		data, err = openWithKey(masterKey, data, []byte(keyringKey))
 
-	return err
+		if err != nil {
+			return ErrWrongMasterKey
+		}
+
+		if err = json.Unmarshal(data, kr); err != nil {
+			return err
+		}
+	} else if err = writeKeyring(store, masterKey, kr); err != nil {
+		return err
+	}
+
+	kd.mutex.Lock()
+
+	kd.webhookCache.invalidate()
+
+	kd.keyring, kd.masterKey, kd.storage = kr, masterKey, &notifyingStorage{Storage: store, changes: kd.changes}
+
+	kd.mutex.Unlock()
+
+	return nil
 }
 
 // Response represents the response which will occur from any route in the keymanaging package
@@ -118,19 +423,35 @@ type Response struct {
 	Message interface{} `json:"msg"`
 }
 
-// RequestSingle is the struct representing the format that POST and PUT requests will use to create and update a single key value pair
+// RequestSingle is the struct representing the format that POST and PUT requests will use to create and update a single key value pair,
+// a key expires after the "ttl" duration or at the "expires_at" time when either is provided, and an update only goes ahead when the key
+// is at the "cas" revision if it is provided; the description, owner and tags of the key are written along with the value
 type RequestSingle struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	MetadataUpdate
+	TypedValue
+	CAS         *int64     `json:"cas,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Key         string     `json:"key"`
+	MaxVersions int        `json:"maxVersions,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	Value       string     `json:"value"`
 }
 
-// RequestMany is the struct representing the format that requests will use to get many key value pairs
+// RequestMany is the struct representing the format that requests will use to get many key value pairs, with "failOnMissing"
+// the whole request fails when any of the keys does not exist or could not be read
 type RequestMany struct {
-	Keys []string `json:"keys"`
+	FailOnMissing bool     `json:"failOnMissing,omitempty"`
+	Keys          []string `json:"keys"`
 }
 
-func init() {
-	keys = newKeyData()
+// ManyResponse is the response to a request for many key value pairs: the message holds the values of the keys which were found,
+// "missing" lists the keys which do not exist and "errors" holds why each of the other keys could not be read; when the request fails
+// the message holds the error instead
+type ManyResponse struct {
+	Error   bool              `json:"error"`
+	Errors  map[string]string `json:"errors"`
+	Message interface{}       `json:"msg"`
+	Missing []string          `json:"missing"`
 }
 
 // NewKeyManagingRouter creates a router with the recovery middleware and a no route handler attached
@@ -172,39 +493,121 @@ func CreateInfoHandler(r *gin.Engine) func(c *gin.Context) {
 	}
 }
 
-// HandleDeleteKey handles the DELETE request for deletion of an existing key/value pair
-func HandleDeleteKey(c *gin.Context) {
-	_, exists := keys.get(c.Param("key"))
+// abortWithError logs the error behind a failed request and responds with a HTTP/500 status and the message
+func (s *Server) abortWithError(c *gin.Context, message string, err error) {
+	s.logger.Printf("%s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
 
-	if exists {
-		keys.delete(c.Param("key"))
+	c.AbortWithStatusJSON(500, Response{true, message})
+}
+
+// HandleDeleteKey handles the DELETE request for deletion of an existing key/value pair, the key is moved to the trash
+// from where it can be restored until it is destroyed or purged; when the If-Match header or the "cas" field of the body
+// is provided the key is only deleted at that revision
+func (s *Server) HandleDeleteKey(c *gin.Context) {
+	DeleteRequest, valid := parseDeleteRequest(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
 	}
 
-	if !exists {
+	matches, valid := parseRevisionMatch(c, DeleteRequest.CAS)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidIfMatch})
+
+		return
+	}
+
+	err := s.keys.delete(keyParam(c), actor(c), matches)
+
+	switch err {
+	case nil:
+	case errRevisionMismatch:
+		c.AbortWithStatusJSON(412, Response{true, ErrorRevisionMismatch})
+
+		return
+	case errKeyDoesNotExist:
 		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
 
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
 		return
 	}
 
-	c.Writer.Header().Set("update", "update")
 	c.JSON(200, Response{false, ""})
 }
 
-// HandleGetKey handles the GET request for the value of an existing key
-func HandleGetKey(c *gin.Context) {
-	value, exists := keys.get(c.Param("key"))
+// HandleGetKey handles the GET request for the value of an existing key, the "version" query parameter selects an older version than the current one
+// and the "index" and "wait" query parameters make it a blocking query; a path ending with the separator is a prefix, whose children are listed instead
+func (s *Server) HandleGetKey(c *gin.Context) {
+	if key := keyParam(c); key == "" || strings.HasSuffix(key, KeySeparator) {
+		s.HandleListChildren(c)
+
+		return
+	}
+
+	number, valid := parseVersion(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidVersion})
 
-	if !exists {
+		return
+	}
+
+	if !s.blockOnKey(c, keyParam(c)) {
+		return
+	}
+
+	value, v, e, err := s.keys.read(keyParam(c), number)
+
+	switch err {
+	case nil:
+	case errKeyExpired:
+		c.AbortWithStatusJSON(410, Response{true, ErrorKeyExpired})
+
+		return
+	case errVersionDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorVersionDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if e == nil {
 		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
 
 		return
 	}
 
-	c.JSON(200, Response{false, value})
+	c.Writer.Header().Set("ETag", etag(e.revision()))
+
+	if acceptsOctetStream(c) {
+		c.Data(200, v.contentType(), []byte(value))
+
+		return
+	}
+
+	c.JSON(200, ValueResponse{
+		ContentType: v.ContentType,
+		Error:       false,
+		ExpiresAt:   e.ExpiresAt,
+		Message:     v.native(value),
+		Revision:    e.revision(),
+		TTL:         e.remainingTTL(time.Now()),
+		Type:        v.valueType(),
+		Version:     v.Number,
+	})
 }
 
 // HandleGetManyKeys handles a POST request for the values of many existing keys
-func HandleGetManyKeys(c *gin.Context) {
+func (s *Server) HandleGetManyKeys(c *gin.Context) {
 	var GetManyRequest RequestMany
 
 	err := json.NewDecoder(c.Request.Body).Decode(&GetManyRequest)
@@ -215,14 +618,48 @@ func HandleGetManyKeys(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{
-		"err": false,
-		"msg": keys.getMany(GetManyRequest.Keys...),
-	})
+	if len(GetManyRequest.Keys) > MaxListLimit {
+		c.AbortWithStatusJSON(400, Response{true, ErrorTooManyKeys})
+
+		return
+	}
+
+	response, err := s.keys.getMany(GetManyRequest.Keys...)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if GetManyRequest.FailOnMissing && (len(response.Missing) != 0 || len(response.Errors) != 0) {
+		response.Error, response.Message = true, ErrorKeysMissing
+
+		c.AbortWithStatusJSON(400, response)
+
+		return
+	}
+
+	c.JSON(200, response)
 }
 
-// HandlePostKey handles the POST request for the creation of a key/value pair which does not already exist
-func HandlePostKey(c *gin.Context) {
+// HandleRotateKEK handles the POST request for rotating the key encryption key, every data encryption key is rewrapped
+// with the new key encryption key while the values themselves are left untouched
+func (s *Server) HandleRotateKEK(c *gin.Context) {
+	version, err := s.keys.rotateKEK()
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, gin.H{"kekVersion": version}})
+}
+
+// HandlePostKey handles the POST request for the creation of a key/value pair which does not already exist, the revision of the key
+// is returned as its ETag
+func (s *Server) HandlePostKey(c *gin.Context) {
 	var UpdateRequest RequestSingle
 
 	err := json.NewDecoder(c.Request.Body).Decode(&UpdateRequest)
@@ -233,32 +670,91 @@ func HandlePostKey(c *gin.Context) {
 		return
 	}
 
-	encodedKey := url.QueryEscape(UpdateRequest.Key)
+	if UpdateRequest.MaxVersions < 0 {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidMaxVersions})
+
+		return
+	}
+
+	if !UpdateRequest.MetadataUpdate.valid() {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidMetadata})
 
-	if encodedKey != UpdateRequest.Key {
+		return
+	}
+
+	value, valueType, valid := UpdateRequest.TypedValue.resolve(UpdateRequest.Value)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidValue})
+
+		return
+	}
+
+	expiresAt, valid := parseExpiry(UpdateRequest.TTL, UpdateRequest.ExpiresAt, time.Now())
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidExpiry})
+
+		return
+	}
+
+	matches, valid := parseRevisionMatch(c, UpdateRequest.CAS)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidIfMatch})
+
+		return
+	}
+
+	if !ValidKey(UpdateRequest.Key) {
 		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidKey})
 
 		return
 	}
 
-	_, exists := keys.get(UpdateRequest.Key)
+	options := writeOptions{
+		actor:        actor(c),
+		contentType:  UpdateRequest.ContentType,
+		expiresAt:    expiresAt,
+		matches:      matches,
+		maxVersions:  UpdateRequest.MaxVersions,
+		metadata:     UpdateRequest.MetadataUpdate,
+		mustNotExist: true,
+		schema:       UpdateRequest.Schema,
+		valueType:    valueType,
+	}
+
+	v, err := s.keys.set(UpdateRequest.Key, value, options)
+
+	if failure, failed := err.(*schemaError); failed {
+		c.AbortWithStatusJSON(400, Response{true, failure.Error()})
 
-	if !exists {
-		keys.set(UpdateRequest.Key, UpdateRequest.Value)
+		return
 	}
 
-	if exists {
+	switch err {
+	case nil:
+	case errKeyAlreadyExists:
 		c.AbortWithStatusJSON(400, Response{true, ErrorKeyAlreadyExists})
 
+		return
+	case errRevisionMismatch:
+		c.AbortWithStatusJSON(412, Response{true, ErrorRevisionMismatch})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
 		return
 	}
 
-	c.Writer.Header().Set("update", "update")
+	c.Writer.Header().Set("ETag", etag(v.Revision))
 	c.JSON(201, Response{false, ""})
 }
 
-// HandlePutKey handles the PUT request for the updating of a key/value pair which already exists
-func HandlePutKey(c *gin.Context) {
+// HandlePutKey handles the PUT request for the updating of a key/value pair which already exists, the key being the path of the request;
+// when the If-Match header or the "cas" field of the body is provided the key is only updated at that revision and HTTP/412 is returned otherwise
+func (s *Server) HandlePutKey(c *gin.Context) {
 	var UpdateRequest RequestSingle
 
 	err := json.NewDecoder(c.Request.Body).Decode(&UpdateRequest)
@@ -269,37 +765,90 @@ func HandlePutKey(c *gin.Context) {
 		return
 	}
 
-	_, exists := keys.get(UpdateRequest.Key)
+	key, valid := writtenKey(c, UpdateRequest.Key)
 
-	if exists {
-		keys.set(UpdateRequest.Key, UpdateRequest.Value)
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyMismatch})
+
+		return
 	}
 
-	if !exists {
-		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+	if UpdateRequest.MaxVersions < 0 {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidMaxVersions})
 
 		return
 	}
 
-	c.Writer.Header().Set("update", "update")
-	c.JSON(200, Response{false, ""})
-}
+	if !UpdateRequest.MetadataUpdate.valid() {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidMetadata})
 
-// WriteToFileOnUpdate is a middleware handler which writes "keys.keys" to the file path provided when the update header on the response writer is equal to "update"
-func WriteToFileOnUpdate(keyDataFilePath string) func(c *gin.Context) {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("update", "")
+		return
+	}
 
-		c.Next()
+	value, valueType, valid := UpdateRequest.TypedValue.resolve(UpdateRequest.Value)
 
-		if c.Writer.Header().Get("update") == "update" {
-			keysFile, err := os.OpenFile(keyDataFilePath, os.O_RDWR, 0666)
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidValue})
 
-			if err != nil {
-				return
-			}
+		return
+	}
 
-			UnloadKeyDataKeys(keysFile)
-		}
+	expiresAt, valid := parseExpiry(UpdateRequest.TTL, UpdateRequest.ExpiresAt, time.Now())
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidExpiry})
+
+		return
 	}
+
+	matches, valid := parseRevisionMatch(c, UpdateRequest.CAS)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidIfMatch})
+
+		return
+	}
+
+	options := writeOptions{
+		actor:       actor(c),
+		contentType: UpdateRequest.ContentType,
+		expiresAt:   expiresAt,
+		matches:     matches,
+		maxVersions: UpdateRequest.MaxVersions,
+		metadata:    UpdateRequest.MetadataUpdate,
+		mustExist:   true,
+		schema:      UpdateRequest.Schema,
+		valueType:   valueType,
+	}
+
+	v, err := s.keys.set(key, value, options)
+
+	if failure, failed := err.(*schemaError); failed {
+		c.AbortWithStatusJSON(400, Response{true, failure.Error()})
+
+		return
+	}
+
+	switch err {
+	case nil:
+	case errKeyExpired:
+		c.AbortWithStatusJSON(410, Response{true, ErrorKeyExpired})
+
+		return
+	case errKeyDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+
+		return
+	case errRevisionMismatch:
+		c.AbortWithStatusJSON(412, Response{true, ErrorRevisionMismatch})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.Writer.Header().Set("ETag", etag(v.Revision))
+	c.JSON(200, Response{false, ""})
 }
@@ -3,21 +3,37 @@ package keymanaging
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
 )
 
 func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// newTestServer creates an unsealed server keeping its keys in memory, with testRootToken as its root token
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey, RootToken: testRootToken}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	return server
+}
+
 // Need to test the following:
 // If key does not exist then a HTTP/400 status is returned,
 //     error field is true, the update field is falsed true,
@@ -25,37 +41,37 @@ func init() {
 // If key exists then key and value is deleted, a HTTP/200 status is returned,
 //     the error field is false, the update field is true, and the message is empty
 func TestHandleDeleteKey(t *testing.T) {
+	server := newTestServer(t)
+
 	var mockResponseJSON Response
 
-	keys.set("TestHandleDeleteKey", "success")
+	server.keys.set("TestHandleDeleteKey", "success", writeOptions{})
 
 	router := gin.New()
-	router.DELETE("/keys/:key", HandleDeleteKey)
+	router.DELETE("/keys/*path", server.HandleDeleteKey)
 
 	tests := []struct {
-		ExpectedResponse                         Response
-		ExpectedStatusCode                       int
-		ExpectedValue, ExpectedUpdateHeader, Key string
+		ExpectedResponse   Response
+		ExpectedStatusCode int
+		ExpectedValue, Key string
 	}{
 		{
 			ExpectedResponse: Response{
 				Error:   true,
 				Message: ErrorKeyDoesNotExist,
 			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "idonotexist",
+			ExpectedStatusCode: 400,
+			ExpectedValue:      "",
+			Key:                "idonotexist",
 		},
 		{
 			ExpectedResponse: Response{
 				Error:   false,
 				Message: "",
 			},
-			ExpectedStatusCode:   200,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandleDeleteKey",
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "",
+			Key:                "TestHandleDeleteKey",
 		},
 	}
 
@@ -86,19 +102,17 @@ func TestHandleDeleteKey(t *testing.T) {
 			continue
 		}
 
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
+		if value, _, _ := server.keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue {
 			t.Errorf(
-				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
+				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", and keys[%s] = "%s"; expected: HTTP/%d, Response: "%v", and keys[%s] = "%s"`,
 				mockResponseWriter.Code,
 				mockResponseJSON,
 				test.Key,
 				value,
-				mockResponseWriter.Header().Get("update"),
 				test.ExpectedStatusCode,
 				test.ExpectedResponse,
 				test.Key,
 				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
 			)
 		}
 	}
@@ -110,12 +124,14 @@ func TestHandleDeleteKey(t *testing.T) {
 // If key exists then the value for the provided key is returned, a HTTP/200 status is returned,
 //     the error field is false, and the message is the value for the key
 func TestHandleGetKey(t *testing.T) {
+	server := newTestServer(t)
+
 	var mockResponseJSON Response
 
-	keys.set("TestHandleGetKey", "success")
+	server.keys.set("TestHandleGetKey", "success", writeOptions{})
 
 	router := gin.New()
-	router.GET("/keys/:key", HandleGetKey)
+	router.GET("/keys/*path", server.HandleGetKey)
 
 	tests := []struct {
 		ExpectedResponse   Response
@@ -185,6 +201,8 @@ func TestHandleGetKey(t *testing.T) {
 // If key exists then the value for the provided key can be found in the returned map in
 //     the message field, the error field is false and a HTTP/200 status is returned
 func TestHandleGetManyKeys(t *testing.T) {
+	server := newTestServer(t)
+
 	CheckResponseAgainstExpected := func(response map[string]interface{}, expected map[string]string) bool {
 		for key, value := range expected {
 			if _, exists := response[key]; !exists {
@@ -199,12 +217,12 @@ func TestHandleGetManyKeys(t *testing.T) {
 		return true
 	}
 
-	keys.set("TestHandleGetKey", "success")
-	keys.set("TestHandleGetAnotherKey", "good")
-	keys.set("TestHandleGetAnotherAnotherKey", "great")
+	server.keys.set("TestHandleGetKey", "success", writeOptions{})
+	server.keys.set("TestHandleGetAnotherKey", "good", writeOptions{})
+	server.keys.set("TestHandleGetAnotherAnotherKey", "great", writeOptions{})
 
 	router := gin.New()
-	router.POST("/keys", HandleGetManyKeys)
+	router.POST("/keys", server.HandleGetManyKeys)
 
 	tests := []struct {
 		ExpectedResponse   Response
@@ -281,6 +299,106 @@ func TestHandleGetManyKeys(t *testing.T) {
 	}
 }
 
+// Need to test the following:
+// If some of the keys do not exist then they are listed as missing, and if some have expired then they are listed with their error,
+//     while the values of the other keys are returned with a HTTP/200 status
+// If the request fails on missing keys and any key is missing or could not be read then a HTTP/400 status is returned,
+//     the error field is true, the message is the "ErrorKeysMissing" constant, and the missing keys and errors are still listed
+// If more keys are asked for than can be read at once then a HTTP/400 status is returned with the "ErrorTooManyKeys" constant
+func TestHandleGetManyKeysMissing(t *testing.T) {
+	server := newTestServer(t)
+
+	expiresAt := time.Now().Add(time.Millisecond)
+
+	server.keys.set("TestHandleGetManyKeysMissing", "success", writeOptions{})
+	server.keys.set("TestHandleGetManyKeysExpired", "expired", writeOptions{expiresAt: &expiresAt})
+
+	time.Sleep(5 * time.Millisecond)
+
+	router := gin.New()
+	router.POST("/keys", server.HandleGetManyKeys)
+
+	keys := []string{"TestHandleGetManyKeysMissing", "TestHandleGetManyKeysExpired", "DoNotTestHandleGetManyKeysMissing", "TestHandleGetManyKeysMissing"}
+
+	tests := []struct {
+		ExpectedResponse   ManyResponse
+		ExpectedStatusCode int
+		Request            RequestMany
+	}{
+		{
+			ExpectedResponse: ManyResponse{
+				Error:   false,
+				Errors:  map[string]string{"TestHandleGetManyKeysExpired": ErrorKeyExpired},
+				Message: map[string]interface{}{"TestHandleGetManyKeysMissing": "success"},
+				Missing: []string{"DoNotTestHandleGetManyKeysMissing"},
+			},
+			ExpectedStatusCode: 200,
+			Request:            RequestMany{Keys: keys},
+		},
+		{
+			ExpectedResponse: ManyResponse{
+				Error:   true,
+				Errors:  map[string]string{"TestHandleGetManyKeysExpired": ErrorKeyExpired},
+				Message: ErrorKeysMissing,
+				Missing: []string{"DoNotTestHandleGetManyKeysMissing"},
+			},
+			ExpectedStatusCode: 400,
+			Request:            RequestMany{FailOnMissing: true, Keys: keys},
+		},
+		{
+			ExpectedResponse: ManyResponse{
+				Error:   false,
+				Errors:  map[string]string{},
+				Message: map[string]interface{}{"TestHandleGetManyKeysMissing": "success"},
+				Missing: []string{},
+			},
+			ExpectedStatusCode: 200,
+			Request:            RequestMany{FailOnMissing: true, Keys: keys[:1]},
+		},
+		{
+			ExpectedResponse: ManyResponse{
+				Error:   true,
+				Message: ErrorTooManyKeys,
+			},
+			ExpectedStatusCode: 400,
+			Request:            RequestMany{Keys: make([]string, MaxListLimit+1)},
+		},
+	}
+
+	for _, test := range tests {
+		requestBytes, _ := json.Marshal(test.Request)
+
+		mockRequest, err := http.NewRequest("POST", "/keys", bytes.NewReader(requestBytes))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		var mockResponseJSON ManyResponse
+
+		if err = json.NewDecoder(mockResponseWriter.Body).Decode(&mockResponseJSON); err != nil {
+			t.Error("Could not decode the response body into json")
+
+			continue
+		}
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || !reflect.DeepEqual(mockResponseJSON, test.ExpectedResponse) {
+			t.Errorf(
+				`HandleGetManyKeys(context) with %d keys = Status Code: HTTP/%d and Response: "%v", expected HTTP/%d and Response: "%v"`,
+				len(test.Request.Keys),
+				mockResponseWriter.Code,
+				mockResponseJSON,
+				test.ExpectedStatusCode,
+				test.ExpectedResponse,
+			)
+		}
+	}
+}
+
 // Need to test the following:
 // If key already exists then a HTTP/400 status is returned,
 //     error field is true, the update field is false, and the message is the "ErrorKeyAlreadyExists" constant
@@ -289,55 +407,54 @@ func TestHandleGetManyKeys(t *testing.T) {
 // If key does not exist then key and value pair is created, a HTTP/201 status is returned,
 //     the error field is false, the update field is true, and the message field is empty
 func TestHandlePostKey(t *testing.T) {
+	server := newTestServer(t)
+
 	var mockResponseJSON Response
 
-	keys.set("TestHandlePostKey", "success")
+	server.keys.set("TestHandlePostKey", "success", writeOptions{})
 
 	router := gin.New()
-	router.POST("/keys", HandlePostKey)
+	router.POST("/keys", server.HandlePostKey)
 
 	tests := []struct {
-		ExpectedResponse                                Response
-		ExpectedStatusCode                              int
-		ExpectedValue, ExpectedUpdateHeader, Key, Value string
+		ExpectedResponse          Response
+		ExpectedStatusCode        int
+		ExpectedValue, Key, Value string
 	}{
 		{
 			ExpectedResponse: Response{
 				Error:   true,
 				Message: ErrorKeyAlreadyExists,
 			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePostKey",
-			Value:                "failure",
+			ExpectedStatusCode: 400,
+			ExpectedValue:      "success",
+			Key:                "TestHandlePostKey",
+			Value:              "failure",
 		},
 		{
 			ExpectedResponse: Response{
 				Error:   true,
 				Message: ErrorInvalidKey,
 			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePostKeyFailure?",
-			Value:                "success",
+			ExpectedStatusCode: 400,
+			ExpectedValue:      "",
+			Key:                "TestHandlePostKeyFailure?",
+			Value:              "success",
 		},
 		{
 			ExpectedResponse: Response{
 				Error:   false,
 				Message: "",
 			},
-			ExpectedStatusCode:   201,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandlePostKeyFailure",
-			Value:                "success",
+			ExpectedStatusCode: 201,
+			ExpectedValue:      "success",
+			Key:                "TestHandlePostKeyFailure",
+			Value:              "success",
 		},
 	}
 
 	for _, test := range tests {
-		requestBytes, err := json.Marshal(RequestSingle{test.Key, test.Value})
+		requestBytes, err := json.Marshal(RequestSingle{Key: test.Key, Value: test.Value})
 
 		if err != nil {
 			t.Error("Could not read the response body into bytes")
@@ -371,68 +488,115 @@ func TestHandlePostKey(t *testing.T) {
 			continue
 		}
 
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
+		if value, _, _ := server.keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue {
 			t.Errorf(
-				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
+				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", and keys[%s] = "%s"; expected: HTTP/%d, Response: "%v", and keys[%s] = "%s"`,
 				mockResponseWriter.Code,
 				mockResponseJSON,
 				test.Key,
 				value,
-				mockResponseWriter.Header().Get("update"),
 				test.ExpectedStatusCode,
 				test.ExpectedResponse,
 				test.Key,
 				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
 			)
 		}
 	}
 }
 
+// Need to test the following:
+// If the same key is created by many requests at once then exactly one of them returns a HTTP/201 status, the others a HTTP/400 status,
+//     and the value of the key is the one created by it
+func TestHandlePostKeyConcurrently(t *testing.T) {
+	server := newTestServer(t)
+
+	router := gin.New()
+	router.POST("/keys", server.HandlePostKey)
+
+	codes := make([]int, 20)
+
+	var wg sync.WaitGroup
+
+	for index := range codes {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			requestBytes, _ := json.Marshal(RequestSingle{Key: "TestHandlePostKeyConcurrently", Value: fmt.Sprint(index)})
+
+			mockRequest, _ := http.NewRequest("POST", "/keys", bytes.NewBuffer(requestBytes))
+
+			mockResponseWriter := httptest.NewRecorder()
+
+			router.ServeHTTP(mockResponseWriter, mockRequest)
+
+			codes[index] = mockResponseWriter.Code
+		}(index)
+	}
+
+	wg.Wait()
+
+	created := -1
+
+	for index, code := range codes {
+		switch {
+		case code == 201 && created == -1:
+			created = index
+		case code != 400:
+			t.Errorf("request %d to create TestHandlePostKeyConcurrently = HTTP/%d, expected only one HTTP/201 and otherwise HTTP/400", index, code)
+		}
+	}
+
+	if value, _, _ := server.keys.get("TestHandlePostKeyConcurrently"); created == -1 || value != fmt.Sprint(created) {
+		t.Errorf(`keys["TestHandlePostKeyConcurrently"] = "%s", expected the value of the request which created it`, value)
+	}
+}
+
 // Need to test the following:
 // If key already exists then a HTTP/400 status is returned,
 //     error field is true, the update field is false, and the message is the "ErrorKeyAlreadyExists" constant
 // If key exists then the value for the key is updated, a HTTP/200 status is returned,
 //     the error field is false, the update field is true, and the message is empty
 func TestHandlePutKey(t *testing.T) {
+	server := newTestServer(t)
+
 	var mockResponseJSON Response
 
-	keys.set("TestHandlePutKey", "success")
+	server.keys.set("TestHandlePutKey", "success", writeOptions{})
 
 	router := gin.New()
-	router.PUT("/keys", HandlePutKey)
+	router.PUT("/keys", server.HandlePutKey)
 
 	tests := []struct {
-		ExpectedResponse                                Response
-		ExpectedStatusCode                              int
-		ExpectedValue, ExpectedUpdateHeader, Key, Value string
+		ExpectedResponse          Response
+		ExpectedStatusCode        int
+		ExpectedValue, Key, Value string
 	}{
 		{
 			ExpectedResponse: Response{
 				Error:   true,
 				Message: ErrorKeyDoesNotExist,
 			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePutKeyFailure",
-			Value:                "success",
+			ExpectedStatusCode: 400,
+			ExpectedValue:      "",
+			Key:                "TestHandlePutKeyFailure",
+			Value:              "success",
 		},
 		{
 			ExpectedResponse: Response{
 				Error:   false,
 				Message: "",
 			},
-			ExpectedStatusCode:   200,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandlePutKey",
-			Value:                "success",
+			ExpectedStatusCode: 200,
+			ExpectedValue:      "success",
+			Key:                "TestHandlePutKey",
+			Value:              "success",
 		},
 	}
 
 	for _, test := range tests {
-		requestBytes, err := json.Marshal(RequestSingle{test.Key, test.Value})
+		requestBytes, err := json.Marshal(RequestSingle{Key: test.Key, Value: test.Value})
 
 		if err != nil {
 			t.Error("Could not read the response body into bytes")
@@ -466,19 +630,17 @@ func TestHandlePutKey(t *testing.T) {
 			continue
 		}
 
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
+		if value, _, _ := server.keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue {
 			t.Errorf(
-				`HandlePutKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
+				`HandlePutKey(context) = Status Code: HTTP/%d, Response: "%v", and keys[%s] = "%s"; expected: HTTP/%d, Response: "%v", and keys[%s] = "%s"`,
 				mockResponseWriter.Code,
 				mockResponseJSON,
 				test.Key,
 				value,
-				mockResponseWriter.Header().Get("update"),
 				test.ExpectedStatusCode,
 				test.ExpectedResponse,
 				test.Key,
 				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
 			)
 		}
 	}
@@ -494,10 +656,9 @@ func TestKeyManagingRouter(t *testing.T) {
 	var mockResponseJSON Response
 
 	tests := []struct {
-		ExpectedStatusCode   int
-		ExpectedResponse     Response
-		ExpectedUpdateHeader string
-		HandlerFuncs         map[string]func(c *gin.Context)
+		ExpectedStatusCode int
+		ExpectedResponse   Response
+		HandlerFuncs       map[string]func(c *gin.Context)
 	}{
 		{
 			ExpectedStatusCode: 404,
@@ -568,8 +729,10 @@ func TestKeyManagingRouter(t *testing.T) {
 
 // Need to test the following:
 // If the reader provided does not provide valid JSON then an error is returned
-// If the reader provided does provide valid JSON then the expected key/value pairs exist in keys.keys
+// If the reader provided does provide valid JSON then the expected key/value pairs exist in the storage
 func TestLoadKeyDataKeys(t *testing.T) {
+	server := newTestServer(t)
+
 	tests := []struct {
 		err    bool
 		pairs  map[string]string
@@ -590,7 +753,7 @@ func TestLoadKeyDataKeys(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		err := LoadKeyDataKeys(test.reader)
+		err := server.LoadKeyDataKeys(test.reader)
 
 		if expectedErr := err != nil; expectedErr != test.err {
 			if test.err {
@@ -603,10 +766,10 @@ func TestLoadKeyDataKeys(t *testing.T) {
 		}
 
 		for key, expectedValue := range test.pairs {
-			if value, exists := keys.get(key); !exists || value != expectedValue {
+			if value, exists, _ := server.keys.get(key); !exists || value != expectedValue {
 				t.Errorf(
-					`LoadKeyDataKeys(test.reader) = %v: expected "%v"`,
-					keys.cloneKeys(), test.pairs,
+					`LoadKeyDataKeys(test.reader) = keys[%s] = "%s": expected "%v"`,
+					key, value, test.pairs,
 				)
 			}
 		}
@@ -614,49 +777,141 @@ func TestLoadKeyDataKeys(t *testing.T) {
 }
 
 // Need to test the following:
-// If the reader provided works,
-//     then the key/value pairs that existed in keys.keys were written to the writer,
-//     otherwise an error is returned
-func TestUnloadKeyDataKeys(t *testing.T) {
-	keys.keys = make(map[string]string)
+// If the key encryption key is rotated then a HTTP/200 status is returned,
+//     the error field is false, the update field is true, and the message holds the new version
+func TestHandleRotateKEK(t *testing.T) {
+	var mockResponseJSON struct {
+		Error   bool `json:"error"`
+		Message struct {
+			KEKVersion int `json:"kekVersion"`
+		} `json:"msg"`
+	}
+
+	server := newTestServer(t)
+
+	server.keys.set("TestHandleRotateKEK", "success", writeOptions{})
+
+	router := gin.New()
+	router.POST("/sys/rotate", server.HandleRotateKEK)
+
+	mockRequest, err := http.NewRequest("POST", "/sys/rotate", &bytes.Reader{})
+
+	if err != nil {
+		t.Fatal("could not create the mock request")
+	}
+
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, mockRequest)
+
+	err = json.NewDecoder(mockResponseWriter.Body).Decode(&mockResponseJSON)
+
+	if err != nil {
+		t.Fatal("Could not decode the response body into json")
+	}
+
+	if value, _, _ := server.keys.get("TestHandleRotateKEK"); mockResponseWriter.Code != 200 || mockResponseJSON.Error || mockResponseJSON.Message.KEKVersion != 2 || value != "success" {
+		t.Errorf(
+			`HandleRotateKEK(context) = Status Code: HTTP/%d, Response: "%v", and keys["TestHandleRotateKEK"] = "%s"; expected: HTTP/200, KEK version 2, and "success"`,
+			mockResponseWriter.Code,
+			mockResponseJSON,
+			value,
+		)
+	}
+}
+
+// failingStorage is storage which can be read from but fails every write
+type failingStorage struct {
+	storage.Storage
+}
+
+var errWriteFailed = errors.New("the write failed")
+
+func (fs failingStorage) Put(key string, value []byte) error { return errWriteFailed }
+
+func (fs failingStorage) Delete(key string) error { return errWriteFailed }
+
+func (fs failingStorage) Transaction(fn func(txn storage.Txn) error) error { return errWriteFailed }
+
+// Need to test the following:
+// If the storage cannot be written to then a HTTP/500 status is returned, the error field is true, the update field is false,
+//     the message is the "ErrorPersistFailed" constant, and the value in the storage is unchanged
+func TestStorageWriteFailure(t *testing.T) {
+	server := newTestServer(t)
+
+	server.keys.set("TestStorageWriteFailure", "success", writeOptions{})
+
+	server.keys.mutex.Lock()
+
+	server.keys.storage = failingStorage{server.keys.storage}
+
+	server.keys.mutex.Unlock()
+
+	router := gin.New()
+	router.DELETE("/keys/*path", server.HandleDeleteKey)
+	router.POST("/keys", server.HandlePostKey)
+	router.PUT("/keys", server.HandlePutKey)
 
 	tests := []struct {
-		expectedBytes []byte
-		err           bool
-		pairs         map[string]string
-		writer        io.Writer
+		ExpectedValue, Key, Method, Path string
 	}{
 		{
-			expectedBytes: []byte("{\"test\":\"passed\"}\n"),
-			err:           false,
-			pairs: map[string]string{
-				"test": "passed",
-			},
-			writer: &bytes.Buffer{},
+			ExpectedValue: "",
+			Key:           "TestStorageWriteFailureCreate",
+			Method:        "POST",
+			Path:          "/keys",
+		},
+		{
+			ExpectedValue: "success",
+			Key:           "TestStorageWriteFailure",
+			Method:        "PUT",
+			Path:          "/keys",
+		},
+		{
+			ExpectedValue: "success",
+			Key:           "TestStorageWriteFailure",
+			Method:        "DELETE",
+			Path:          "/keys/TestStorageWriteFailure",
 		},
 	}
 
 	for _, test := range tests {
-		for key, value := range test.pairs {
-			keys.set(key, value)
+		var mockResponseJSON Response
+
+		requestBytes, _ := json.Marshal(RequestSingle{Key: test.Key, Value: "failure"})
+
+		mockRequest, err := http.NewRequest(test.Method, test.Path, bytes.NewBuffer(requestBytes))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
 		}
 
-		err := UnloadKeyDataKeys(test.writer)
+		mockResponseWriter := httptest.NewRecorder()
 
-		if expectedErr := err != nil; expectedErr != test.err {
-			if test.err {
-				t.Error("Expected an error")
-			} else {
-				t.Error("Did not expected error:", err)
-			}
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		err = json.NewDecoder(mockResponseWriter.Body).Decode(&mockResponseJSON)
+
+		if err != nil {
+			t.Error("Could not decode the response body into json")
 
 			continue
 		}
 
-		if (test.writer.(*bytes.Buffer)).String() != string(test.expectedBytes) {
+		expectedResponse := Response{Error: true, Message: ErrorPersistFailed}
+
+		if value, _, _ := server.keys.get(test.Key); mockResponseWriter.Code != 500 || mockResponseJSON != expectedResponse || value != test.ExpectedValue {
 			t.Errorf(
-				`UnloadKeyDataKeys(test.writer) = "%s": expected "%s"`,
-				(test.writer.(*bytes.Buffer)).Bytes(), test.expectedBytes,
+				`%s %s = Status Code: HTTP/%d, Response: "%v", and keys[%s] = "%s"; expected: HTTP/500, Response: "%v", and keys[%s] = "%s"`,
+				test.Method,
+				test.Path,
+				mockResponseWriter.Code,
+				mockResponseJSON,
+				test.Key,
+				value,
+				expectedResponse,
+				test.Key,
+				test.ExpectedValue,
 			)
 		}
 	}
@@ -0,0 +1,108 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// importKeys writes the key/value pairs of a keys file into the storage in a single transaction, returning how many were imported
+func (s *Server) importKeys(plainKeys map[string]string) (int, error) {
+	kr, store, err := s.keys.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		for key, value := range plainKeys {
+			if _, err := s.keys.writeValue(txn, kr, key, value, writeOptions{actor: "legacy keys file"}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(plainKeys), nil
+}
+
+// LoadKeyDataKeys tries to read a keys file of key/value pairs from the provided reader into the storage, the values are sealed with the
+// keyring in use and values already in the storage under the same keys are replaced
+func (s *Server) LoadKeyDataKeys(r io.Reader) error {
+	plainKeys := make(map[string]string)
+
+	if err := json.NewDecoder(r).Decode(&plainKeys); err != nil {
+		return err
+	}
+
+	_, err := s.importKeys(plainKeys)
+
+	return err
+}
+
+// shredFile overwrites the file at the provided path with zeros and syncs it before removing it, so that the plaintext it held is not
+// simply left behind in the blocks it was unlinked from
+func shredFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err == nil {
+		_, err = file.Write(make([]byte, info.Size()))
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// ImportLegacyKeysFile imports the keys file of key/value pairs at the provided path, written by the keymanager before the storage
+// backends existed, into the storage; since it holds the values in plaintext it is overwritten and removed once it has been imported.
+// It returns how many keys were imported, which is zero when there is no keys file at the path
+func (s *Server) ImportLegacyKeysFile(keysFilePath string) (int, error) {
+	keyData, err := ioutil.ReadFile(keysFilePath)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	plainKeys := make(map[string]string)
+
+	if err = json.Unmarshal(keyData, &plainKeys); err != nil {
+		return 0, err
+	}
+
+	imported, err := s.importKeys(plainKeys)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return imported, shredFile(keysFilePath)
+}
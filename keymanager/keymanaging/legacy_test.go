@@ -0,0 +1,60 @@
+package keymanaging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// Need to test the following:
+// If there is no keys file then nothing is imported
+// If the keys file holds key/value pairs then they are imported and the keys file is removed
+// If the keys file is not valid JSON then an error is returned, nothing is imported and the keys file is left as it is
+func TestImportLegacyKeysFile(t *testing.T) {
+	keysDir, err := ioutil.TempDir("", "TestImportLegacyKeysFile")
+
+	if err != nil {
+		t.Fatal("could not create the temporary directory")
+	}
+
+	defer os.RemoveAll(keysDir)
+
+	keysFilePath := filepath.Join(keysDir, "keys.json")
+
+	server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	if imported, err := server.ImportLegacyKeysFile(keysFilePath); imported != 0 || err != nil {
+		t.Errorf(`ImportLegacyKeysFile("%s") without a keys file = %d, %v; expected 0, nil`, keysFilePath, imported, err)
+	}
+
+	ioutil.WriteFile(keysFilePath, []byte(`{"plain":"text"`), 0600)
+
+	if imported, err := server.ImportLegacyKeysFile(keysFilePath); imported != 0 || err == nil {
+		t.Errorf(`ImportLegacyKeysFile("%s") with an invalid keys file = %d, %v; expected 0 and an error`, keysFilePath, imported, err)
+	}
+
+	if _, err := os.Stat(keysFilePath); err != nil {
+		t.Error("expected the invalid keys file to be left as it is")
+	}
+
+	ioutil.WriteFile(keysFilePath, []byte(`{"plain":"text","other":"value"}`), 0600)
+
+	if imported, err := server.ImportLegacyKeysFile(keysFilePath); imported != 2 || err != nil {
+		t.Errorf(`ImportLegacyKeysFile("%s") with a keys file = %d, %v; expected 2, nil`, keysFilePath, imported, err)
+	}
+
+	if value, _, _ := server.keys.get("plain"); value != "text" {
+		t.Errorf(`keys["plain"] = "%s", expected "text"`, value)
+	}
+
+	if files, _ := ioutil.ReadDir(keysDir); len(files) != 0 {
+		t.Errorf("%d files are left in %s, expected the imported keys file to be removed", len(files), keysDir)
+	}
+}
@@ -0,0 +1,159 @@
+package keymanaging
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The number of key names listed in a page when no limit is provided, and the most which can be asked for
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// KeyList is a page of key names, "next" is the cursor to pass as "after" for the next page and is left out on the last page
+type KeyList struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// list returns up to limit key names under the prefix which come after the cursor, which the filters match and which the access allows
+// the capabilities on, a nil filter matching every key; the storage lists keys in order, so a page starts where the previous one stopped
+// even when keys are written in between
+func (kd *keyData) list(prefix, after string, limit int, filter func(string) bool, metadataFilter func(Metadata) bool, access keyAccess, capabilities ...string) (KeyList, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return KeyList{}, err
+	}
+
+	storageKeys, err := store.List(keyPrefix + prefix)
+
+	if err != nil {
+		return KeyList{}, err
+	}
+
+	page := KeyList{Keys: make([]string, 0)}
+
+	for _, storageKey := range storageKeys {
+		key := strings.TrimPrefix(storageKey, keyPrefix)
+
+		if key <= after || (filter != nil && !filter(key)) || !allowsEvery(access, capabilities, key) {
+			continue
+		}
+
+		if metadataFilter != nil {
+			e, err := readEntry(store, key)
+
+			if err != nil {
+				return KeyList{}, err
+			}
+
+			if e == nil || !metadataFilter(e.Metadata) {
+				continue
+			}
+		}
+
+		if len(page.Keys) == limit {
+			page.Next = page.Keys[len(page.Keys)-1]
+
+			break
+		}
+
+		page.Keys = append(page.Keys, key)
+	}
+
+	return page, nil
+}
+
+// parseListFilter reads the "glob" or "regex" query parameter into a filter, the glob matches the whole key with "*" stopping at
+// the separator while the regex matches anywhere in the key unless it is anchored; nil is returned when neither is provided
+func parseListFilter(c *gin.Context) (func(string) bool, bool) {
+	glob, regex := c.Query("glob"), c.Query("regex")
+
+	switch {
+	case glob != "" && regex != "":
+		return nil, false
+	case glob != "":
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, false
+		}
+
+		return func(key string) bool {
+			matched, _ := path.Match(glob, key)
+
+			return matched
+		}, true
+	case regex != "":
+		compiled, err := regexp.Compile(regex)
+
+		if err != nil {
+			return nil, false
+		}
+
+		return compiled.MatchString, true
+	}
+
+	return nil, true
+}
+
+// HandleListKeys handles the GET request for the names of the keys, never their values, under the "prefix" query parameter and
+// carrying the "owner" and "tag" query parameters if provided; the keys are listed in pages of "limit" names, each page starting after
+// the "after" cursor returned with the previous one, and the keys the token is denied are left out
+func (s *Server) HandleListKeys(c *gin.Context) {
+	limit := DefaultListLimit
+
+	if query := c.Query("limit"); query != "" {
+		var err error
+
+		if limit, err = strconv.Atoi(query); err != nil || limit < 1 || limit > MaxListLimit {
+			c.AbortWithStatusJSON(400, Response{true, ErrorInvalidLimit})
+
+			return
+		}
+	}
+
+	filter, valid := parseListFilter(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidFilter})
+
+		return
+	}
+
+	metadataFilter, valid := parseMetadataFilter(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidFilter})
+
+		return
+	}
+
+	access, err := s.keyAccess(c)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	capabilities := []string{CapabilityList}
+
+	if c.Query("values") == "true" {
+		capabilities = append(capabilities, CapabilityRead)
+	}
+
+	page, err := s.keys.list(c.Query("prefix"), c.Query("after"), limit, filter, metadataFilter, access, capabilities...)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, page})
+}
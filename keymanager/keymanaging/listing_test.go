@@ -0,0 +1,123 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Need to test the following:
+// If no parameters are provided then every key name is listed in order, without any value
+// If a prefix is provided then only the keys under it are listed
+// If a limit is provided then the keys are listed in pages, each page after the first starting after the cursor returned by the one before
+// If a glob or regex is provided then only the keys matching it are listed
+// If the limit is not a whole number from 1 to 1000, both a glob and a regex are provided, or either is invalid then a HTTP/400 status is returned
+func TestHandleListKeys(t *testing.T) {
+	server := newTestServer(t)
+
+	for _, key := range []string{"prod/api/token", "prod/db/password", "prod/db/user", "staging/db/password", "top"} {
+		server.keys.set(key, "secret", writeOptions{})
+	}
+
+	handler := server.Handler()
+
+	tests := []struct {
+		ExpectedResponse   KeyList
+		ExpectedStatusCode int
+		Query              string
+	}{
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/api/token", "prod/db/password", "prod/db/user", "staging/db/password", "top"}},
+			ExpectedStatusCode: 200,
+			Query:              "",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/api/token", "prod/db/password", "prod/db/user"}},
+			ExpectedStatusCode: 200,
+			Query:              "?prefix=prod/",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/api/token", "prod/db/password"}, Next: "prod/db/password"},
+			ExpectedStatusCode: 200,
+			Query:              "?limit=2",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/db/user", "staging/db/password"}, Next: "staging/db/password"},
+			ExpectedStatusCode: 200,
+			Query:              "?limit=2&after=prod/db/password",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"top"}},
+			ExpectedStatusCode: 200,
+			Query:              "?limit=2&after=staging/db/password",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/db/password", "staging/db/password"}},
+			ExpectedStatusCode: 200,
+			Query:              "?glob=*/db/password",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{}},
+			ExpectedStatusCode: 200,
+			Query:              "?glob=*/password",
+		},
+		{
+			ExpectedResponse:   KeyList{Keys: []string{"prod/db/user", "top"}},
+			ExpectedStatusCode: 200,
+			Query:              "?regex=(user|top)$",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?limit=0",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?limit=1001",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?glob=*&regex=.*",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?glob=[",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?regex=(",
+		},
+	}
+
+	for _, test := range tests {
+		mockRequest, err := http.NewRequest("GET", "/keys"+test.Query, nil)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		var response struct {
+			Message KeyList `json:"msg"`
+		}
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || (test.ExpectedStatusCode == 200 && !reflect.DeepEqual(response.Message, test.ExpectedResponse)) {
+			t.Errorf(
+				`GET /keys%s = HTTP/%d and Response: "%s", expected HTTP/%d and Response: "%v"`,
+				test.Query,
+				mockResponseWriter.Code,
+				mockResponseWriter.Body.String(),
+				test.ExpectedStatusCode,
+				test.ExpectedResponse,
+			)
+		}
+	}
+}
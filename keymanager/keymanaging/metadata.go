@@ -0,0 +1,176 @@
+package keymanaging
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaxTags is the most tags a single key can carry
+const MaxTags = 64
+
+// Metadata is what is known about a key besides its value: when it was created and last written and by whom, along with the description,
+// owner and tags given to it
+type Metadata struct {
+	CreatedAt   time.Time         `json:"createdAt"`
+	CreatedBy   string            `json:"createdBy"`
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	UpdatedBy   string            `json:"updatedBy"`
+}
+
+// MetadataUpdate is the part of the metadata of a key which can be written along with its value, anything left out is kept as it was;
+// the tags provided replace all of the tags of the key, so an empty object removes them
+type MetadataUpdate struct {
+	Description *string           `json:"description,omitempty"`
+	Owner       *string           `json:"owner,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// KeyMetadata is the response to a read of the metadata of a key, which never includes its value
+type KeyMetadata struct {
+	Metadata
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string     `json:"key"`
+	Revision  int64      `json:"revision"`
+	Version   int        `json:"version"`
+}
+
+// valid reports whether every tag has a name, which cannot hold ":" since it separates the name from the value when filtering
+func (mu MetadataUpdate) valid() bool {
+	if len(mu.Tags) > MaxTags {
+		return false
+	}
+
+	for name := range mu.Tags {
+		if name == "" || strings.Contains(name, ":") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply writes the parts of the update which were provided to the metadata
+func (mu MetadataUpdate) apply(m *Metadata) {
+	if mu.Description != nil {
+		m.Description = *mu.Description
+	}
+
+	if mu.Owner != nil {
+		m.Owner = *mu.Owner
+	}
+
+	if mu.Tags != nil {
+		m.Tags = make(map[string]string, len(mu.Tags))
+
+		for name, value := range mu.Tags {
+			m.Tags[name] = value
+		}
+	}
+}
+
+// backfill fills in the timestamps of keys written before metadata existed from their retained versions, the oldest standing in for
+// the creation of the key
+func (m *Metadata) backfill(versions []version) {
+	if !m.CreatedAt.IsZero() || len(versions) == 0 {
+		return
+	}
+
+	oldest, newest := versions[0], versions[len(versions)-1]
+
+	m.CreatedAt, m.CreatedBy = oldest.CreatedAt, oldest.Actor
+	m.UpdatedAt, m.UpdatedBy = newest.CreatedAt, newest.Actor
+}
+
+// parseMetadataFilter reads the "owner" query parameter and every "tag" query parameter into a filter, a tag being either "name" for keys
+// carrying the tag or "name:value" for keys carrying it with that value; nil is returned when none are provided
+func parseMetadataFilter(c *gin.Context) (func(Metadata) bool, bool) {
+	owner, owned := c.GetQuery("owner")
+
+	tags := c.QueryArray("tag")
+
+	if !owned && len(tags) == 0 {
+		return nil, true
+	}
+
+	for _, tag := range tags {
+		if strings.SplitN(tag, ":", 2)[0] == "" {
+			return nil, false
+		}
+	}
+
+	return func(m Metadata) bool {
+		if owned && m.Owner != owner {
+			return false
+		}
+
+		for _, tag := range tags {
+			parts := strings.SplitN(tag, ":", 2)
+
+			value, tagged := m.Tags[parts[0]]
+
+			if !tagged || (len(parts) == 2 && value != parts[1]) {
+				return false
+			}
+		}
+
+		return true
+	}, true
+}
+
+// metadata reads the metadata of the key, false is returned when the key does not exist and errKeyExpired when it has outlived its expiry
+func (kd *keyData) metadata(key string) (KeyMetadata, bool, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return KeyMetadata{}, false, err
+	}
+
+	e, err := readEntry(store, key)
+
+	if err != nil || e == nil {
+		return KeyMetadata{}, false, err
+	}
+
+	if e.expired(time.Now()) {
+		return KeyMetadata{}, true, errKeyExpired
+	}
+
+	return KeyMetadata{
+		Metadata:  e.Metadata,
+		ExpiresAt: e.ExpiresAt,
+		Key:       key,
+		Revision:  e.revision(),
+		Version:   e.current().Number,
+	}, true, nil
+}
+
+// HandleGetKeyMetadata handles the GET request for the metadata of a key, its value is never returned
+func (s *Server) HandleGetKeyMetadata(c *gin.Context) {
+	metadata, exists, err := s.keys.metadata(keyParam(c))
+
+	if err == errKeyExpired {
+		c.AbortWithStatusJSON(410, Response{true, ErrorKeyExpired})
+
+		return
+	}
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+
+		return
+	}
+
+	c.Writer.Header().Set("ETag", etag(metadata.Revision))
+	c.JSON(200, Response{false, metadata})
+}
@@ -0,0 +1,162 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Need to test the following:
+// If a key is created then its metadata records when and by whom, along with the description, owner and tags provided, and never its value
+// If a key is updated then the metadata records when and by whom, keeping the description, owner and tags which were not provided
+// If tags are provided then they replace every tag of the key
+// If a tag has no name or its name holds ":" then a HTTP/400 status is returned
+// If the key does not exist then a HTTP/400 status is returned
+// If an owner or tags are provided when listing then only the keys carrying them are listed
+func TestKeyMetadata(t *testing.T) {
+	server := newTestServer(t)
+
+	handler, bearers := server.Handler(), map[string]string{}
+
+	serve := func(method, path, actor string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		if _, exists := bearers[actor]; !exists {
+			bearers[actor] = testToken(t, server, actor)
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+bearers[actor])
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	read := func(key string) (int, KeyMetadata) {
+		code, body := serve("GET", "/metadata/"+key, "reader", nil)
+
+		var response struct {
+			Message KeyMetadata `json:"msg"`
+		}
+
+		json.Unmarshal(body, &response)
+
+		return code, response.Message
+	}
+
+	description, owner, team := "the database password", "payments", "platform"
+
+	created := RequestSingle{
+		MetadataUpdate: MetadataUpdate{Description: &description, Owner: &owner, Tags: map[string]string{"env": "prod", "tier": "db"}},
+		Key:            "TestKeyMetadata/password",
+		Value:          "secret",
+	}
+
+	if code, _ := serve("POST", "/key", "creator", created); code != 201 {
+		t.Fatalf("POST /key = HTTP/%d, expected HTTP/201", code)
+	}
+
+	code, metadata := read("TestKeyMetadata/password")
+
+	if code != 200 || metadata.CreatedBy != "creator" || metadata.UpdatedBy != "creator" || metadata.CreatedAt.IsZero() || metadata.Description != description || metadata.Owner != owner || metadata.Version != 1 {
+		t.Fatalf("GET /metadata/TestKeyMetadata/password after creation = HTTP/%d %+v, expected HTTP/200 with the metadata created", code, metadata)
+	}
+
+	updated := RequestSingle{MetadataUpdate: MetadataUpdate{Tags: map[string]string{"env": "staging"}}, Key: "TestKeyMetadata/password", Value: "rotated"}
+
+	if code, _ := serve("PUT", "/key/TestKeyMetadata/password", "updater", updated); code != 200 {
+		t.Fatalf("PUT /key/TestKeyMetadata/password = HTTP/%d, expected HTTP/200", code)
+	}
+
+	createdAt := metadata.CreatedAt
+
+	code, metadata = read("TestKeyMetadata/password")
+
+	if code != 200 || metadata.CreatedBy != "creator" || !metadata.CreatedAt.Equal(createdAt) || metadata.UpdatedBy != "updater" || metadata.Description != description || metadata.Owner != owner || !reflect.DeepEqual(metadata.Tags, map[string]string{"env": "staging"}) {
+		t.Errorf("GET /metadata/TestKeyMetadata/password after update = HTTP/%d %+v, expected HTTP/200 with the metadata updated", code, metadata)
+	}
+
+	if _, body := serve("GET", "/metadata/TestKeyMetadata/password", "reader", nil); bytes.Contains(body, []byte("rotated")) {
+		t.Errorf("GET /metadata/TestKeyMetadata/password returned the value of the key: %s", body)
+	}
+
+	if code, _ := read("TestKeyMetadata/missing"); code != 400 {
+		t.Errorf("GET /metadata/TestKeyMetadata/missing = HTTP/%d, expected HTTP/400", code)
+	}
+
+	for _, tags := range []map[string]string{{"": "empty"}, {"env:prod": "colon"}} {
+		invalid := RequestSingle{MetadataUpdate: MetadataUpdate{Tags: tags}, Key: "TestKeyMetadata/invalid", Value: "invalid"}
+
+		if code, _ := serve("POST", "/key", "creator", invalid); code != 400 {
+			t.Errorf("POST /key with the tags %v = HTTP/%d, expected HTTP/400", tags, code)
+		}
+	}
+
+	serve("POST", "/key", "creator", RequestSingle{MetadataUpdate: MetadataUpdate{Owner: &team, Tags: map[string]string{"env": "prod"}}, Key: "TestKeyMetadata/token", Value: "token"})
+	serve("POST", "/key", "creator", RequestSingle{Key: "TestKeyMetadata/untagged", Value: "untagged"})
+
+	tests := []struct {
+		ExpectedKeys       []string
+		ExpectedStatusCode int
+		Query              string
+	}{
+		{
+			ExpectedKeys:       []string{"TestKeyMetadata/password"},
+			ExpectedStatusCode: 200,
+			Query:              "?owner=payments",
+		},
+		{
+			ExpectedKeys:       []string{"TestKeyMetadata/password", "TestKeyMetadata/token"},
+			ExpectedStatusCode: 200,
+			Query:              "?tag=env",
+		},
+		{
+			ExpectedKeys:       []string{"TestKeyMetadata/token"},
+			ExpectedStatusCode: 200,
+			Query:              "?tag=env:prod",
+		},
+		{
+			ExpectedKeys:       []string{},
+			ExpectedStatusCode: 200,
+			Query:              "?tag=env:prod&owner=payments",
+		},
+		{
+			ExpectedKeys:       []string{"TestKeyMetadata/untagged"},
+			ExpectedStatusCode: 200,
+			Query:              "?owner=",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Query:              "?tag=:prod",
+		},
+	}
+
+	for _, test := range tests {
+		code, body := serve("GET", "/keys"+test.Query, "reader", nil)
+
+		var response struct {
+			Message KeyList `json:"msg"`
+		}
+
+		json.Unmarshal(body, &response)
+
+		if code != test.ExpectedStatusCode || (test.ExpectedStatusCode == 200 && !reflect.DeepEqual(response.Message.Keys, test.ExpectedKeys)) {
+			t.Errorf(`GET /keys%s = HTTP/%d and Response: "%s", expected HTTP/%d and keys %v`, test.Query, code, body, test.ExpectedStatusCode, test.ExpectedKeys)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package keymanaging
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeySeparator separates the segments of hierarchical keys, such as "prod/db/password"
+const KeySeparator = "/"
+
+// keyParam reads the key from the "path" parameter of the route, which gin starts with a slash
+func keyParam(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("path"), KeySeparator)
+}
+
+// writtenKey returns the key a request writes, which is the key in its path; the key named in the body only stands in for it when the
+// route is mounted without one, and false is returned when the body names another key than the path
+func writtenKey(c *gin.Context, named string) (string, bool) {
+	key := keyParam(c)
+
+	if key == "" {
+		return named, true
+	}
+
+	return key, named == "" || named == key
+}
+
+// ValidKey reports whether the key can be created: every one of its segments must be made only of characters which are left
+// as they are by url.QueryEscape, and no segment can be empty or be "." or ".."
+func ValidKey(key string) bool {
+	for _, segment := range strings.Split(key, KeySeparator) {
+		if segment == "" || segment == "." || segment == ".." || url.QueryEscape(segment) != segment {
+			return false
+		}
+	}
+
+	return true
+}
+
+// children lists the keys and sub-prefixes directly under the prefix, which is either empty or ends with the separator, that the access
+// allows listing; sub-prefixes are listed with the separator at their end, so "prod/" can hold both a "db" key and a "db/" prefix, and
+// only when the access allows listing a key under them
+func (kd *keyData) children(prefix string, access keyAccess) ([]string, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storageKeys, err := store.List(keyPrefix + prefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]string, 0)
+
+	for _, storageKey := range storageKeys {
+		if !access.allows(CapabilityList, strings.TrimPrefix(storageKey, keyPrefix)) {
+			continue
+		}
+
+		child := strings.TrimPrefix(storageKey, keyPrefix+prefix)
+
+		if index := strings.Index(child, KeySeparator); index != -1 {
+			child = child[:index+1]
+		}
+
+		// The storage lists the keys in order, so a sub-prefix is only ever repeated right after itself
+		if len(children) != 0 && children[len(children)-1] == child {
+			continue
+		}
+
+		children = append(children, child)
+	}
+
+	return children, nil
+}
+
+// HandleListChildren handles the GET request for the keys and sub-prefixes directly under a prefix, the prefix being
+// the path of the request, which ends with the separator, or nothing for the top level
+func (s *Server) HandleListChildren(c *gin.Context) {
+	prefix := keyParam(c)
+
+	if prefix != "" && (!strings.HasSuffix(prefix, KeySeparator) || !ValidKey(strings.TrimSuffix(prefix, KeySeparator))) {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidKey})
+
+		return
+	}
+
+	access, err := s.keyAccess(c)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	children, err := s.keys.children(prefix, access)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, children})
+}
@@ -0,0 +1,151 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Need to test the following:
+// If every segment of a key is made of letters, numbers, "-", "_", "." and "~" then the key is valid
+// If a segment of a key is empty, is "." or "..", or holds any other character then the key is invalid
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		ExpectedValid bool
+		Key           string
+	}{
+		{ExpectedValid: true, Key: "password"},
+		{ExpectedValid: true, Key: "prod/db/password"},
+		{ExpectedValid: true, Key: "prod/db-main_1.backup~/password"},
+		{ExpectedValid: false, Key: ""},
+		{ExpectedValid: false, Key: "/prod/db"},
+		{ExpectedValid: false, Key: "prod/db/"},
+		{ExpectedValid: false, Key: "prod//db"},
+		{ExpectedValid: false, Key: "prod/../db"},
+		{ExpectedValid: false, Key: "prod/./db"},
+		{ExpectedValid: false, Key: "prod/d b"},
+		{ExpectedValid: false, Key: "prod/db?password"},
+	}
+
+	for _, test := range tests {
+		if valid := ValidKey(test.Key); valid != test.ExpectedValid {
+			t.Errorf(`ValidKey("%s") = %t, expected %t`, test.Key, valid, test.ExpectedValid)
+		}
+	}
+}
+
+// Need to test the following:
+// If a hierarchical key is created then it can be read, updated and deleted through its path, and updating it with another key in
+//     the body returns a HTTP/400 status without writing either key
+// If a prefix ending with "/" is read then the keys and sub-prefixes directly under it are listed, with the sub-prefixes ending with "/"
+// If the prefix is empty then the top level is listed, and if no key is under the prefix then the list is empty
+// If a prefix holds an invalid segment then a HTTP/400 status is returned
+func TestHierarchicalKeys(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	serve := func(method, path string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	for _, key := range []string{"prod/db/password", "prod/db/user", "prod/db", "prod/api/token", "prod/db-replica/password", "staging/db/password", "top"} {
+		if code, body := serve("POST", "/key", RequestSingle{Key: key, Value: key}); code != 201 {
+			t.Fatalf("POST /key for %s = HTTP/%d %s, expected HTTP/201", key, code, body)
+		}
+	}
+
+	if code, _ := serve("PUT", "/key/prod/db/password", RequestSingle{Key: "prod/db/password", Value: "updated"}); code != 200 {
+		t.Errorf("PUT /key/prod/db/password = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if code, _ := serve("PUT", "/key/prod/db/password", RequestSingle{Value: "updated"}); code != 200 {
+		t.Errorf("PUT /key/prod/db/password without the key in the body = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if code, _ := serve("PUT", "/key/prod/db/password", RequestSingle{Key: "top", Value: "elsewhere"}); code != 400 {
+		t.Errorf("PUT /key/prod/db/password naming top in the body = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if value, _, _ := server.keys.get("prod/db/password"); value != "updated" {
+		t.Errorf(`keys["prod/db/password"] = "%s", expected "updated"`, value)
+	}
+
+	if value, _, _ := server.keys.get("top"); value != "top" {
+		t.Errorf(`keys["top"] = "%s", expected "top"`, value)
+	}
+
+	if code, _ := serve("DELETE", "/key/prod/db/user", nil); code != 200 {
+		t.Errorf("DELETE /key/prod/db/user = HTTP/%d, expected HTTP/200", code)
+	}
+
+	tests := []struct {
+		ExpectedChildren   []string
+		ExpectedStatusCode int
+		Path               string
+	}{
+		{
+			ExpectedChildren:   []string{"prod/", "staging/", "top"},
+			ExpectedStatusCode: 200,
+			Path:               "/key/",
+		},
+		{
+			ExpectedChildren:   []string{"api/", "db", "db-replica/", "db/"},
+			ExpectedStatusCode: 200,
+			Path:               "/key/prod/",
+		},
+		{
+			ExpectedChildren:   []string{"password"},
+			ExpectedStatusCode: 200,
+			Path:               "/key/prod/db/",
+		},
+		{
+			ExpectedChildren:   []string{},
+			ExpectedStatusCode: 200,
+			Path:               "/key/dev/",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Path:               "/key/prod/../",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Path:               "/key/prod//",
+		},
+	}
+
+	for _, test := range tests {
+		code, body := serve("GET", test.Path, nil)
+
+		var response struct {
+			Message []string `json:"msg"`
+		}
+
+		json.Unmarshal(body, &response)
+
+		if code != test.ExpectedStatusCode || (code == 200 && !reflect.DeepEqual(response.Message, test.ExpectedChildren)) {
+			t.Errorf("GET %s = HTTP/%d %s, expected HTTP/%d %v", test.Path, code, body, test.ExpectedStatusCode, test.ExpectedChildren)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/hcl"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errPolicyDoesNotExist = errors.New(ErrorPolicyDoesNotExist)
+
+// The capabilities a policy can grant on the keys matching a glob, "deny" takes away every capability on them whatever other rules grant
+const (
+	CapabilityCreate = "create"
+	CapabilityDelete = "delete"
+	CapabilityDeny   = "deny"
+	CapabilityList   = "list"
+	CapabilityRead   = "read"
+	CapabilityUpdate = "update"
+)
+
+var capabilities = map[string]bool{CapabilityCreate: true, CapabilityDelete: true, CapabilityDeny: true, CapabilityList: true, CapabilityRead: true, CapabilityUpdate: true}
+
+// policyPrefix is the prefix of the storage keys of the policies, which are named after the policy
+const policyPrefix = "policy/"
+
+// Policy is a named set of rules which is attached to tokens, the document it was written as is kept along with the rules read from it
+type Policy struct {
+	Document string       `json:"document"`
+	Name     string       `json:"name"`
+	Rules    []PolicyRule `json:"rules"`
+}
+
+// PolicyRule grants the capabilities on the keys matching the glob; "*" matches any characters other than "/", except at the end
+// of the glob where it also matches every key under it, so "prod/payments/*" covers "prod/payments/stripe/key" too
+type PolicyRule struct {
+	Capabilities []string `json:"capabilities"`
+	Glob         string   `json:"glob"`
+}
+
+// RequestPolicy is the request for writing a policy, the document is either HCL or JSON made of path blocks, such as
+// `path "prod/payments/*" { capabilities = ["read", "list"] }` or `{"path": {"prod/payments/*": {"capabilities": ["read", "list"]}}}`
+type RequestPolicy struct {
+	Policy string `json:"policy"`
+}
+
+// access is a capability a request needs on a key or, for listings, on a prefix
+type access struct {
+	Capability string
+	Key        string
+}
+
+// matchesGlob reports whether the key matches the glob of a policy rule
+func matchesGlob(glob, key string) bool {
+	if matched, _ := path.Match(glob, key); matched {
+		return true
+	}
+
+	if !strings.HasSuffix(glob, "*") {
+		return false
+	}
+
+	// A trailing "*" matches the rest of the key, so whatever comes before it only has to match the start of the key
+	prefixGlob := strings.TrimSuffix(glob, "*")
+
+	for end := 0; end <= len(key); end++ {
+		if matched, _ := path.Match(prefixGlob, key[:end]); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parsePolicy reads the rules of the HCL or JSON document of a policy, in the order of their globs; false is returned when the document
+// cannot be read, holds no rules, or holds an invalid glob or capability
+func parsePolicy(document string) ([]PolicyRule, bool) {
+	var parsed struct {
+		Path map[string]*struct {
+			Capabilities []string `hcl:"capabilities"`
+		} `hcl:"path"`
+	}
+
+	if err := hcl.Decode(&parsed, document); err != nil || len(parsed.Path) == 0 {
+		return nil, false
+	}
+
+	rules := make([]PolicyRule, 0, len(parsed.Path))
+
+	for glob, rule := range parsed.Path {
+		if _, err := path.Match(glob, ""); err != nil || rule == nil || len(rule.Capabilities) == 0 {
+			return nil, false
+		}
+
+		for _, capability := range rule.Capabilities {
+			if !capabilities[capability] {
+				return nil, false
+			}
+		}
+
+		rules = append(rules, PolicyRule{Capabilities: rule.Capabilities, Glob: glob})
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Glob < rules[j].Glob })
+
+	return rules, true
+}
+
+// PolicyDecision is whether the policies allow a capability on a key, along with the policy and rule which decided it; no rule decided it
+// when nothing matched the key or the root policy allowed it
+type PolicyDecision struct {
+	Allowed bool        `json:"allowed"`
+	Policy  string      `json:"policy,omitempty"`
+	Rule    *PolicyRule `json:"rule,omitempty"`
+}
+
+// RequestPolicyCheck is the request for checking whether a token, or a token with the policies provided, would be allowed the operation,
+// which is one of the capabilities, on the key; the key itself is never read
+type RequestPolicyCheck struct {
+	Key       string   `json:"key"`
+	Operation string   `json:"operation"`
+	Policies  []string `json:"policies,omitempty"`
+	Token     string   `json:"token,omitempty"`
+}
+
+// decide decides whether the policies grant the capability on the key, a rule denying the key taking precedence over every rule granting it
+func decide(policies []*Policy, capability, key string) PolicyDecision {
+	decision := PolicyDecision{}
+
+	for _, policy := range policies {
+		for index, rule := range policy.Rules {
+			if !matchesGlob(rule.Glob, key) {
+				continue
+			}
+
+			for _, ruleCapability := range rule.Capabilities {
+				switch {
+				case ruleCapability == CapabilityDeny:
+					return PolicyDecision{Allowed: false, Policy: policy.Name, Rule: &policy.Rules[index]}
+				case ruleCapability == capability && !decision.Allowed:
+					decision = PolicyDecision{Allowed: true, Policy: policy.Name, Rule: &policy.Rules[index]}
+				}
+			}
+		}
+	}
+
+	return decision
+}
+
+// readPolicy reads the policy with the name, nil is returned when there is none
+func readPolicy(txn storage.Txn, name string) (*Policy, error) {
+	data, exists, err := txn.Get(policyPrefix + name)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	policy := &Policy{}
+
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// writePolicy creates or replaces the policy with the name
+func (kd *keyData) writePolicy(name, document string, rules []PolicyRule) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(Policy{Document: document, Name: name, Rules: rules})
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error { return txn.Put(policyPrefix+name, data) })
+}
+
+// policy returns the policy with the name, errPolicyDoesNotExist is returned when there is none
+func (kd *keyData) policy(name string) (*Policy, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := readPolicy(store, name)
+
+	if err == nil && policy == nil {
+		err = errPolicyDoesNotExist
+	}
+
+	return policy, err
+}
+
+// policies lists the names of every policy in order
+func (kd *keyData) policies() ([]string, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storageKeys, err := store.List(policyPrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(storageKeys))
+
+	for _, storageKey := range storageKeys {
+		names = append(names, strings.TrimPrefix(storageKey, policyPrefix))
+	}
+
+	return names, nil
+}
+
+// deletePolicy removes the policy, the tokens it is attached to lose what it granted; errPolicyDoesNotExist is returned when there is none
+func (kd *keyData) deletePolicy(name string) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error {
+		policy, err := readPolicy(txn, name)
+
+		if err != nil {
+			return err
+		}
+
+		if policy == nil {
+			return errPolicyDoesNotExist
+		}
+
+		return txn.Delete(policyPrefix + name)
+	})
+}
+
+// namedPolicies reads the policies with the names, such as the ones attached to a token; policies which do not exist (anymore) are skipped
+func (kd *keyData) namedPolicies(names []string) ([]*Policy, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]*Policy, 0, len(names))
+
+	for _, name := range names {
+		policy, err := readPolicy(store, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if policy != nil {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies, nil
+}
+
+// keyAccess decides whether a token is allowed the capability on the key, it is used by the routes listing many keys under a prefix to
+// leave out the keys the token is denied under a prefix it is allowed; a nil keyAccess allows every key
+type keyAccess func(capability, key string) bool
+
+// allows reports whether the capability on the key is allowed
+func (ka keyAccess) allows(capability, key string) bool {
+	return ka == nil || ka(capability, key)
+}
+
+// allowsEvery reports whether the access allows every one of the capabilities on the key
+func allowsEvery(access keyAccess, capabilities []string, key string) bool {
+	for _, capability := range capabilities {
+		if !access.allows(capability, key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keyAccess returns what the token of the request is allowed on each key, which is read from its policies as they are when it is
+// called; nil is returned for the root token, which is allowed every key
+func (s *Server) keyAccess(c *gin.Context) (keyAccess, error) {
+	t := requestToken(c)
+
+	if t == nil || t.hasPolicy(RootPolicy) {
+		return nil, nil
+	}
+
+	policies, err := s.keys.namedPolicies(t.Policies)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(capability, key string) bool { return decide(policies, capability, key).Allowed }, nil
+}
+
+// requestAccesses returns the capabilities the request needs on the keys it is for; reading a prefix ending with "/" lists it, and the routes
+// listing keys, the trash or the changes to the keys need to list the prefix they are for, which is every key when none is provided
+func requestAccesses(c *gin.Context) []access {
+	key := keyParam(c)
+
+	switch c.Request.Method + " " + c.FullPath() {
+	case "GET /key/*path":
+		if key == "" || strings.HasSuffix(key, KeySeparator) {
+			return []access{{CapabilityList, key}}
+		}
+
+		return []access{{CapabilityRead, key}}
+	case "GET /metadata/*path", "GET /versions/*path":
+		return []access{{CapabilityRead, key}}
+	case "PUT /key/*path":
+		var UpdateRequest RequestSingle
+
+		json.Unmarshal(peekBody(c), &UpdateRequest)
+
+		written, _ := writtenKey(c, UpdateRequest.Key)
+
+		return []access{{CapabilityUpdate, written}}
+	case "POST /rollback/*path":
+		return []access{{CapabilityUpdate, key}}
+	case "DELETE /key/*path", "POST /destroy/*path":
+		return []access{{CapabilityDelete, key}}
+	case "POST /restore/*path":
+		return []access{{CapabilityCreate, key}}
+	case "GET /keys", "GET /watch":
+		accesses := []access{{CapabilityList, c.Query("prefix")}}
+
+		if c.Query("values") == "true" {
+			accesses = append(accesses, access{CapabilityRead, c.Query("prefix")})
+		}
+
+		return accesses
+	case "GET /trash":
+		return []access{{CapabilityList, ""}}
+	case "POST /key":
+		var CreateRequest RequestSingle
+
+		json.Unmarshal(peekBody(c), &CreateRequest)
+
+		return []access{{CapabilityCreate, CreateRequest.Key}}
+	case "POST /keys":
+		var ManyRequest RequestMany
+
+		json.Unmarshal(peekBody(c), &ManyRequest)
+
+		accesses := []access{}
+
+		for _, requestedKey := range ManyRequest.Keys {
+			accesses = append(accesses, access{CapabilityRead, requestedKey})
+		}
+
+		return accesses
+	case "POST /txn":
+		var TxnRequest RequestTxn
+
+		json.Unmarshal(peekBody(c), &TxnRequest)
+
+		accesses := []access{}
+
+		for _, operation := range TxnRequest.Operations {
+			capability := operation.Operation
+
+			if capability == OperationCheck {
+				capability = CapabilityRead
+			}
+
+			accesses = append(accesses, access{capability, operation.Key})
+		}
+
+		return accesses
+	}
+
+	return nil
+}
+
+// Authorize is a middleware handler which rejects every request for keys which the policies of its token do not grant the capabilities
+// the request needs on, tokens with the root policy being granted everything; it comes after RequireToken
+func (s *Server) Authorize(c *gin.Context) {
+	t := requestToken(c)
+
+	if t == nil {
+		c.AbortWithStatusJSON(403, Response{true, ErrorPermissionDenied})
+
+		return
+	}
+
+	if t.hasPolicy(RootPolicy) {
+		c.Next()
+
+		return
+	}
+
+	policies, err := s.keys.namedPolicies(t.Policies)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	for _, needed := range requestAccesses(c) {
+		if !decide(policies, needed.Capability, needed.Key).Allowed {
+			c.AbortWithStatusJSON(403, Response{true, ErrorPermissionDenied})
+
+			return
+		}
+	}
+
+	c.Next()
+}
+
+// HandlePutPolicy handles the PUT request for creating or replacing a policy from its HCL or JSON document, the tokens it is attached to
+// are granted what it allows from the next request they make; the root policy is built in and cannot be written
+func (s *Server) HandlePutPolicy(c *gin.Context) {
+	var PolicyRequest RequestPolicy
+
+	err := json.NewDecoder(c.Request.Body).Decode(&PolicyRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	name := c.Param("name")
+
+	if name == RootPolicy {
+		c.AbortWithStatusJSON(400, Response{true, ErrorRootPolicy})
+
+		return
+	}
+
+	rules, valid := parsePolicy(PolicyRequest.Policy)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidPolicy})
+
+		return
+	}
+
+	if err = s.keys.writePolicy(name, PolicyRequest.Policy, rules); err != nil {
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, Policy{Document: PolicyRequest.Policy, Name: name, Rules: rules}})
+}
+
+// HandleGetPolicy handles the GET request for a policy, along with the rules read from its document
+func (s *Server) HandleGetPolicy(c *gin.Context) {
+	policy, err := s.keys.policy(c.Param("name"))
+
+	switch err {
+	case nil:
+	case errPolicyDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorPolicyDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, policy})
+}
+
+// HandleGetPolicies handles the GET request for the names of every policy
+func (s *Server) HandleGetPolicies(c *gin.Context) {
+	names, err := s.keys.policies()
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, names})
+}
+
+// HandleDeletePolicy handles the DELETE request for a policy, the tokens it is attached to are no longer granted what it allowed
+func (s *Server) HandleDeletePolicy(c *gin.Context) {
+	err := s.keys.deletePolicy(c.Param("name"))
+
+	switch err {
+	case nil:
+	case errPolicyDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorPolicyDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, ""})
+}
+
+// HandleCheckPolicy handles the POST request for whether a token, or a token with the policies provided, would be allowed the operation on
+// the key, returning the policy and rule which decided it without reading the key
+func (s *Server) HandleCheckPolicy(c *gin.Context) {
+	var CheckRequest RequestPolicyCheck
+
+	err := json.NewDecoder(c.Request.Body).Decode(&CheckRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	if !capabilities[CheckRequest.Operation] || CheckRequest.Operation == CapabilityDeny || (CheckRequest.Token == "") == (CheckRequest.Policies == nil) {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidPolicyCheck})
+
+		return
+	}
+
+	names := CheckRequest.Policies
+
+	if CheckRequest.Token != "" {
+		t, err := s.authenticate(CheckRequest.Token)
+
+		switch err {
+		case nil:
+		case errTokenDoesNotExist:
+			c.AbortWithStatusJSON(400, Response{true, ErrorInvalidToken})
+
+			return
+		default:
+			s.abortWithError(c, err.Error(), err)
+
+			return
+		}
+
+		names = t.Policies
+	}
+
+	for _, name := range names {
+		if name == RootPolicy {
+			c.JSON(200, Response{false, PolicyDecision{Allowed: true, Policy: RootPolicy}})
+
+			return
+		}
+	}
+
+	policies, err := s.keys.namedPolicies(names)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, decide(policies, CheckRequest.Operation, CheckRequest.Key)})
+}
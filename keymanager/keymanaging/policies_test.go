@@ -0,0 +1,296 @@
+package keymanaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Need to test the following:
+// If a glob ends with "*" then it matches every key under it, and otherwise "*" does not match past a "/"
+func TestMatchesGlob(t *testing.T) {
+	tests := []struct {
+		Glob, Key string
+		Expected  bool
+	}{
+		{Glob: "prod/payments/*", Key: "prod/payments/stripe", Expected: true},
+		{Glob: "prod/payments/*", Key: "prod/payments/stripe/key", Expected: true},
+		{Glob: "prod/payments/*", Key: "prod/payroll", Expected: false},
+		{Glob: "prod/*/password", Key: "prod/db/password", Expected: true},
+		{Glob: "prod/*/password", Key: "prod/db/replica/password", Expected: false},
+		{Glob: "prod/db/password", Key: "prod/db/password", Expected: true},
+		{Glob: "prod/db/password", Key: "prod/db/password2", Expected: false},
+		{Glob: "prod/db-?", Key: "prod/db-1", Expected: true},
+		{Glob: "*", Key: "anything/at/all", Expected: true},
+	}
+
+	for _, test := range tests {
+		if matched := matchesGlob(test.Glob, test.Key); matched != test.Expected {
+			t.Errorf("matchesGlob(%q, %q) = %t, expected %t", test.Glob, test.Key, matched, test.Expected)
+		}
+	}
+}
+
+// Need to test the following:
+// If a policy is written as HCL or JSON then its rules are read from it, and it is listed, returned and deleted by name
+// If a policy is invalid, or is the root policy, then a HTTP/400 status is returned
+// If a token reads, creates, updates or deletes a key which its policies do not grant the capability on then a HTTP/403 status
+//     is returned, and otherwise the request is handled
+// If a request names keys in more than one field of its body then it is checked against the keys the route reads, whatever the other
+//     fields name
+// If a key is denied by any policy of the token then every request for it returns a HTTP/403 status, whatever the other policies grant
+// If the keys under a prefix are listed, or watched, then the keys the token is denied under it are left out
+// If a policy attached to a token is deleted then the token loses what it granted
+func TestPolicies(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	server.keys.set("prod/payments/stripe", "sk_live", writeOptions{})
+	server.keys.set("prod/payments/secret/master", "master", writeOptions{})
+	server.keys.set("prod/db/password", "hunter2", writeOptions{})
+
+	serve := func(method, path, bearer string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+bearer)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	for name, invalid := range map[string]string{
+		"unreadable":  `path "prod/*" {`,
+		"empty":       ``,
+		"capability":  `path "prod/*" { capabilities = ["sudo"] }`,
+		"glob":        `path "prod/[" { capabilities = ["read"] }`,
+		RootPolicy:    `path "*" { capabilities = ["read"] }`,
+		"nothing-set": `path "prod/*" {}`,
+	} {
+		if code, _ := serve("PUT", "/sys/policies/"+name, testRootToken, RequestPolicy{Policy: invalid}); code != 400 {
+			t.Errorf("PUT /sys/policies/%s with %q = HTTP/%d, expected HTTP/400", name, invalid, code)
+		}
+	}
+
+	documents := map[string]string{
+		"payments": `
+path "prod/payments/*" {
+  capabilities = ["read", "create", "update", "list"]
+}
+
+path "prod/db/password" {
+  capabilities = ["read"]
+}`,
+		"no-secrets": `{"path": {"prod/payments/secret/*": {"capabilities": ["deny"]}}}`,
+	}
+
+	for name, document := range documents {
+		if code, body := serve("PUT", "/sys/policies/"+name, testRootToken, RequestPolicy{Policy: document}); code != 200 {
+			t.Fatalf("PUT /sys/policies/%s = HTTP/%d %s, expected HTTP/200", name, code, body)
+		}
+	}
+
+	code, body := serve("GET", "/sys/policies/payments", testRootToken, nil)
+
+	var policy struct {
+		Message Policy `json:"msg"`
+	}
+
+	json.Unmarshal(body, &policy)
+
+	if code != 200 || len(policy.Message.Rules) != 2 || policy.Message.Rules[1].Glob != "prod/payments/*" || len(policy.Message.Rules[1].Capabilities) != 4 {
+		t.Errorf("GET /sys/policies/payments = HTTP/%d %s, expected HTTP/200 with the rules of the policy", code, body)
+	}
+
+	if code, body := serve("GET", "/sys/policies", testRootToken, nil); code != 200 || !bytes.Contains(body, []byte(`["no-secrets","payments"]`)) {
+		t.Errorf("GET /sys/policies = HTTP/%d %s, expected HTTP/200 listing both policies", code, body)
+	}
+
+	info, err := server.keys.createToken(RequestToken{Name: "payments", Policies: []string{"payments", "no-secrets", "missing"}}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the token:", err)
+	}
+
+	if code, _ := serve("GET", "/sys/policies", info.Token, nil); code != 403 {
+		t.Errorf("GET /sys/policies without the root policy = HTTP/%d, expected HTTP/403", code)
+	}
+
+	tests := []struct {
+		Method, Path string
+		Body         interface{}
+		ExpectedCode int
+	}{
+		{Method: "GET", Path: "/key/prod/payments/stripe", ExpectedCode: 200},
+		{Method: "GET", Path: "/key/prod/db/password", ExpectedCode: 200},
+		{Method: "PUT", Path: "/key/prod/db/password", Body: RequestSingle{Key: "prod/db/password", Value: "changed"}, ExpectedCode: 403},
+		{Method: "DELETE", Path: "/key/prod/db/password", ExpectedCode: 403},
+		{Method: "GET", Path: "/key/prod/payments/secret/master", ExpectedCode: 403},
+		{Method: "PUT", Path: "/key/prod/payments/secret/master", Body: RequestSingle{Key: "prod/payments/secret/master", Value: "changed"}, ExpectedCode: 403},
+		{Method: "POST", Path: "/key", Body: RequestSingle{Key: "prod/payments/paypal", Value: "created"}, ExpectedCode: 201},
+		{Method: "POST", Path: "/key", Body: RequestSingle{Key: "prod/db/replica", Value: "created"}, ExpectedCode: 403},
+		{Method: "PUT", Path: "/key/prod/payments/stripe", Body: RequestSingle{Key: "prod/payments/stripe", Value: "changed"}, ExpectedCode: 200},
+		{Method: "PUT", Path: "/key/prod/payments/stripe", Body: RequestSingle{Key: "prod/db/password", Value: "changed"}, ExpectedCode: 400},
+		{Method: "DELETE", Path: "/key/prod/payments/stripe", ExpectedCode: 403},
+		{Method: "GET", Path: "/key/prod/payments/", ExpectedCode: 200},
+		{Method: "GET", Path: "/key/prod/", ExpectedCode: 403},
+		{Method: "POST", Path: "/keys", Body: RequestMany{Keys: []string{"prod/payments/stripe", "prod/payments/secret/master"}}, ExpectedCode: 403},
+		{Method: "POST", Path: "/keys", Body: map[string]interface{}{"key": "prod/payments/stripe", "keys": []string{"prod/payments/secret/master"}}, ExpectedCode: 403},
+		{Method: "POST", Path: "/key", Body: map[string]interface{}{"key": "prod/db/replica", "keys": []string{"prod/payments/paypal"}, "value": "created"}, ExpectedCode: 403},
+	}
+
+	for _, test := range tests {
+		if code, body := serve(test.Method, test.Path, info.Token, test.Body); code != test.ExpectedCode {
+			t.Errorf("%s %s = HTTP/%d %s, expected HTTP/%d", test.Method, test.Path, code, body, test.ExpectedCode)
+		}
+	}
+
+	for _, path := range []string{"/keys?prefix=prod/payments/", "/keys?prefix=prod/payments/&values=true", "/key/prod/payments/", "/watch?prefix=prod/payments/&revision=0&values=true"} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// The watch sends the events after the revision before waiting for the request to be done, so it is done before being made
+		cancel()
+
+		mockRequest, err := http.NewRequest("GET", path, nil)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+info.Token)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest.WithContext(ctx))
+
+		if body := mockResponseWriter.Body.Bytes(); mockResponseWriter.Code != 200 || !bytes.Contains(body, []byte("stripe")) || bytes.Contains(body, []byte("secret")) {
+			t.Errorf("GET %s = HTTP/%d %s, expected HTTP/200 without the keys denied under the prefix", path, mockResponseWriter.Code, body)
+		}
+	}
+
+	if code, _ := serve("DELETE", "/sys/policies/payments", testRootToken, nil); code != 200 {
+		t.Errorf("DELETE /sys/policies/payments = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if code, _ := serve("DELETE", "/sys/policies/payments", testRootToken, nil); code != 400 {
+		t.Errorf("DELETE /sys/policies/payments again = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code, _ := serve("GET", "/key/prod/payments/stripe", info.Token, nil); code != 403 {
+		t.Errorf("GET /key/prod/payments/stripe after deleting the policy = HTTP/%d, expected HTTP/403", code)
+	}
+}
+
+// Need to test the following:
+// If a token or a set of policies is checked then whether the operation on the key is allowed is returned, along with the policy and
+//     rule which decided it, and the key is not read
+// If a deny rule matches the key then it decides the check, whatever the other policies grant
+// If the token has the root policy then the check is allowed by the root policy
+// If the operation is not a capability, or not exactly one of the token and the policies is provided, then a HTTP/400 status is returned
+func TestPolicyCheck(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	rules, _ := parsePolicy(`path "prod/payments/*" { capabilities = ["read", "list"] }`)
+
+	server.keys.writePolicy("payments", "", rules)
+
+	rules, _ = parsePolicy(`path "prod/payments/secret/*" { capabilities = ["deny"] }`)
+
+	server.keys.writePolicy("no-secrets", "", rules)
+
+	info, err := server.keys.createToken(RequestToken{Name: "payments", Policies: []string{"payments", "no-secrets"}}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the token:", err)
+	}
+
+	tests := []struct {
+		Check            RequestPolicyCheck
+		ExpectedCode     int
+		ExpectedDecision PolicyDecision
+	}{
+		{
+			Check:            RequestPolicyCheck{Key: "prod/payments/stripe", Operation: CapabilityRead, Token: info.Token},
+			ExpectedCode:     200,
+			ExpectedDecision: PolicyDecision{Allowed: true, Policy: "payments", Rule: &PolicyRule{Glob: "prod/payments/*"}},
+		},
+		{
+			Check:            RequestPolicyCheck{Key: "prod/payments/stripe", Operation: CapabilityUpdate, Token: info.Token},
+			ExpectedCode:     200,
+			ExpectedDecision: PolicyDecision{Allowed: false},
+		},
+		{
+			Check:            RequestPolicyCheck{Key: "prod/payments/secret/master", Operation: CapabilityRead, Policies: []string{"payments", "no-secrets"}},
+			ExpectedCode:     200,
+			ExpectedDecision: PolicyDecision{Allowed: false, Policy: "no-secrets", Rule: &PolicyRule{Glob: "prod/payments/secret/*"}},
+		},
+		{
+			Check:            RequestPolicyCheck{Key: "prod/db/password", Operation: CapabilityDelete, Token: testRootToken},
+			ExpectedCode:     200,
+			ExpectedDecision: PolicyDecision{Allowed: true, Policy: RootPolicy},
+		},
+		{Check: RequestPolicyCheck{Key: "prod/db/password", Operation: CapabilityDeny, Token: info.Token}, ExpectedCode: 400},
+		{Check: RequestPolicyCheck{Key: "prod/db/password", Operation: "sudo", Token: info.Token}, ExpectedCode: 400},
+		{Check: RequestPolicyCheck{Key: "prod/db/password", Operation: CapabilityRead}, ExpectedCode: 400},
+		{Check: RequestPolicyCheck{Key: "prod/db/password", Operation: CapabilityRead, Policies: []string{"payments"}, Token: info.Token}, ExpectedCode: 400},
+		{Check: RequestPolicyCheck{Key: "prod/db/password", Operation: CapabilityRead, Token: "not a token"}, ExpectedCode: 400},
+	}
+
+	for _, test := range tests {
+		var requestBody bytes.Buffer
+
+		json.NewEncoder(&requestBody).Encode(test.Check)
+
+		mockRequest, err := http.NewRequest("POST", "/sys/policy/check", &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		if mockResponseWriter.Code != test.ExpectedCode {
+			t.Errorf("POST /sys/policy/check with %+v = HTTP/%d %s, expected HTTP/%d", test.Check, mockResponseWriter.Code, mockResponseWriter.Body, test.ExpectedCode)
+
+			continue
+		}
+
+		if test.ExpectedCode != 200 {
+			continue
+		}
+
+		var response struct {
+			Message PolicyDecision `json:"msg"`
+		}
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+		decision, expected := response.Message, test.ExpectedDecision
+
+		if decision.Allowed != expected.Allowed || decision.Policy != expected.Policy || (decision.Rule == nil) != (expected.Rule == nil) || (decision.Rule != nil && decision.Rule.Glob != expected.Rule.Glob) {
+			t.Errorf("POST /sys/policy/check with %+v = %s, expected %+v", test.Check, mockResponseWriter.Body, expected)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/shamir"
+)
+
+var ErrSealed = errors.New("the keymanager is sealed")
+
+// sealState tracks whether the master key is in memory, and while it is not, the unseal shares submitted so far
+type sealState struct {
+	mutex     *sync.Mutex
+	sealed    bool
+	shares    [][]byte
+	threshold int
+}
+
+// RequestUnseal is the struct representing the format that requests to "/sys/unseal" will use to submit a single unseal share
+type RequestUnseal struct {
+	Share string `json:"share"`
+}
+
+// SealStatus is the message sent back by the seal routes
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Progress  int  `json:"progress"`
+	Threshold int  `json:"threshold"`
+}
+
+func (ss sealState) status() SealStatus {
+	return SealStatus{Sealed: ss.sealed, Progress: len(ss.shares), Threshold: ss.threshold}
+}
+
+// IsSealed reports whether the server is sealed
+func (s *Server) IsSealed() bool {
+	s.seal.mutex.Lock()
+
+	defer s.seal.mutex.Unlock()
+
+	return s.seal.sealed
+}
+
+// SplitMasterKey splits the master key into the given number of hex encoded unseal shares, any "threshold" of which can unseal the keymanager;
+// the threshold is stored in the first byte of every share so that "/sys/unseal" knows how many shares to wait for
+func SplitMasterKey(masterKey []byte, shares, threshold int) ([]string, error) {
+	splitShares, err := shamir.Split(masterKey, shares, threshold)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encodedShares := make([]string, 0, len(splitShares))
+
+	for _, share := range splitShares {
+		encodedShares = append(encodedShares, hex.EncodeToString(append([]byte{byte(threshold)}, share...)))
+	}
+
+	return encodedShares, nil
+}
+
+// unseal opens the storage with the master key and starts serving the keys in it, opening the keyring it holds or creating a new keyring when it is empty,
+// then imports the legacy keys file if there is one; it must be called with the seal mutex held
+func (s *Server) unseal(masterKey []byte) error {
+	store := s.storage
+
+	if store == nil {
+		var err error
+
+		if store, err = s.options.OpenStorage(masterKey); err != nil {
+			return err
+		}
+	}
+
+	if err := s.keys.unseal(store, masterKey); err != nil {
+		if s.storage == nil {
+			store.Close()
+		}
+
+		return err
+	}
+
+	if s.options.LegacyKeysFile != "" {
+		imported, err := s.ImportLegacyKeysFile(s.options.LegacyKeysFile)
+
+		if err != nil {
+			s.dropKeyData()
+
+			return err
+		}
+
+		if imported != 0 {
+			s.logger.Printf("imported %d keys from %s into the storage and removed it; the file held the values in plaintext, so any copies or backups of it must be deleted too", imported, s.options.LegacyKeysFile)
+		}
+	}
+
+	s.seal.sealed, s.seal.shares, s.seal.threshold = false, nil, 0
+
+	s.logger.Println("unsealed")
+
+	return nil
+}
+
+// Unseal unseals the server with the master key, ErrWrongMasterKey is returned when the keyring in the storage cannot be opened with it
+func (s *Server) Unseal(masterKey []byte) error {
+	s.seal.mutex.Lock()
+
+	defer s.seal.mutex.Unlock()
+
+	if !s.seal.sealed {
+		return nil
+	}
+
+	return s.unseal(masterKey)
+}
+
+// dropKeyData drops the master key and keyring from memory, the storage is closed when it was opened with the master key
+func (s *Server) dropKeyData() {
+	s.keys.mutex.Lock()
+
+	if s.keys.storage != nil && s.storage == nil {
+		s.keys.storage.Close()
+	}
+
+	s.keys.keyring, s.keys.masterKey, s.keys.storage = nil, nil, nil
+
+	s.keys.mutex.Unlock()
+
+	// Whoever is waiting for a change finds the keymanager sealed
+	s.keys.changes.notify()
+}
+
+// Seal drops the master key and keyring from memory, the server then stays sealed until enough unseal shares are submitted
+func (s *Server) Seal() {
+	s.seal.mutex.Lock()
+
+	defer s.seal.mutex.Unlock()
+
+	s.seal.sealed, s.seal.shares, s.seal.threshold = true, nil, 0
+
+	s.dropKeyData()
+
+	s.logger.Println("sealed")
+}
+
+// RequireUnsealed is a middleware handler which rejects every request while the server is sealed
+func (s *Server) RequireUnsealed(c *gin.Context) {
+	if s.IsSealed() {
+		c.AbortWithStatusJSON(503, Response{true, ErrorSealed})
+
+		return
+	}
+
+	c.Next()
+}
+
+// HandleSeal handles the POST request for sealing the server, dropping the master key and keyring from memory
+func (s *Server) HandleSeal(c *gin.Context) {
+	s.Seal()
+
+	s.seal.mutex.Lock()
+
+	status := s.seal.status()
+
+	s.seal.mutex.Unlock()
+
+	c.JSON(200, Response{false, status})
+}
+
+// HandleSealStatus handles the GET request for whether the server is sealed and how far along unsealing is
+func (s *Server) HandleSealStatus(c *gin.Context) {
+	s.seal.mutex.Lock()
+
+	status := s.seal.status()
+
+	s.seal.mutex.Unlock()
+
+	c.JSON(200, Response{false, status})
+}
+
+// HandleUnseal handles the POST request for submitting an unseal share, once the threshold of shares is reached the master key is
+// recovered from them and the server is unsealed; if the recovered master key is wrong the submitted shares are discarded
+func (s *Server) HandleUnseal(c *gin.Context) {
+	var UnsealRequest RequestUnseal
+
+	err := json.NewDecoder(c.Request.Body).Decode(&UnsealRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	share, err := hex.DecodeString(UnsealRequest.Share)
+
+	if err != nil || len(share) < 3 || share[0] < 2 {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidUnsealShare})
+
+		return
+	}
+
+	threshold, share := int(share[0]), share[1:]
+
+	s.seal.mutex.Lock()
+
+	defer s.seal.mutex.Unlock()
+
+	if !s.seal.sealed {
+		c.JSON(200, Response{false, s.seal.status()})
+
+		return
+	}
+
+	if s.seal.threshold != 0 && (s.seal.threshold != threshold || len(s.seal.shares[0]) != len(share)) {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidUnsealShare})
+
+		return
+	}
+
+	for _, submittedShare := range s.seal.shares {
+		if bytes.Equal(submittedShare, share) {
+			c.JSON(200, Response{false, s.seal.status()})
+
+			return
+		}
+	}
+
+	s.seal.threshold = threshold
+	s.seal.shares = append(s.seal.shares, share)
+
+	if len(s.seal.shares) < s.seal.threshold {
+		c.JSON(200, Response{false, s.seal.status()})
+
+		return
+	}
+
+	masterKey, err := shamir.Combine(s.seal.shares)
+
+	s.seal.shares, s.seal.threshold = nil, 0
+
+	if err == nil {
+		err = s.unseal(masterKey)
+	}
+
+	if err != nil {
+		s.logger.Printf("unsealing failed: %v", err)
+
+		c.AbortWithStatusJSON(400, Response{true, ErrorUnsealFailed})
+
+		return
+	}
+
+	c.JSON(200, Response{false, s.seal.status()})
+}
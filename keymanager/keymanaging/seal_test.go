@@ -0,0 +1,150 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Need to test the following:
+// If the server is sealed then the key routes return a HTTP/503 status and the "ErrorSealed" constant
+// If fewer unseal shares than the threshold are submitted then the server stays sealed and the progress is returned
+// If shares of the wrong master key are submitted then unsealing fails and has to be started over
+// If the threshold of unseal shares is reached then the server is unsealed and the keys are readable again
+func TestSealAndUnseal(t *testing.T) {
+	storageDir, err := ioutil.TempDir("", "TestSealAndUnseal")
+
+	if err != nil {
+		t.Fatal("could not create the temporary directory")
+	}
+
+	defer os.RemoveAll(storageDir)
+
+	storagePath := filepath.Join(storageDir, "storage.json")
+
+	server, err := NewServer(nil, Options{
+		MasterKey: testMasterKey,
+		OpenStorage: func(masterKey []byte) (storage.Storage, error) {
+			return storage.OpenJSONFile(storagePath, masterKey, 0)
+		},
+	}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	server.keys.set("TestSealAndUnseal", "success", writeOptions{})
+
+	rightShares, err := SplitMasterKey(testMasterKey, 3, 2)
+
+	if err != nil {
+		t.Fatal("could not split the master key:", err)
+	}
+
+	wrongShares, err := SplitMasterKey([]byte("fedcba9876543210fedcba9876543210"), 3, 2)
+
+	if err != nil {
+		t.Fatal("could not split the wrong master key:", err)
+	}
+
+	server.Seal()
+
+	router := gin.New()
+	router.GET("/keys/*path", server.RequireUnsealed, server.HandleGetKey)
+	router.POST("/sys/unseal", server.HandleUnseal)
+
+	serve := func(method, path string, body interface{}) (int, map[string]interface{}) {
+		requestBytes, _ := json.Marshal(body)
+
+		mockRequest, err := http.NewRequest(method, path, bytes.NewReader(requestBytes))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		var mockResponseJSON map[string]interface{}
+
+		json.NewDecoder(mockResponseWriter.Body).Decode(&mockResponseJSON)
+
+		return mockResponseWriter.Code, mockResponseJSON
+	}
+
+	if code, response := serve("GET", "/keys/TestSealAndUnseal", nil); code != 503 || response["msg"] != ErrorSealed {
+		t.Errorf(`GET /keys/TestSealAndUnseal while sealed = HTTP/%d, "%v"; expected HTTP/503 and "%s"`, code, response, ErrorSealed)
+	}
+
+	tests := []struct {
+		ExpectedMessage    interface{}
+		ExpectedStatusCode int
+		ExpectedSealed     bool
+		Share              string
+	}{
+		{
+			ExpectedMessage:    map[string]interface{}{"sealed": true, "progress": 1.0, "threshold": 2.0},
+			ExpectedStatusCode: 200,
+			ExpectedSealed:     true,
+			Share:              wrongShares[0],
+		},
+		{
+			ExpectedMessage:    ErrorUnsealFailed,
+			ExpectedStatusCode: 400,
+			ExpectedSealed:     true,
+			Share:              wrongShares[1],
+		},
+		{
+			ExpectedMessage:    ErrorInvalidUnsealShare,
+			ExpectedStatusCode: 400,
+			ExpectedSealed:     true,
+			Share:              "not a share",
+		},
+		{
+			ExpectedMessage:    map[string]interface{}{"sealed": true, "progress": 1.0, "threshold": 2.0},
+			ExpectedStatusCode: 200,
+			ExpectedSealed:     true,
+			Share:              rightShares[2],
+		},
+		{
+			ExpectedMessage:    map[string]interface{}{"sealed": false, "progress": 0.0, "threshold": 0.0},
+			ExpectedStatusCode: 200,
+			ExpectedSealed:     false,
+			Share:              rightShares[0],
+		},
+	}
+
+	for _, test := range tests {
+		code, response := serve("POST", "/sys/unseal", RequestUnseal{Share: test.Share})
+
+		expectedMessage, _ := json.Marshal(test.ExpectedMessage)
+		message, _ := json.Marshal(response["msg"])
+
+		if code != test.ExpectedStatusCode || !bytes.Equal(message, expectedMessage) || server.IsSealed() != test.ExpectedSealed {
+			t.Errorf(
+				`HandleUnseal(context) = Status Code: HTTP/%d, Message: %s, and sealed = %v; expected HTTP/%d, Message: %s, and sealed = %v`,
+				code,
+				message,
+				server.IsSealed(),
+				test.ExpectedStatusCode,
+				expectedMessage,
+				test.ExpectedSealed,
+			)
+		}
+	}
+
+	if code, response := serve("GET", "/keys/TestSealAndUnseal", nil); code != 200 || response["msg"] != "success" {
+		t.Errorf(`GET /keys/TestSealAndUnseal after unsealing = HTTP/%d, "%v"; expected HTTP/200 and "success"`, code, response)
+	}
+}
@@ -0,0 +1,193 @@
+package keymanaging
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var ErrStorageRequired = errors.New("a server needs either a storage or an OpenStorage option to unseal with")
+
+// Options are the settings of a Server
+type Options struct {
+	// MasterKey unseals the server as soon as it is created, without it the server starts sealed until enough unseal shares are submitted
+	MasterKey []byte
+	// OpenStorage opens the storage with the master key recovered from the unseal shares, it is used when the server is created without
+	// a storage, which is needed for storage that cannot be opened without the master key; storage opened by it is closed when sealing
+	OpenStorage func(masterKey []byte) (storage.Storage, error)
+	// MaxVersions is the number of versions retained for each key which does not set its own, zero retaining every version
+	MaxVersions int
+	// TrashRetention is how long deleted keys are kept in the trash before they are purged, zero keeping them until they are destroyed
+	TrashRetention time.Duration
+	// ReapInterval is how often expired keys, tokens and wrapped responses are removed, the trash is purged and the events are compacted in the background,
+	// zero leaving it to the requests which come across them
+	ReapInterval time.Duration
+	// EventRetention is the number of the latest events kept for watchers to resume from, zero keeping every event
+	EventRetention int
+	// WebhookBackoff is the wait before the first retry of a failed webhook delivery, doubled for every retry after it; zero waits
+	// DefaultWebhookBackoff
+	WebhookBackoff time.Duration
+	// RootToken is the token which is allowed every request, it is the token other tokens are first created with; it is not kept
+	// in the storage, so it is only valid for as long as the server is given it
+	RootToken string
+	// AuditLog is the path of the file every request to the keys is recorded in, along with a file next to it ending in ".head" holding
+	// the last record; nothing is recorded when it is empty
+	AuditLog string
+	// AuditKey is the key the records of the audit log and the names of the keys in them are HMAC'd with, it is needed with AuditLog
+	AuditKey []byte
+	// TrustedProxies are the IP addresses and CIDR ranges of the proxies, such as the gatekeeper, which are trusted to forward the IP of the
+	// client in the X-KeyMan-Source-IP header; the header of requests made from anywhere else is ignored
+	TrustedProxies []string
+	// LegacyKeysFile is the path of a keys file written by an older keymanager, it is imported into the storage and removed when the server
+	// is unsealed
+	LegacyKeysFile string
+}
+
+// Server is a keymanager serving the keys kept in its storage, any number of servers can run in the same process as long as they
+// do not share their storage; the routes are served by Handler, or can be added to another router with Routes
+type Server struct {
+	auditLog       *auditLog
+	closeOnce      sync.Once
+	keys           keyData
+	logger         *log.Logger
+	options        Options
+	seal           sealState
+	stopReaper     chan struct{}
+	storage        storage.Storage
+	trustedProxies []*net.IPNet
+}
+
+// NewServer creates a server keeping the keys in the storage, which may be nil when "options.OpenStorage" is set; the server is unsealed
+// with "options.MasterKey" if it is set and starts sealed otherwise. A nil logger discards everything logged, and since webhooks are
+// delivered in the background the server has to be closed once it is no longer used
+func NewServer(store storage.Storage, options Options, logger *log.Logger) (*Server, error) {
+	if store == nil && options.OpenStorage == nil {
+		return nil, ErrStorageRequired
+	}
+
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	trustedProxies, err := parseTrustedProxies(options.TrustedProxies)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		keys:       newKeyData(options),
+		logger:     logger,
+		options:    options,
+		seal:       sealState{mutex: &sync.Mutex{}, sealed: true},
+		stopReaper: make(chan struct{}),
+		storage:    store,
+
+		trustedProxies: trustedProxies,
+	}
+
+	if options.AuditLog != "" {
+		auditLog, err := openAuditLog(options.AuditLog, options.AuditKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.auditLog = auditLog
+	}
+
+	if len(options.MasterKey) != 0 {
+		if err := s.Unseal(options.MasterKey); err != nil {
+			if s.auditLog != nil {
+				s.auditLog.close()
+			}
+
+			return nil, err
+		}
+	}
+
+	if options.ReapInterval > 0 {
+		s.startReaper(options.ReapInterval)
+	}
+
+	if options.WebhookBackoff <= 0 {
+		options.WebhookBackoff = DefaultWebhookBackoff
+	}
+
+	s.startDispatcher(options.WebhookBackoff)
+
+	return s, nil
+}
+
+// Close stops the background work of the server, reaping and delivering webhooks, and closes its audit log; the storage the server
+// was created with is left open for its owner to close
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stopReaper)
+
+		if s.auditLog != nil {
+			s.auditLog.close()
+		}
+	})
+}
+
+// Handler returns a handler serving every route of the server, along with a listing of the routes at "/"
+func (s *Server) Handler() http.Handler {
+	router := NewKeyManagingRouter()
+
+	s.Routes(router)
+
+	router.Any("/", CreateInfoHandler(router))
+
+	return router
+}
+
+// Routes adds every route of the server to the router, the routes which need the keys reject requests while the server is sealed;
+// keys are hierarchical, so the routes for a single key end with the key as a path and the actions on a key other than reading
+// and writing it are routes of their own in front of the key. Every request for the keys or the tokens has to be made with a token
+// and is recorded in the audit log, including those rejected while the server is sealed, and the routes administering the server
+// need a token with the root policy; only the seal status and unsealing are open to everyone
+func (s *Server) Routes(router gin.IRouter) {
+	auditedRouter := router.Group("", s.Audit, s.RequireUnsealed, s.RequireToken, s.Authorize)
+	rootRouter := router.Group("", s.RequireUnsealed, s.RequireToken, s.RequireRoot)
+
+	auditedRouter.DELETE("/key/*path", s.HandleDeleteKey)
+	auditedRouter.GET("/key/*path", s.WrapResponse, s.HandleGetKey)
+	auditedRouter.POST("/key", s.HandlePostKey)
+	auditedRouter.GET("/keys", s.HandleListKeys)
+	auditedRouter.GET("/metadata/*path", s.HandleGetKeyMetadata)
+	auditedRouter.POST("/keys", s.HandleGetManyKeys)
+	auditedRouter.PUT("/key/*path", s.HandlePutKey)
+	auditedRouter.POST("/destroy/*path", s.HandleDestroyKey)
+	auditedRouter.POST("/restore/*path", s.HandleRestoreKey)
+	auditedRouter.POST("/rollback/*path", s.HandleRollbackKey)
+	auditedRouter.GET("/versions/*path", s.HandleGetKeyVersions)
+	auditedRouter.POST("/txn", s.HandleTxn)
+	rootRouter.POST("/sys/rotate", s.HandleRotateKEK)
+	auditedRouter.GET("/trash", s.HandleGetTrash)
+	auditedRouter.GET("/watch", s.HandleWatch)
+	rootRouter.POST("/sys/webhooks", s.HandleCreateWebhook)
+	rootRouter.GET("/sys/webhooks", s.HandleGetWebhooks)
+	rootRouter.DELETE("/sys/webhooks/:id", s.HandleDeleteWebhook)
+	rootRouter.GET("/sys/webhooks/:id/deliveries", s.HandleGetWebhookDeliveries)
+	rootRouter.GET("/sys/policies", s.HandleGetPolicies)
+	rootRouter.DELETE("/sys/policies/:name", s.HandleDeletePolicy)
+	rootRouter.GET("/sys/policies/:name", s.HandleGetPolicy)
+	rootRouter.PUT("/sys/policies/:name", s.HandlePutPolicy)
+	rootRouter.POST("/sys/policy/check", s.HandleCheckPolicy)
+	auditedRouter.POST("/auth/token/create", s.RequireRoot, s.HandleCreateToken)
+	auditedRouter.POST("/auth/token/lookup", s.HandleLookupToken)
+	auditedRouter.POST("/auth/token/revoke", s.HandleRevokeToken)
+
+	router.POST("/sys/seal", s.RequireToken, s.RequireRoot, s.HandleSeal)
+	router.GET("/sys/seal-status", s.HandleSealStatus)
+	router.POST("/sys/unseal", s.HandleUnseal)
+	router.POST("/sys/unwrap", s.Audit, s.RequireUnsealed, s.HandleUnwrap)
+}
@@ -0,0 +1,50 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Need to test the following:
+// If two servers run in the same process then a key created through the handler of one is not visible to the other
+// If one of the servers is sealed then the other one keeps serving its keys
+func TestServerIsolation(t *testing.T) {
+	first, second := newTestServer(t), newTestServer(t)
+
+	serve := func(server *Server, method, path string, body interface{}) int {
+		requestBytes, _ := json.Marshal(body)
+
+		mockRequest, err := http.NewRequest(method, path, bytes.NewReader(requestBytes))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		server.Handler().ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code
+	}
+
+	if code := serve(first, "POST", "/key", RequestSingle{Key: "TestServerIsolation", Value: "first"}); code != 201 {
+		t.Fatalf("POST /key on the first server = HTTP/%d, expected HTTP/201", code)
+	}
+
+	if code := serve(second, "GET", "/key/TestServerIsolation", nil); code != 400 {
+		t.Errorf("GET /key/TestServerIsolation on the second server = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code := serve(second, "POST", "/sys/seal", nil); code != 200 {
+		t.Fatalf("POST /sys/seal on the second server = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if code := serve(first, "GET", "/key/TestServerIsolation", nil); code != 200 || first.IsSealed() || !second.IsSealed() {
+		t.Errorf("GET /key/TestServerIsolation on the first server after sealing the second = HTTP/%d, expected HTTP/200", code)
+	}
+}
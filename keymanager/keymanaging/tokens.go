@@ -0,0 +1,441 @@
+package keymanaging
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errTokenDoesNotExist = errors.New(ErrorInvalidToken)
+
+// RootPolicy is the policy which allows every request, it is the policy of the root token and of the tokens which can create other tokens
+const RootPolicy = "root"
+
+// RootTokenID is the ID of the root token, which is not kept in the storage
+const RootTokenID = "root"
+
+// bearerPrefix starts the Authorization header carrying a token
+const bearerPrefix = "Bearer "
+
+// contextToken is the key of the gin context the token of an authenticated request is kept under
+const contextToken = "token"
+
+// tokenPrefix is the prefix of the storage keys of the tokens, which are named by the SHA-256 hash of the token so that the tokens
+// themselves are never stored
+const tokenPrefix = "token/"
+
+// token is a bearer token which requests are made with, along with the name of who it was created for and the policies it has
+type token struct {
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Policies  []string   `json:"policies"`
+}
+
+// RequestToken is the request for the creation of a token, which expires after the "ttl" duration or at the "expires_at" time if
+// either is provided and never expires otherwise
+type RequestToken struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Name      string     `json:"name"`
+	Policies  []string   `json:"policies"`
+	TTL       string     `json:"ttl,omitempty"`
+}
+
+// RequestTokenLookup is the request for looking up or revoking a token, the token the request is made with when none is provided
+type RequestTokenLookup struct {
+	Token string `json:"token"`
+}
+
+// TokenInfo is a token as it is returned by the routes, the token itself is only returned when it is created
+type TokenInfo struct {
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Policies  []string   `json:"policies"`
+	Token     string     `json:"token,omitempty"`
+}
+
+// hashToken returns the hex encoded SHA-256 hash of the token, which is what the token is stored as
+func hashToken(bearer string) string {
+	hash := sha256.Sum256([]byte(bearer))
+
+	return hex.EncodeToString(hash[:])
+}
+
+func (t *token) info() TokenInfo {
+	return TokenInfo{CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt, ID: t.ID, Name: t.Name, Policies: t.Policies}
+}
+
+func (t *token) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
+
+// hasPolicy reports whether the token has the policy
+func (t *token) hasPolicy(policy string) bool {
+	for _, tokenPolicy := range t.Policies {
+		if tokenPolicy == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valid reports whether the token can be created: it needs a name, and none of its policies can be empty
+func (rt *RequestToken) valid() bool {
+	if rt.Name == "" {
+		return false
+	}
+
+	for _, policy := range rt.Policies {
+		if policy == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readToken reads the token stored under the hash, nil is returned when there is none
+func readToken(txn storage.Txn, hash string) (*token, error) {
+	data, exists, err := txn.Get(tokenPrefix + hash)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	t := &token{}
+
+	if err = json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// createToken creates a token for the request, returning it along with the token itself, which is not kept anywhere else
+func (kd *keyData) createToken(request RequestToken, expiresAt *time.Time) (TokenInfo, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return TokenInfo{}, err
+	}
+
+	bearer := hex.EncodeToString(newRandomKey())
+
+	t := &token{
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		ID:        hex.EncodeToString(newRandomKey()[:8]),
+		Name:      request.Name,
+		Policies:  request.Policies,
+	}
+
+	if t.Policies == nil {
+		t.Policies = []string{}
+	}
+
+	data, err := json.Marshal(t)
+
+	if err != nil {
+		return TokenInfo{}, err
+	}
+
+	if err = store.Transaction(func(txn storage.Txn) error { return txn.Put(tokenPrefix+hashToken(bearer), data) }); err != nil {
+		return TokenInfo{}, err
+	}
+
+	info := t.info()
+
+	info.Token = bearer
+
+	return info, nil
+}
+
+// lookupToken returns the token, errTokenDoesNotExist is returned when it was never created, has been revoked or has expired
+func (kd *keyData) lookupToken(bearer string) (*token, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := readToken(store, hashToken(bearer))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil || t.expired(time.Now()) {
+		return nil, errTokenDoesNotExist
+	}
+
+	return t, nil
+}
+
+// revokeToken removes the token so that it can no longer be used, errTokenDoesNotExist is returned when there is no such token
+func (kd *keyData) revokeToken(bearer string) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error {
+		hash := hashToken(bearer)
+
+		t, err := readToken(txn, hash)
+
+		if err != nil {
+			return err
+		}
+
+		if t == nil {
+			return errTokenDoesNotExist
+		}
+
+		return txn.Delete(tokenPrefix + hash)
+	})
+}
+
+// purgeExpiredTokens removes every token which has expired, returning how many were removed
+func (kd *keyData) purgeExpiredTokens() (int, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	now, purged := time.Now(), 0
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		storageKeys, err := txn.List(tokenPrefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, storageKey := range storageKeys {
+			t, err := readToken(txn, strings.TrimPrefix(storageKey, tokenPrefix))
+
+			if err != nil {
+				return err
+			}
+
+			if !t.expired(now) {
+				continue
+			}
+
+			if err = txn.Delete(storageKey); err != nil {
+				return err
+			}
+
+			purged++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// isRootToken reports whether the token is the root token of the server, there is none when "options.RootToken" is empty
+func (s *Server) isRootToken(bearer string) bool {
+	return s.options.RootToken != "" && subtle.ConstantTimeCompare([]byte(hashToken(bearer)), []byte(hashToken(s.options.RootToken))) == 1
+}
+
+// authenticate returns the token the request is made with, the root token is known without reading the storage and so also works
+// while the server is sealed
+func (s *Server) authenticate(bearer string) (*token, error) {
+	if s.isRootToken(bearer) {
+		return &token{ID: RootTokenID, Name: RootTokenID, Policies: []string{RootPolicy}}, nil
+	}
+
+	return s.keys.lookupToken(bearer)
+}
+
+// requestToken returns the token the request was authenticated with, nil is returned for requests which were not authenticated
+func requestToken(c *gin.Context) *token {
+	if t, exists := c.Get(contextToken); exists {
+		return t.(*token)
+	}
+
+	return nil
+}
+
+// RequireToken is a middleware handler which rejects every request which is not made with a valid token in the Authorization header,
+// as "Bearer <token>"
+func (s *Server) RequireToken(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+
+	if !strings.HasPrefix(header, bearerPrefix) {
+		c.AbortWithStatusJSON(401, Response{true, ErrorTokenRequired})
+
+		return
+	}
+
+	t, err := s.authenticate(strings.TrimPrefix(header, bearerPrefix))
+
+	switch err {
+	case nil:
+	case errTokenDoesNotExist:
+		c.AbortWithStatusJSON(403, Response{true, ErrorInvalidToken})
+
+		return
+	case ErrSealed:
+		c.AbortWithStatusJSON(503, Response{true, ErrorSealed})
+
+		return
+	default:
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.Set(contextToken, t)
+
+	c.Next()
+}
+
+// RequireRoot is a middleware handler which rejects every request which was not authenticated with a token having the root policy
+func (s *Server) RequireRoot(c *gin.Context) {
+	if t := requestToken(c); t == nil || !t.hasPolicy(RootPolicy) {
+		c.AbortWithStatusJSON(403, Response{true, ErrorPermissionDenied})
+
+		return
+	}
+
+	c.Next()
+}
+
+// parseTokenLookup reads the token a lookup or revocation is for, which is the token the request is made with when the body does not
+// provide one
+func parseTokenLookup(c *gin.Context) (string, bool) {
+	var LookupRequest RequestTokenLookup
+
+	if c.Request.Body != nil {
+		if err := json.NewDecoder(c.Request.Body).Decode(&LookupRequest); err != nil && err != io.EOF {
+			return "", false
+		}
+	}
+
+	if LookupRequest.Token == "" {
+		return strings.TrimPrefix(c.GetHeader("Authorization"), bearerPrefix), true
+	}
+
+	return LookupRequest.Token, true
+}
+
+// HandleCreateToken handles the POST request for the creation of a token with a name, policies and optionally an expiry, the token
+// itself is only returned by this request
+func (s *Server) HandleCreateToken(c *gin.Context) {
+	var TokenRequest RequestToken
+
+	err := json.NewDecoder(c.Request.Body).Decode(&TokenRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	if !TokenRequest.valid() {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidTokenRequest})
+
+		return
+	}
+
+	expiresAt, valid := parseExpiry(TokenRequest.TTL, TokenRequest.ExpiresAt, time.Now())
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidExpiry})
+
+		return
+	}
+
+	info, err := s.keys.createToken(TokenRequest, expiresAt)
+
+	if err != nil {
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(201, Response{false, info})
+}
+
+// HandleLookupToken handles the POST request for the name, policies and expiry of a token, the token the request is made with
+// when the body does not provide one
+func (s *Server) HandleLookupToken(c *gin.Context) {
+	bearer, valid := parseTokenLookup(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	t, err := s.authenticate(bearer)
+
+	switch err {
+	case nil:
+	case errTokenDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidToken})
+
+		return
+	default:
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, t.info()})
+}
+
+// HandleRevokeToken handles the POST request for revoking a token, the token the request is made with when the body does not
+// provide one; the root token cannot be revoked, it is removed by restarting the keymanager without it
+func (s *Server) HandleRevokeToken(c *gin.Context) {
+	bearer, valid := parseTokenLookup(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	if s.isRootToken(bearer) {
+		c.AbortWithStatusJSON(400, Response{true, ErrorRevokeRootToken})
+
+		return
+	}
+
+	err := s.keys.revokeToken(bearer)
+
+	switch err {
+	case nil:
+	case errTokenDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidToken})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, ""})
+}
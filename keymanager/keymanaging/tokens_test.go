@@ -0,0 +1,178 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRootToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// testToken creates a token with the root policy named after who it is for, returning the token
+func testToken(t *testing.T, server *Server, name string) string {
+	info, err := server.keys.createToken(RequestToken{Name: name, Policies: []string{RootPolicy}}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the token:", err)
+	}
+
+	return info.Token
+}
+
+// Need to test the following:
+// If a request for the keys is made without a token then a HTTP/401 status is returned, and with a token which does not exist
+//     a HTTP/403 status is returned
+// If a token is created by the root token then it is returned once with its name, policies and expiry, and only its hash is stored
+// If a token is created by a token without the root policy, or the routes administering the server are requested with it,
+//     then a HTTP/403 status is returned
+// If a token is created without a name or with an invalid expiry then a HTTP/400 status is returned
+// If a token is looked up then its name, policies and expiry are returned, the token the request is made with when none is provided
+// If a token is revoked then it can no longer be used, and the root token cannot be revoked
+// If a token has expired then it can no longer be used, and it is removed by the reaper
+func TestTokens(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	server.keys.set("TestTokens", "success", writeOptions{})
+
+	serve := func(method, path, bearer string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		if bearer != "" {
+			mockRequest.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	if code, _ := serve("GET", "/key/TestTokens", "", nil); code != 401 {
+		t.Errorf("GET /key/TestTokens without a token = HTTP/%d, expected HTTP/401", code)
+	}
+
+	if code, _ := serve("GET", "/key/TestTokens", "not a token", nil); code != 403 {
+		t.Errorf("GET /key/TestTokens with a token which does not exist = HTTP/%d, expected HTTP/403", code)
+	}
+
+	if code, _ := serve("GET", "/sys/seal-status", "", nil); code != 200 {
+		t.Errorf("GET /sys/seal-status without a token = HTTP/%d, expected HTTP/200", code)
+	}
+
+	for _, invalid := range []RequestToken{{Policies: []string{"deploy"}}, {Name: "ci", Policies: []string{""}}, {Name: "ci", TTL: "-1h"}} {
+		if code, _ := serve("POST", "/auth/token/create", testRootToken, invalid); code != 400 {
+			t.Errorf("POST /auth/token/create with %+v = HTTP/%d, expected HTTP/400", invalid, code)
+		}
+	}
+
+	if code, body := serve("PUT", "/sys/policies/deploy", testRootToken, RequestPolicy{Policy: `path "TestTokens" { capabilities = ["read"] }`}); code != 200 {
+		t.Fatalf("PUT /sys/policies/deploy = HTTP/%d %s, expected HTTP/200", code, body)
+	}
+
+	code, body := serve("POST", "/auth/token/create", testRootToken, RequestToken{Name: "ci", Policies: []string{"deploy"}, TTL: "1h"})
+
+	var created struct {
+		Message TokenInfo `json:"msg"`
+	}
+
+	json.Unmarshal(body, &created)
+
+	if code != 201 || created.Message.Token == "" || created.Message.Name != "ci" || created.Message.ExpiresAt == nil || len(created.Message.Policies) != 1 {
+		t.Fatalf("POST /auth/token/create = HTTP/%d %s, expected HTTP/201 with the token, its name, policies and expiry", code, body)
+	}
+
+	bearer := created.Message.Token
+
+	storageKeys, _ := server.keys.storage.List(tokenPrefix)
+
+	for _, storageKey := range storageKeys {
+		value, _, _ := server.keys.storage.Get(storageKey)
+
+		if strings.Contains(storageKey, bearer) || bytes.Contains(value, []byte(bearer)) {
+			t.Errorf("the token is stored as it is under %s, expected only its hash to be stored", storageKey)
+		}
+	}
+
+	if code, body := serve("GET", "/key/TestTokens", bearer, nil); code != 200 {
+		t.Errorf("GET /key/TestTokens with the token = HTTP/%d %s, expected HTTP/200", code, body)
+	}
+
+	for _, path := range []string{"/auth/token/create", "/sys/rotate", "/sys/webhooks"} {
+		if code, _ := serve("POST", path, bearer, RequestToken{Name: "escalated", Policies: []string{RootPolicy}}); code != 403 {
+			t.Errorf("POST %s with a token without the root policy = HTTP/%d, expected HTTP/403", path, code)
+		}
+	}
+
+	for _, lookup := range []struct {
+		Bearer, Token, ExpectedName string
+	}{
+		{Bearer: bearer, ExpectedName: "ci"},
+		{Bearer: testRootToken, Token: bearer, ExpectedName: "ci"},
+		{Bearer: bearer, Token: testRootToken, ExpectedName: RootTokenID},
+	} {
+		code, body := serve("POST", "/auth/token/lookup", lookup.Bearer, RequestTokenLookup{Token: lookup.Token})
+
+		var response struct {
+			Message TokenInfo `json:"msg"`
+		}
+
+		json.Unmarshal(body, &response)
+
+		if code != 200 || response.Message.Name != lookup.ExpectedName || response.Message.Token != "" {
+			t.Errorf("POST /auth/token/lookup = HTTP/%d %s, expected HTTP/200 with the token named %s", code, body, lookup.ExpectedName)
+		}
+	}
+
+	if code, _ := serve("POST", "/auth/token/lookup", testRootToken, RequestTokenLookup{Token: "not a token"}); code != 400 {
+		t.Errorf("POST /auth/token/lookup for a token which does not exist = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code, _ := serve("POST", "/auth/token/revoke", testRootToken, nil); code != 400 {
+		t.Errorf("POST /auth/token/revoke for the root token = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code, _ := serve("POST", "/auth/token/revoke", bearer, nil); code != 200 {
+		t.Errorf("POST /auth/token/revoke = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if code, _ := serve("GET", "/key/TestTokens", bearer, nil); code != 403 {
+		t.Errorf("GET /key/TestTokens with a revoked token = HTTP/%d, expected HTTP/403", code)
+	}
+
+	if code, _ := serve("POST", "/auth/token/revoke", testRootToken, RequestTokenLookup{Token: bearer}); code != 400 {
+		t.Errorf("POST /auth/token/revoke for a revoked token = HTTP/%d, expected HTTP/400", code)
+	}
+
+	expiresAt := time.Now().Add(-time.Second)
+
+	expired, err := server.keys.createToken(RequestToken{Name: "expired"}, &expiresAt)
+
+	if err != nil {
+		t.Fatal("could not create the expired token:", err)
+	}
+
+	if code, _ := serve("GET", "/key/TestTokens", expired.Token, nil); code != 403 {
+		t.Errorf("GET /key/TestTokens with an expired token = HTTP/%d, expected HTTP/403", code)
+	}
+
+	if purged, err := server.keys.purgeExpiredTokens(); purged != 1 || err != nil {
+		t.Errorf("purgeExpiredTokens() = %d, %v, expected the expired token to be removed", purged, err)
+	}
+}
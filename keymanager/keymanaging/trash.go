@@ -0,0 +1,417 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errKeyNotInTrash = errors.New(ErrorKeyNotInTrash)
+
+// trashPrefix is the storage prefix deleted keys are kept under, followed by their key, until they are restored, destroyed or purged;
+// every deletion of a key is kept under it, so that deleting a key which was recreated does not lose the key deleted before it
+const trashPrefix = "trash/"
+
+// trashedEntry is a deletion of a key in the trash, its versions are kept sealed exactly as they were before the key was deleted and it
+// is told apart from the other deletions of the key by the revision it was deleted at
+type trashedEntry struct {
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	Entry     entry     `json:"entry"`
+	Revision  int64     `json:"revision"`
+}
+
+// TrashInfo describes a deletion of a key in the trash without its values, "revision" is what the deletion was made at and restores it,
+// and "purgeAt" is left out when the trash is never purged
+type TrashInfo struct {
+	DeletedAt time.Time  `json:"deletedAt"`
+	DeletedBy string     `json:"deletedBy"`
+	Key       string     `json:"key"`
+	PurgeAt   *time.Time `json:"purgeAt,omitempty"`
+	Revision  int64      `json:"revision"`
+	Version   int        `json:"version"`
+}
+
+// readTrashed reads the deletions of the key in the trash from the oldest to the latest, none are returned when the key is not in the trash
+func readTrashed(txn storage.Txn, key string) ([]trashedEntry, error) {
+	data, exists, err := txn.Get(trashPrefix + key)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var trashed []trashedEntry
+
+	if err = json.Unmarshal(data, &trashed); err != nil {
+		return nil, err
+	}
+
+	return trashed, nil
+}
+
+// writeTrashed writes the deletions of the key to the trash, removing the key from the trash when none are left
+func writeTrashed(txn storage.Txn, key string, trashed []trashedEntry) error {
+	if len(trashed) == 0 {
+		return txn.Delete(trashPrefix + key)
+	}
+
+	data, err := json.Marshal(trashed)
+
+	if err != nil {
+		return err
+	}
+
+	return txn.Put(trashPrefix+key, data)
+}
+
+// purgeAt returns when the deleted key is purged from the trash, nil meaning that it is kept until it is restored or destroyed
+func (kd *keyData) purgeAt(te *trashedEntry) *time.Time {
+	if kd.trashRetention <= 0 {
+		return nil
+	}
+
+	purgeAt := te.DeletedAt.Add(kd.trashRetention)
+
+	return &purgeAt
+}
+
+// purged reports whether the deleted key has outlived the trash retention, purged keys are treated as gone even before they are removed
+func (kd *keyData) purged(te *trashedEntry, now time.Time) bool {
+	purgeAt := kd.purgeAt(te)
+
+	return purgeAt != nil && !now.Before(*purgeAt)
+}
+
+// delete moves the key, with every one of its versions, to the trash if it is at the revisions matched; a key deleted again after being
+// recreated is kept in the trash along with its earlier deletions
+func (kd *keyData) delete(key, actor string, matches []*revisionMatch) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error {
+		e, err := readEntry(txn, key)
+
+		if err != nil {
+			return err
+		}
+
+		if e == nil {
+			return errKeyDoesNotExist
+		}
+
+		if !matchesRevisions(e, matches) {
+			return errRevisionMismatch
+		}
+
+		return kd.trashEntry(txn, key, e, actor)
+	})
+}
+
+// trashEntry moves the entry of the key to the trash after its earlier deletions, recording the deletion of the key
+func (kd *keyData) trashEntry(txn storage.Txn, key string, e *entry, actor string) error {
+	revision, err := kd.recordEvent(txn, EventDelete, key, 0)
+
+	if err != nil {
+		return err
+	}
+
+	trashed, err := readTrashed(txn, key)
+
+	if err != nil {
+		return err
+	}
+
+	if err = writeTrashed(txn, key, append(trashed, trashedEntry{DeletedAt: time.Now().UTC(), DeletedBy: actor, Entry: *e, Revision: revision})); err != nil {
+		return err
+	}
+
+	return deleteEntry(txn, key, e)
+}
+
+// destroy permanently removes the key and every one of its versions, whether the key is in use, in the trash or both, along with
+// every deletion of it in the trash
+func (kd *keyData) destroy(key string) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error {
+		e, err := readEntry(txn, key)
+
+		if err != nil {
+			return err
+		}
+
+		trashed, err := readTrashed(txn, key)
+
+		if err != nil {
+			return err
+		}
+
+		if e == nil && len(trashed) == 0 {
+			return errKeyDoesNotExist
+		}
+
+		if e != nil {
+			if err = deleteEntry(txn, key, e); err != nil {
+				return err
+			}
+
+			if _, err = kd.recordEvent(txn, EventDelete, key, 0); err != nil {
+				return err
+			}
+		}
+
+		return writeTrashed(txn, key, nil)
+	})
+}
+
+// purgeTrash removes every deletion of a key which has outlived the trash retention, returning how many were removed
+func (kd *keyData) purgeTrash() (int, error) {
+	_, store, err := kd.state()
+
+	if err != nil || kd.trashRetention <= 0 {
+		return 0, err
+	}
+
+	now, purged := time.Now(), 0
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		storageKeys, err := txn.List(trashPrefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, storageKey := range storageKeys {
+			key := strings.TrimPrefix(storageKey, trashPrefix)
+
+			trashed, err := readTrashed(txn, key)
+
+			if err != nil {
+				return err
+			}
+
+			kept := trashed[:0]
+
+			for _, te := range trashed {
+				if !kd.purged(&te, now) {
+					kept = append(kept, te)
+				}
+			}
+
+			if len(kept) == len(trashed) {
+				continue
+			}
+
+			purged += len(trashed) - len(kept)
+
+			if err = writeTrashed(txn, key, kept); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// restore moves the deletion of the key made at the revision, or its latest deletion when the revision is zero, out of the trash with its
+// history intact, returning the number of its current version and the revision it is restored at, which its current version takes on;
+// a key which has been recreated since it was deleted has to be deleted or destroyed before one in the trash can be restored
+func (kd *keyData) restore(key string, revision int64) (int, int64, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var number int
+	var restored int64
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		trashed, err := readTrashed(txn, key)
+
+		if err != nil {
+			return err
+		}
+
+		index := len(trashed) - 1
+
+		for revision != 0 && index >= 0 && trashed[index].Revision != revision {
+			index--
+		}
+
+		if index < 0 || kd.purged(&trashed[index], time.Now()) {
+			return errKeyNotInTrash
+		}
+
+		te := trashed[index]
+
+		_, exists, err := txn.Get(keyPrefix + key)
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return errKeyAlreadyExists
+		}
+
+		number = te.Entry.current().Number
+
+		if restored, err = kd.recordEvent(txn, EventCreate, key, number); err != nil {
+			return err
+		}
+
+		te.Entry.Versions[len(te.Entry.Versions)-1].Revision = restored
+
+		if err = writeEntry(txn, key, &te.Entry); err != nil {
+			return err
+		}
+
+		return writeTrashed(txn, key, append(trashed[:index], trashed[index+1:]...))
+	})
+
+	return number, restored, err
+}
+
+// trash lists every deletion of a key in the trash, purging the ones which have outlived the trash retention first
+func (kd *keyData) trash() ([]TrashInfo, error) {
+	if _, err := kd.purgeTrash(); err != nil {
+		return nil, err
+	}
+
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storageKeys, err := store.List(trashPrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	trashed := make([]TrashInfo, 0, len(storageKeys))
+
+	for _, storageKey := range storageKeys {
+		key := strings.TrimPrefix(storageKey, trashPrefix)
+
+		deletions, err := readTrashed(store, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for index := range deletions {
+			te := &deletions[index]
+
+			trashed = append(trashed, TrashInfo{
+				DeletedAt: te.DeletedAt,
+				DeletedBy: te.DeletedBy,
+				Key:       key,
+				PurgeAt:   kd.purgeAt(te),
+				Revision:  te.Revision,
+				Version:   te.Entry.current().Number,
+			})
+		}
+	}
+
+	return trashed, nil
+}
+
+// parseRestoreRevision reads the revision of the deletion to restore from the "revision" query parameter, zero is returned when it is not
+// provided, the latest deletion then being restored
+func parseRestoreRevision(c *gin.Context) (int64, bool) {
+	query := c.Query("revision")
+
+	if query == "" {
+		return 0, true
+	}
+
+	revision, err := strconv.ParseInt(query, 10, 64)
+
+	return revision, err == nil && revision > 0
+}
+
+// HandleDestroyKey handles the POST request for permanently removing a key and every one of its versions, including from the trash
+func (s *Server) HandleDestroyKey(c *gin.Context) {
+	err := s.keys.destroy(keyParam(c))
+
+	switch err {
+	case nil:
+	case errKeyDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, ""})
+}
+
+// HandleGetTrash handles the GET request for the deleted keys in the trash
+func (s *Server) HandleGetTrash(c *gin.Context) {
+	trashed, err := s.keys.trash()
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, trashed})
+}
+
+// HandleRestoreKey handles the POST request for restoring a deleted key from the trash, the "revision" query parameter selects which
+// deletion of the key is restored when it has been deleted more than once and is otherwise its latest deletion
+func (s *Server) HandleRestoreKey(c *gin.Context) {
+	revision, valid := parseRestoreRevision(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidRevision})
+
+		return
+	}
+
+	number, restored, err := s.keys.restore(keyParam(c), revision)
+
+	switch err {
+	case nil:
+	case errKeyAlreadyExists:
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyAlreadyExists})
+
+		return
+	case errKeyNotInTrash:
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyNotInTrash})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.Writer.Header().Set("ETag", etag(restored))
+	c.JSON(200, Response{false, gin.H{"revision": restored, "version": number}})
+}
@@ -0,0 +1,210 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// Need to test the following:
+// If a key is deleted then it can no longer be read, and it is listed in the trash along with who deleted it
+// If a key is restored then it can be read again with every one of its versions, and it is no longer in the trash
+// If a key is deleted, recreated and deleted again then both deletions are in the trash, and either can be restored by its revision
+//     at a new revision which is the revision of the restored key
+// If a key which is not in the trash, or which has been recreated since it was deleted, is restored then a HTTP/400 status is returned
+// If a key is destroyed then it is removed both from the keys and from the trash, and cannot be restored
+// If a deleted key has outlived the trash retention then it is purged and cannot be restored
+// If the key encryption key is rotated then the values in the trash are rewrapped too
+func TestTrash(t *testing.T) {
+	newHandler := func(retention time.Duration) (*Server, func(method, path string, body interface{}) (int, []byte)) {
+		server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey, TrashRetention: retention}, nil)
+
+		if err != nil {
+			t.Fatal("could not create the server:", err)
+		}
+
+		handler, bearer := server.Handler(), testToken(t, server, "tester")
+
+		return server, func(method, path string, body interface{}) (int, []byte) {
+			var requestBody bytes.Buffer
+
+			if body != nil {
+				json.NewEncoder(&requestBody).Encode(body)
+			}
+
+			mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+			if err != nil {
+				t.Fatal("could not create the mock request")
+			}
+
+			mockRequest.Header.Set("Authorization", "Bearer "+bearer)
+
+			mockResponseWriter := httptest.NewRecorder()
+
+			handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+			return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+		}
+	}
+
+	server, serve := newHandler(time.Hour)
+
+	server.keys.set("TestTrash", "first", writeOptions{})
+	server.keys.set("TestTrash", "second", writeOptions{})
+	server.keys.set("TestTrashDestroy", "success", writeOptions{})
+
+	if code, _ := serve("DELETE", "/key/TestTrash", nil); code != 200 {
+		t.Fatalf("DELETE /key/TestTrash = HTTP/%d, expected HTTP/200", code)
+	}
+
+	if _, exists, _ := server.keys.get("TestTrash"); exists {
+		t.Error(`expected keys["TestTrash"] to no longer exist once it is deleted`)
+	}
+
+	if _, err := server.keys.rotateKEK(); err != nil {
+		t.Fatal("could not rotate the key encryption key:", err)
+	}
+
+	if trashed, _ := readTrashed(server.keys.storage, "TestTrash"); len(trashed) != 1 || trashed[0].Entry.current().Value.KEKVersion != 2 {
+		t.Error(`expected the trashed versions of "TestTrash" to be rewrapped with KEK version 2`)
+	}
+
+	code, body := serve("GET", "/trash", nil)
+
+	var trashResponse struct {
+		Message []TrashInfo `json:"msg"`
+	}
+
+	json.Unmarshal(body, &trashResponse)
+
+	if code != 200 || len(trashResponse.Message) != 1 || trashResponse.Message[0].Key != "TestTrash" || trashResponse.Message[0].DeletedBy != "tester" || trashResponse.Message[0].PurgeAt == nil {
+		t.Errorf("GET /trash = HTTP/%d %s, expected HTTP/200 listing TestTrash deleted by tester", code, body)
+	}
+
+	server.keys.set("TestTrash", "recreated", writeOptions{})
+
+	if code, _ := serve("POST", "/restore/TestTrash", nil); code != 400 {
+		t.Errorf("POST /restore/TestTrash while the key has been recreated = HTTP/%d, expected HTTP/400", code)
+	}
+
+	serve("POST", "/destroy/TestTrash", nil)
+
+	server.keys.set("TestTrash", "first", writeOptions{})
+	server.keys.set("TestTrash", "second", writeOptions{})
+
+	serve("DELETE", "/key/TestTrash", nil)
+
+	if code, body := serve("POST", "/restore/TestTrash", nil); code != 200 {
+		t.Fatalf("POST /restore/TestTrash = HTTP/%d %s, expected HTTP/200", code, body)
+	}
+
+	for number, expectedValue := range map[int]string{0: "second", 1: "first"} {
+		if value, _, _, err := server.keys.read("TestTrash", number); value != expectedValue || err != nil {
+			t.Errorf(`keys["TestTrash"] at version %d after restoring it = "%s", %v; expected "%s", nil`, number, value, err, expectedValue)
+		}
+	}
+
+	serve("POST", "/destroy/TestTrash", nil)
+
+	server.keys.set("TestTrash", "first deletion", writeOptions{})
+
+	serve("DELETE", "/key/TestTrash", nil)
+
+	server.keys.set("TestTrash", "second deletion", writeOptions{})
+
+	serve("DELETE", "/key/TestTrash", nil)
+
+	_, body = serve("GET", "/trash", nil)
+
+	json.Unmarshal(body, &trashResponse)
+
+	if len(trashResponse.Message) != 2 || trashResponse.Message[0].Revision >= trashResponse.Message[1].Revision {
+		t.Fatalf("GET /trash after deleting TestTrash twice = %s, expected both deletions", body)
+	}
+
+	if code, _ := serve("POST", "/restore/TestTrash?revision=first", nil); code != 400 {
+		t.Errorf("POST /restore/TestTrash with an invalid revision = HTTP/%d, expected HTTP/400", code)
+	}
+
+	var restoreResponse struct {
+		Message struct {
+			Revision int64 `json:"revision"`
+		} `json:"msg"`
+	}
+
+	_, body = serve("POST", fmt.Sprintf("/restore/TestTrash?revision=%d", trashResponse.Message[0].Revision), nil)
+
+	json.Unmarshal(body, &restoreResponse)
+
+	value, _, e, _ := server.keys.read("TestTrash", 0)
+
+	if value != "first deletion" || e == nil || e.revision() != restoreResponse.Message.Revision || e.revision() <= trashResponse.Message[1].Revision {
+		t.Errorf(`keys["TestTrash"] after restoring its first deletion = "%s" %s, expected "first deletion" at the new revision it was restored at`, value, body)
+	}
+
+	if trashed, _ := readTrashed(server.keys.storage, "TestTrash"); len(trashed) != 1 || trashed[0].Revision != trashResponse.Message[1].Revision {
+		t.Errorf("the trash after restoring the first deletion of TestTrash holds %d deletions, expected only the second", len(trashed))
+	}
+
+	serve("POST", "/destroy/TestTrash", nil)
+
+	tests := []struct {
+		ExpectedStatusCode int
+		Method, Path       string
+	}{
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Path:               "/restore/TestTrash",
+		},
+		{
+			ExpectedStatusCode: 200,
+			Method:             "DELETE",
+			Path:               "/key/TestTrashDestroy",
+		},
+		{
+			ExpectedStatusCode: 200,
+			Method:             "POST",
+			Path:               "/destroy/TestTrashDestroy",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Path:               "/restore/TestTrashDestroy",
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Path:               "/destroy/TestTrashDestroy",
+		},
+	}
+
+	for _, test := range tests {
+		if code, body := serve(test.Method, test.Path, nil); code != test.ExpectedStatusCode {
+			t.Errorf("%s %s = HTTP/%d %s, expected HTTP/%d", test.Method, test.Path, code, body, test.ExpectedStatusCode)
+		}
+	}
+
+	server, serve = newHandler(time.Nanosecond)
+
+	server.keys.set("TestTrash", "success", writeOptions{})
+
+	serve("DELETE", "/key/TestTrash", nil)
+
+	time.Sleep(time.Millisecond)
+
+	if code, _ := serve("POST", "/restore/TestTrash", nil); code != 400 {
+		t.Errorf("POST /restore/TestTrash after the trash retention = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if purged, err := server.keys.purgeTrash(); purged != 1 || err != nil {
+		t.Errorf("keys.purgeTrash() after the trash retention = %d, %v; expected 1, nil", purged, err)
+	}
+}
@@ -0,0 +1,253 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// The operations a transaction can be made of, "check" only tests its precondition
+const (
+	OperationCheck  = "check"
+	OperationCreate = "create"
+	OperationDelete = "delete"
+	OperationUpdate = "update"
+)
+
+// MaxTxnOperations is the most operations a single transaction can be made of
+const MaxTxnOperations = 100
+
+// Precondition is what has to hold for a key before an operation of a transaction is applied to it, "exists" tests whether the key exists,
+// "revision" whether the key is at the given revision and "version" whether its current version is the given one
+type Precondition struct {
+	Exists   *bool `json:"exists,omitempty"`
+	Revision int64 `json:"revision,omitempty"`
+	Version  int   `json:"version,omitempty"`
+}
+
+// TxnOperation is a single operation of a transaction, the value, expiry, number of versions to retain and metadata are only used when
+// creating or updating the key
+type TxnOperation struct {
+	MetadataUpdate
+	TypedValue
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"`
+	If          *Precondition `json:"if,omitempty"`
+	Key         string        `json:"key"`
+	MaxVersions int           `json:"maxVersions,omitempty"`
+	Operation   string        `json:"op"`
+	TTL         string        `json:"ttl,omitempty"`
+	Value       string        `json:"value,omitempty"`
+	expiresAt   *time.Time
+	value       string
+	valueType   string
+}
+
+// RequestTxn is the struct representing the format that requests for a transaction will use, the operations are applied in order
+type RequestTxn struct {
+	Operations []TxnOperation `json:"operations"`
+}
+
+// TxnResult is the outcome of an operation of a transaction which has been applied, the revision and version are the ones written by a create or update
+type TxnResult struct {
+	Key       string `json:"key"`
+	Operation string `json:"op"`
+	Revision  int64  `json:"revision,omitempty"`
+	Version   int    `json:"version,omitempty"`
+}
+
+// TxnResponse is the response to a transaction, when the transaction fails "operation" is the index of the operation which failed
+type TxnResponse struct {
+	Error     bool        `json:"error"`
+	Message   interface{} `json:"msg"`
+	Operation *int        `json:"operation,omitempty"`
+}
+
+// txnError is why an operation of a transaction failed, along with the status the transaction fails with
+type txnError struct {
+	index   int
+	message string
+	status  int
+}
+
+func (te *txnError) Error() string {
+	return fmt.Sprintf("operation %d failed: %s", te.index, te.message)
+}
+
+// validateOperations checks every operation of the transaction before any of them is applied, parsing the expiry and value of the writes
+func validateOperations(operations []TxnOperation, now time.Time) *txnError {
+	for index := range operations {
+		operation := &operations[index]
+
+		switch operation.Operation {
+		case OperationCheck, OperationDelete:
+		case OperationCreate, OperationUpdate:
+			if operation.MaxVersions < 0 {
+				return &txnError{index, ErrorInvalidMaxVersions, 400}
+			}
+
+			if !operation.MetadataUpdate.valid() {
+				return &txnError{index, ErrorInvalidMetadata, 400}
+			}
+
+			value, valueType, valid := operation.TypedValue.resolve(operation.Value)
+
+			if !valid {
+				return &txnError{index, ErrorInvalidValue, 400}
+			}
+
+			operation.value, operation.valueType = value, valueType
+
+			expiresAt, valid := parseExpiry(operation.TTL, operation.ExpiresAt, now)
+
+			if !valid {
+				return &txnError{index, ErrorInvalidExpiry, 400}
+			}
+
+			operation.expiresAt = expiresAt
+		default:
+			return &txnError{index, ErrorInvalidOperation, 400}
+		}
+
+		if operation.Operation == OperationCreate && !ValidKey(operation.Key) {
+			return &txnError{index, ErrorInvalidKey, 400}
+		}
+	}
+
+	return nil
+}
+
+// holds reports whether the precondition holds for the entry of a key, nil meaning that the key does not exist
+func (p *Precondition) holds(e *entry) bool {
+	if p.Exists != nil && *p.Exists != (e != nil) {
+		return false
+	}
+
+	if p.Revision != 0 && (e == nil || e.revision() != p.Revision) {
+		return false
+	}
+
+	return p.Version == 0 || (e != nil && e.current().Number == p.Version)
+}
+
+// transact applies every operation in order within a single storage transaction, so either all of them are persisted in one write
+// or, as soon as one fails, none of them are; keys which have expired but have not been reaped yet are treated as missing
+func (kd *keyData) transact(operations []TxnOperation, actor string) ([]TxnResult, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if err := validateOperations(operations, now); err != nil {
+		return nil, err
+	}
+
+	results := make([]TxnResult, 0, len(operations))
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		for index, operation := range operations {
+			e, err := readEntry(txn, operation.Key)
+
+			if err != nil {
+				return err
+			}
+
+			expired := e != nil && e.expired(now)
+
+			if expired {
+				e = nil
+			}
+
+			if operation.If != nil && !operation.If.holds(e) {
+				return &txnError{index, ErrorPreconditionFailed, 409}
+			}
+
+			result := TxnResult{Key: operation.Key, Operation: operation.Operation}
+
+			switch {
+			case operation.Operation == OperationCreate && e != nil:
+				return &txnError{index, ErrorKeyAlreadyExists, 400}
+			case operation.Operation == OperationUpdate && expired:
+				return &txnError{index, ErrorKeyExpired, 410}
+			case (operation.Operation == OperationUpdate || operation.Operation == OperationDelete) && e == nil:
+				return &txnError{index, ErrorKeyDoesNotExist, 400}
+			case operation.Operation == OperationCreate || operation.Operation == OperationUpdate:
+				options := writeOptions{
+					actor:       actor,
+					contentType: operation.ContentType,
+					expiresAt:   operation.expiresAt,
+					maxVersions: operation.MaxVersions,
+					metadata:    operation.MetadataUpdate,
+					schema:      operation.Schema,
+					valueType:   operation.valueType,
+				}
+
+				v, err := kd.writeValue(txn, kr, operation.Key, operation.value, options)
+
+				if failure, failed := err.(*schemaError); failed {
+					return &txnError{index, failure.Error(), 400}
+				}
+
+				if err != nil {
+					return err
+				}
+
+				result.Revision, result.Version = v.Revision, v.Number
+			case operation.Operation == OperationDelete:
+				if err = kd.trashEntry(txn, operation.Key, e, actor); err != nil {
+					return err
+				}
+			}
+
+			results = append(results, result)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// HandleTxn handles the POST request for a transaction, a list of operations which are applied all together or not at all
+func (s *Server) HandleTxn(c *gin.Context) {
+	var TxnRequest RequestTxn
+
+	err := json.NewDecoder(c.Request.Body).Decode(&TxnRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	if len(TxnRequest.Operations) == 0 || len(TxnRequest.Operations) > MaxTxnOperations {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidTxnLength})
+
+		return
+	}
+
+	results, err := s.keys.transact(TxnRequest.Operations, actor(c))
+
+	if failure, failed := err.(*txnError); failed {
+		c.AbortWithStatusJSON(failure.status, TxnResponse{Error: true, Message: failure.message, Operation: &failure.index})
+
+		return
+	}
+
+	if err != nil {
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, TxnResponse{Error: false, Message: results})
+}
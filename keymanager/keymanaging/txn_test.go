@@ -0,0 +1,160 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Need to test the following:
+// If every operation succeeds then all of them are applied and the version written by each create and update is returned
+// If a precondition does not hold then a HTTP/409 status is returned with the index of the operation, and none of the operations are applied
+// If an operation fails, such as creating a key which exists or updating one which does not, then a HTTP/400 status is returned
+//     with the index of the operation, and none of the operations are applied, including the ones before it
+// If an operation is not create, update, delete or check, or there are no operations, then a HTTP/400 status is returned
+// If a key is deleted in a transaction then it is moved to the trash
+func TestHandleTxn(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	serve := func(operations ...TxnOperation) (int, TxnResponse) {
+		requestBytes, _ := json.Marshal(RequestTxn{Operations: operations})
+
+		mockRequest, err := http.NewRequest("POST", "/txn", bytes.NewReader(requestBytes))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		var response TxnResponse
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+		return mockResponseWriter.Code, response
+	}
+
+	exists, missing := true, false
+
+	code, response := serve(
+		TxnOperation{Operation: OperationCreate, Key: "TestHandleTxn/username", Value: "admin"},
+		TxnOperation{Operation: OperationCreate, Key: "TestHandleTxn/password", Value: "first"},
+		TxnOperation{Operation: OperationUpdate, Key: "TestHandleTxn/password", Value: "second"},
+	)
+
+	var results []TxnResult
+
+	resultBytes, _ := json.Marshal(response.Message)
+
+	json.Unmarshal(resultBytes, &results)
+
+	if code != 200 || len(results) != 3 || results[0].Version != 1 || results[1].Version != 1 || results[2].Version != 2 {
+		t.Fatalf("POST /txn creating the pair = HTTP/%d %v, expected HTTP/200 with versions 1, 1 and 2", code, response.Message)
+	}
+
+	tests := []struct {
+		ExpectedOperation  *int
+		ExpectedStatusCode int
+		ExpectedValues     map[string]string
+		Operations         []TxnOperation
+	}{
+		{
+			ExpectedStatusCode: 200,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root", "TestHandleTxn/password": "third"},
+			Operations: []TxnOperation{
+				{Operation: OperationUpdate, Key: "TestHandleTxn/username", Value: "root", If: &Precondition{Version: 1}},
+				{Operation: OperationUpdate, Key: "TestHandleTxn/password", Value: "third", If: &Precondition{Version: 2}},
+			},
+		},
+		{
+			ExpectedOperation:  intPointer(0),
+			ExpectedStatusCode: 409,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root", "TestHandleTxn/password": "third"},
+			Operations: []TxnOperation{
+				{Operation: OperationUpdate, Key: "TestHandleTxn/username", Value: "stale", If: &Precondition{Version: 1}},
+				{Operation: OperationUpdate, Key: "TestHandleTxn/password", Value: "stale"},
+			},
+		},
+		{
+			ExpectedOperation:  intPointer(2),
+			ExpectedStatusCode: 409,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root", "TestHandleTxn/password": "third"},
+			Operations: []TxnOperation{
+				{Operation: OperationUpdate, Key: "TestHandleTxn/username", Value: "halfway"},
+				{Operation: OperationCheck, Key: "TestHandleTxn/username", If: &Precondition{Exists: &exists}},
+				{Operation: OperationCheck, Key: "TestHandleTxn/missing", If: &Precondition{Exists: &exists}},
+			},
+		},
+		{
+			ExpectedOperation:  intPointer(1),
+			ExpectedStatusCode: 400,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root", "TestHandleTxn/password": "third"},
+			Operations: []TxnOperation{
+				{Operation: OperationUpdate, Key: "TestHandleTxn/username", Value: "halfway"},
+				{Operation: OperationCreate, Key: "TestHandleTxn/password", Value: "halfway"},
+			},
+		},
+		{
+			ExpectedOperation:  intPointer(1),
+			ExpectedStatusCode: 400,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root"},
+			Operations: []TxnOperation{
+				{Operation: OperationUpdate, Key: "TestHandleTxn/username", Value: "halfway"},
+				{Operation: OperationUpdate, Key: "TestHandleTxn/missing", Value: "halfway"},
+			},
+		},
+		{
+			ExpectedOperation:  intPointer(1),
+			ExpectedStatusCode: 400,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root"},
+			Operations: []TxnOperation{
+				{Operation: OperationCheck, Key: "TestHandleTxn/username"},
+				{Operation: "rename", Key: "TestHandleTxn/username"},
+			},
+		},
+		{
+			ExpectedStatusCode: 400,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "root"},
+			Operations:         []TxnOperation{},
+		},
+		{
+			ExpectedStatusCode: 200,
+			ExpectedValues:     map[string]string{"TestHandleTxn/username": "", "TestHandleTxn/password": "", "TestHandleTxn/token": "new"},
+			Operations: []TxnOperation{
+				{Operation: OperationDelete, Key: "TestHandleTxn/username"},
+				{Operation: OperationDelete, Key: "TestHandleTxn/password"},
+				{Operation: OperationCreate, Key: "TestHandleTxn/token", Value: "new", If: &Precondition{Exists: &missing}},
+			},
+		},
+	}
+
+	for index, test := range tests {
+		code, response := serve(test.Operations...)
+
+		if code != test.ExpectedStatusCode || (test.ExpectedOperation == nil) != (response.Operation == nil) || (test.ExpectedOperation != nil && *test.ExpectedOperation != *response.Operation) {
+			t.Errorf("POST /txn for test %d = HTTP/%d %v failing operation %v, expected HTTP/%d failing operation %v", index, code, response.Message, response.Operation, test.ExpectedStatusCode, test.ExpectedOperation)
+		}
+
+		for key, expectedValue := range test.ExpectedValues {
+			if value, _, _ := server.keys.get(key); value != expectedValue {
+				t.Errorf(`keys["%s"] after test %d = "%s", expected "%s"`, key, index, value, expectedValue)
+			}
+		}
+	}
+
+	if trashed, _ := server.keys.trash(); len(trashed) != 2 {
+		t.Errorf("expected the keys deleted in the transaction to be in the trash, found %v", trashed)
+	}
+}
+
+func intPointer(i int) *int {
+	return &i
+}
@@ -0,0 +1,217 @@
+package keymanaging
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// The types of value a key can hold, values written before types existed are strings
+const (
+	ValueTypeBinary = "binary"
+	ValueTypeJSON   = "json"
+	ValueTypeString = "string"
+)
+
+// MIMEOctetStream is the media type to accept for the value of a key to be returned as is rather than within a JSON response
+const MIMEOctetStream = "application/octet-stream"
+
+// TypedValue is how a value other than a string is written, "json" holding any JSON value and "binary" the base64 encoding of the bytes
+// with the media type of the bytes as "contentType"; a "schema" makes the key only hold JSON values matching the JSON Schema from then
+// on, and a schema of null removes it
+type TypedValue struct {
+	Binary      []byte          `json:"binary,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	JSON        json.RawMessage `json:"json,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+}
+
+// errRemoteSchemaReference is returned when a JSON Schema refers to a schema outside of itself, which is never loaded so that writing a
+// schema cannot make the keymanager fetch a URL or read a file
+var errRemoteSchemaReference = errors.New("a JSON Schema can only refer to itself")
+
+// localSchemaLoader loads a JSON Schema whose references are only resolved within it, any other schema it refers to being refused
+type localSchemaLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (localSchemaLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return refusedSchemaLoaderFactory{}
+}
+
+// refusedSchemaLoaderFactory creates the loaders for the schemas a JSON Schema refers to outside of itself, which refuse to load them
+type refusedSchemaLoaderFactory struct{}
+
+func (refusedSchemaLoaderFactory) New(source string) gojsonschema.JSONLoader {
+	return refusedSchemaLoader{gojsonschema.NewReferenceLoader(source)}
+}
+
+// refusedSchemaLoader refuses to load the schema it refers to
+type refusedSchemaLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (refusedSchemaLoader) LoadJSON() (interface{}, error) {
+	return nil, errRemoteSchemaReference
+}
+
+// schemaCache holds the JSON Schemas of the keys compiled, keyed by the schema, so that they are not compiled again for every write
+type schemaCache struct {
+	compiled map[string]*gojsonschema.Schema
+	mutex    sync.Mutex
+}
+
+var schemas = &schemaCache{compiled: make(map[string]*gojsonschema.Schema)}
+
+// compile returns the compiled JSON Schema, compiling it the first time it is seen; a schema referring to a schema outside of itself
+// fails to compile
+func (sc *schemaCache) compile(schema json.RawMessage) (*gojsonschema.Schema, error) {
+	sc.mutex.Lock()
+
+	defer sc.mutex.Unlock()
+
+	if compiled, cached := sc.compiled[string(schema)]; cached {
+		return compiled, nil
+	}
+
+	compiled, err := gojsonschema.NewSchemaLoader().Compile(localSchemaLoader{gojsonschema.NewBytesLoader(schema)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sc.compiled[string(schema)] = compiled
+
+	return compiled, nil
+}
+
+// schemaError is why a value does not match the JSON Schema of its key, with every problem found
+type schemaError struct {
+	problems []string
+}
+
+func (se *schemaError) Error() string {
+	return ErrorSchemaViolation + ": " + strings.Join(se.problems, "; ")
+}
+
+// resolve picks the value which is written out of the string value and the typed ones, along with its type; false is returned when more
+// than one of them is provided, when a content type is provided for anything but a binary value, or when the schema is not valid or
+// refers to a schema outside of itself
+func (tv TypedValue) resolve(value string) (string, string, bool) {
+	if tv.Schema != nil && !removesSchema(tv.Schema) {
+		if _, err := schemas.compile(tv.Schema); err != nil {
+			return "", "", false
+		}
+	}
+
+	switch {
+	case tv.JSON != nil && (tv.Binary != nil || value != "" || tv.ContentType != ""):
+		return "", "", false
+	case tv.JSON != nil:
+		return string(tv.JSON), ValueTypeJSON, true
+	case tv.Binary != nil && value != "":
+		return "", "", false
+	case tv.Binary != nil:
+		return string(tv.Binary), ValueTypeBinary, true
+	case tv.ContentType != "":
+		return "", "", false
+	}
+
+	return value, ValueTypeString, true
+}
+
+func removesSchema(schema json.RawMessage) bool {
+	return string(schema) == "null"
+}
+
+// validate checks the value against the JSON Schema of the key, a key with a schema only holding JSON values
+func validate(schema json.RawMessage, value, valueType string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if valueType != ValueTypeJSON {
+		return &schemaError{[]string{"the key only holds JSON values"}}
+	}
+
+	compiled, err := schemas.compile(schema)
+
+	if err != nil {
+		return &schemaError{[]string{err.Error()}}
+	}
+
+	result, err := compiled.Validate(gojsonschema.NewStringLoader(value))
+
+	if err != nil {
+		return &schemaError{[]string{err.Error()}}
+	}
+
+	if result.Valid() {
+		return nil
+	}
+
+	problems := make([]string, 0, len(result.Errors()))
+
+	for _, problem := range result.Errors() {
+		problems = append(problems, problem.String())
+	}
+
+	return &schemaError{problems}
+}
+
+// valueType is the type of the value of the version
+func (v version) valueType() string {
+	if v.Type == "" {
+		return ValueTypeString
+	}
+
+	return v.Type
+}
+
+// contentType is the media type the value of the version is returned as when it is returned as is
+func (v version) contentType() string {
+	switch v.valueType() {
+	case ValueTypeBinary:
+		if v.ContentType != "" {
+			return v.ContentType
+		}
+
+		return MIMEOctetStream
+	case ValueTypeJSON:
+		return gin.MIMEJSON
+	}
+
+	return "text/plain; charset=utf-8"
+}
+
+// native is the value of the version as it is returned within a JSON response, JSON values being embedded as they are and binary values
+// being encoded as base64
+func (v version) native(value string) interface{} {
+	switch v.valueType() {
+	case ValueTypeBinary:
+		return []byte(value)
+	case ValueTypeJSON:
+		return json.RawMessage(value)
+	}
+
+	return value
+}
+
+// text is the value of the version where it has to be a string, binary values being encoded as base64
+func (v version) text(value string) string {
+	if v.valueType() == ValueTypeBinary {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	return value
+}
+
+// acceptsOctetStream reports whether the request prefers the value to be returned as is over a JSON response
+func acceptsOctetStream(c *gin.Context) bool {
+	return c.GetHeader("Accept") != "" && c.NegotiateFormat(gin.MIMEJSON, MIMEOctetStream) == MIMEOctetStream
+}
@@ -0,0 +1,225 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Need to test the following:
+// If a JSON value is written then it is returned as JSON rather than as a string
+// If a binary value is written then it is returned as base64 within JSON, or as is with its content type when application/octet-stream is accepted
+// If more than one of value, json and binary, or a content type without binary, or an invalid schema is provided then a HTTP/400 status is returned
+// If a key has a JSON Schema then only JSON values matching it can be written, a HTTP/400 status being returned otherwise, until the schema is removed
+// If a schema refers to a schema outside of itself then a HTTP/400 status is returned without the schema being loaded, and references within
+//     the schema are resolved
+// If a schema is checked more than once then it is only compiled once
+func TestTypedValues(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	serve := func(method, path, accept string, body interface{}) *httptest.ResponseRecorder {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		if accept != "" {
+			mockRequest.Header.Set("Accept", accept)
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter
+	}
+
+	certificate := []byte{0x30, 0x82, 0x00, 0xff}
+
+	writes := []RequestSingle{
+		{Key: "TestTypedValues/string", Value: "plain"},
+		{Key: "TestTypedValues/json", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":5432}`)}},
+		{Key: "TestTypedValues/binary", TypedValue: TypedValue{Binary: certificate, ContentType: "application/pkix-cert"}},
+	}
+
+	for _, write := range writes {
+		if code := serve("POST", "/key", "", write).Code; code != 201 {
+			t.Fatalf("POST /key for %s = HTTP/%d, expected HTTP/201", write.Key, code)
+		}
+	}
+
+	readTests := []struct {
+		Accept, ExpectedBody, ExpectedContentType, Path string
+	}{
+		{
+			ExpectedBody:        `"msg":"plain"`,
+			ExpectedContentType: "application/json; charset=utf-8",
+			Path:                "/key/TestTypedValues/string",
+		},
+		{
+			ExpectedBody:        `"msg":{"port":5432}`,
+			ExpectedContentType: "application/json; charset=utf-8",
+			Path:                "/key/TestTypedValues/json",
+		},
+		{
+			ExpectedBody:        `"msg":"MIIA/w=="`,
+			ExpectedContentType: "application/json; charset=utf-8",
+			Path:                "/key/TestTypedValues/binary",
+		},
+		{
+			Accept:              MIMEOctetStream,
+			ExpectedBody:        string(certificate),
+			ExpectedContentType: "application/pkix-cert",
+			Path:                "/key/TestTypedValues/binary",
+		},
+	}
+
+	for _, test := range readTests {
+		response := serve("GET", test.Path, test.Accept, nil)
+
+		if response.Code != 200 || !bytes.Contains(response.Body.Bytes(), []byte(test.ExpectedBody)) || response.Header().Get("Content-Type") != test.ExpectedContentType {
+			t.Errorf(
+				"GET %s accepting %q = HTTP/%d %s %q, expected HTTP/200 %s containing %q",
+				test.Path,
+				test.Accept,
+				response.Code,
+				response.Header().Get("Content-Type"),
+				response.Body.String(),
+				test.ExpectedContentType,
+				test.ExpectedBody,
+			)
+		}
+	}
+
+	if value, _, _ := server.keys.get("TestTypedValues/binary"); value != "MIIA/w==" {
+		t.Errorf(`keys["TestTypedValues/binary"] = "%s", expected the base64 encoding "MIIA/w=="`, value)
+	}
+
+	schema := json.RawMessage(`{"type":"object","required":["port"],"properties":{"port":{"type":"integer"}}}`)
+
+	remoteRequests := 0
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteRequests++
+
+		w.Write([]byte(`{"type":"integer"}`))
+	}))
+
+	defer remoteServer.Close()
+
+	remoteSchema := json.RawMessage(`{"properties":{"port":{"$ref":"` + remoteServer.URL + `/port.json"}}}`)
+	localSchema := json.RawMessage(`{"definitions":{"port":{"type":"integer"}},"properties":{"port":{"$ref":"#/definitions/port"}}}`)
+
+	writeTests := []struct {
+		ExpectedStatusCode int
+		Method             string
+		Request            RequestSingle
+	}{
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", Value: "plain", TypedValue: TypedValue{JSON: json.RawMessage(`{}`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", TypedValue: TypedValue{Binary: certificate, JSON: json.RawMessage(`{}`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", Value: "plain", TypedValue: TypedValue{ContentType: "text/plain"}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", TypedValue: TypedValue{JSON: json.RawMessage(`{}`), Schema: json.RawMessage(`{"type":1}`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "PUT",
+			Request:            RequestSingle{Key: "TestTypedValues/json", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":"5432"}`), Schema: schema}},
+		},
+		{
+			ExpectedStatusCode: 200,
+			Method:             "PUT",
+			Request:            RequestSingle{Key: "TestTypedValues/json", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":6432}`), Schema: schema}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "PUT",
+			Request:            RequestSingle{Key: "TestTypedValues/json", TypedValue: TypedValue{JSON: json.RawMessage(`{"host":"db"}`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "PUT",
+			Request:            RequestSingle{Key: "TestTypedValues/json", Value: "plain"},
+		},
+		{
+			ExpectedStatusCode: 200,
+			Method:             "PUT",
+			Request:            RequestSingle{Key: "TestTypedValues/json", Value: "plain", TypedValue: TypedValue{Schema: json.RawMessage(`null`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":5432}`), Schema: remoteSchema}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/invalid", TypedValue: TypedValue{JSON: json.RawMessage(`{}`), Schema: json.RawMessage(`{"$ref":"file:///etc/passwd"}`)}},
+		},
+		{
+			ExpectedStatusCode: 400,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/local", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":"5432"}`), Schema: localSchema}},
+		},
+		{
+			ExpectedStatusCode: 201,
+			Method:             "POST",
+			Request:            RequestSingle{Key: "TestTypedValues/local", TypedValue: TypedValue{JSON: json.RawMessage(`{"port":5432}`), Schema: localSchema}},
+		},
+	}
+
+	for index, test := range writeTests {
+		path := "/key"
+
+		if test.Method == "PUT" {
+			path += "/" + test.Request.Key
+		}
+
+		response := serve(test.Method, path, "", test.Request)
+
+		if response.Code != test.ExpectedStatusCode {
+			t.Errorf("%s %s for test %d = HTTP/%d %s, expected HTTP/%d", test.Method, path, index, response.Code, response.Body.String(), test.ExpectedStatusCode)
+		}
+	}
+
+	if _, exists, _ := server.keys.get("TestTypedValues/invalid"); exists {
+		t.Error(`keys["TestTypedValues/invalid"] exists, expected every invalid write to be refused`)
+	}
+
+	if remoteRequests != 0 {
+		t.Errorf("the schema referred to was requested %d times, expected a schema outside of the schema of the key never to be loaded", remoteRequests)
+	}
+
+	compiled, err := schemas.compile(localSchema)
+
+	if recompiled, _ := schemas.compile(localSchema); err != nil || compiled != recompiled {
+		t.Errorf("compiling the same schema twice = %p, %p, %v, expected the schema compiled the first time to be returned again", compiled, recompiled, err)
+	}
+}
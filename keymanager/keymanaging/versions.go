@@ -0,0 +1,426 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errVersionDoesNotExist = errors.New("the version does not exist")
+
+// HeaderActor is the request header naming who made the request, it is recorded with every version written by the request
+const HeaderActor = "X-KeyMan-Actor"
+
+// version is a single value written to a key along with its type, stamped with the revision of the storage it was written at
+type version struct {
+	Actor       string      `json:"actor"`
+	ContentType string      `json:"contentType,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	Number      int         `json:"version"`
+	Revision    int64       `json:"revision,omitempty"`
+	Type        string      `json:"type,omitempty"`
+	Value       sealedValue `json:"value"`
+}
+
+// entry is everything stored for a key: its retained versions ordered from oldest to newest, the newest one being the current value,
+// the number of versions to retain for the key when it differs from the server default, when the key expires if it does, its metadata,
+// and the JSON Schema its values have to match if it has one
+type entry struct {
+	ExpiresAt   *time.Time      `json:"expiresAt,omitempty"`
+	MaxVersions int             `json:"maxVersions,omitempty"`
+	Metadata    Metadata        `json:"metadata"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Versions    []version       `json:"versions"`
+}
+
+// writeOptions are the details of a write which are not the value itself, the write only goes ahead when the key is at the revisions matched,
+// and when "mustExist" or "mustNotExist" is set only when the key does or does not exist, which is checked in the same transaction as the write
+type writeOptions struct {
+	actor        string
+	contentType  string
+	expiresAt    *time.Time
+	matches      []*revisionMatch
+	maxVersions  int
+	metadata     MetadataUpdate
+	mustExist    bool
+	mustNotExist bool
+	schema       json.RawMessage
+	valueType    string
+}
+
+// VersionInfo describes a version of a key without its value
+type VersionInfo struct {
+	Actor       string    `json:"actor"`
+	ContentType string    `json:"contentType,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Current     bool      `json:"current"`
+	Revision    int64     `json:"revision"`
+	Type        string    `json:"type"`
+	Version     int       `json:"version"`
+}
+
+// RequestRollback is the struct representing the format that requests to roll a key back will use to choose the version to promote,
+// the rollback only going ahead when the key is at the "cas" revision if it is provided
+type RequestRollback struct {
+	CAS     *int64 `json:"cas,omitempty"`
+	Version int    `json:"version"`
+}
+
+// ValueResponse is the response to a read of a single key, along with the value it carries its type, the version which was read, the current
+// revision of the key which is also its ETag, and, for keys which expire, when they expire and the time left until then
+type ValueResponse struct {
+	ContentType string      `json:"contentType,omitempty"`
+	Error       bool        `json:"error"`
+	ExpiresAt   *time.Time  `json:"expires_at,omitempty"`
+	Message     interface{} `json:"msg"`
+	Revision    int64       `json:"revision"`
+	TTL         string      `json:"ttl,omitempty"`
+	Type        string      `json:"type"`
+	Version     int         `json:"version"`
+}
+
+func (e *entry) current() version {
+	return e.Versions[len(e.Versions)-1]
+}
+
+// find returns the version with the number, zero being the current version
+func (e *entry) find(number int) (version, bool) {
+	if number == 0 {
+		return e.current(), true
+	}
+
+	for _, v := range e.Versions {
+		if v.Number == number {
+			return v, true
+		}
+	}
+
+	return version{}, false
+}
+
+// add appends a new version holding the sealed value and type of v and drops the oldest versions past the retention, zero retaining every
+// version; the metadata records the version as the last write of the key, and as its creation when it is the first version
+func (e *entry) add(v version, actor string, revision int64, maxVersions int) version {
+	number := 1
+
+	if len(e.Versions) != 0 {
+		number = e.current().Number + 1
+	}
+
+	v.Actor, v.CreatedAt, v.Number, v.Revision = actor, time.Now().UTC(), number, revision
+
+	if len(e.Versions) == 0 {
+		e.Metadata.CreatedAt, e.Metadata.CreatedBy = v.CreatedAt, actor
+	}
+
+	e.Metadata.UpdatedAt, e.Metadata.UpdatedBy = v.CreatedAt, actor
+
+	e.Versions = append(e.Versions, v)
+
+	if e.MaxVersions != 0 {
+		maxVersions = e.MaxVersions
+	}
+
+	if maxVersions > 0 && len(e.Versions) > maxVersions {
+		e.Versions = append([]version{}, e.Versions[len(e.Versions)-maxVersions:]...)
+	}
+
+	return v
+}
+
+// readEntry reads the entry of the key from the storage, nil is returned when the key does not exist; keys written before versioning
+// existed hold a single sealed value, which is read as version 1
+func readEntry(txn storage.Txn, key string) (*entry, error) {
+	data, exists, err := txn.Get(keyPrefix + key)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var e entry
+
+	if err = json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	if len(e.Versions) == 0 {
+		var sv sealedValue
+
+		if err = json.Unmarshal(data, &sv); err != nil || sv.Ciphertext == nil {
+			return nil, ErrUnsealValue
+		}
+
+		e.Versions = []version{{Number: 1, Value: sv}}
+	}
+
+	e.Metadata.backfill(e.Versions)
+
+	return &e, nil
+}
+
+// writeEntry puts the entry of the key into the storage, moving it in the expiry index when the time it expires at has changed
+func writeEntry(txn storage.Txn, key string, e *entry) error {
+	previous, err := readEntry(txn, key)
+
+	if err != nil {
+		return err
+	}
+
+	if previous != nil && previous.ExpiresAt != nil && (e.ExpiresAt == nil || !e.ExpiresAt.Equal(*previous.ExpiresAt)) {
+		if err = txn.Delete(expiryKey(*previous.ExpiresAt, key)); err != nil {
+			return err
+		}
+	}
+
+	if e.ExpiresAt != nil {
+		if err = txn.Put(expiryKey(*e.ExpiresAt, key), nil); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	return txn.Put(keyPrefix+key, data)
+}
+
+// deleteEntry removes the entry of the key, along with its place in the expiry index when it expires
+func deleteEntry(txn storage.Txn, key string, e *entry) error {
+	if e.ExpiresAt != nil {
+		if err := txn.Delete(expiryKey(*e.ExpiresAt, key)); err != nil {
+			return err
+		}
+	}
+
+	return txn.Delete(keyPrefix + key)
+}
+
+// actor names who made the request, which is the name of the token it was made with; requests served without authentication are from
+// whoever they claim to be from, or else their IP address
+func actor(c *gin.Context) string {
+	if t := requestToken(c); t != nil {
+		return t.Name
+	}
+
+	if actor := c.GetHeader(HeaderActor); actor != "" {
+		return actor
+	}
+
+	return c.ClientIP()
+}
+
+// read opens the version of the key with the number, zero being the current version, the entry of the key is returned along with it and
+// is nil when the key does not exist; errVersionDoesNotExist is returned when the key exists but the version does not, which is also
+// the case for versions dropped by the retention, and errKeyExpired when the key has outlived its expiry but has not been reaped yet
+func (kd *keyData) read(key string, number int) (string, version, *entry, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return "", version{}, nil, err
+	}
+
+	e, err := readEntry(store, key)
+
+	if err != nil || e == nil {
+		return "", version{}, nil, err
+	}
+
+	if e.expired(time.Now()) {
+		return "", version{}, e, errKeyExpired
+	}
+
+	v, found := e.find(number)
+
+	if !found {
+		return "", version{}, e, errVersionDoesNotExist
+	}
+
+	value, err := kr.open(key, v.Value)
+
+	if err != nil {
+		return "", version{}, e, err
+	}
+
+	return value, v, e, nil
+}
+
+// versions lists the retained versions of the key, oldest first
+func (kd *keyData) versions(key string) ([]VersionInfo, bool, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	e, err := readEntry(store, key)
+
+	if err != nil || e == nil {
+		return nil, false, err
+	}
+
+	versions := make([]VersionInfo, 0, len(e.Versions))
+
+	for _, v := range e.Versions {
+		versions = append(versions, VersionInfo{
+			Actor:       v.Actor,
+			ContentType: v.ContentType,
+			CreatedAt:   v.CreatedAt,
+			Current:     v.Number == e.current().Number,
+			Revision:    v.Revision,
+			Type:        v.valueType(),
+			Version:     v.Number,
+		})
+	}
+
+	return versions, true, nil
+}
+
+// rollback promotes an old version of the key to be the current one by writing its value again as a new version, so the history
+// is never rewritten; the new version is returned, and a *schemaError when the old value does not match the JSON Schema of the key
+func (kd *keyData) rollback(key string, number int, options writeOptions) (version, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return version{}, err
+	}
+
+	var newVersion version
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		e, err := readEntry(txn, key)
+
+		if err != nil {
+			return err
+		}
+
+		if e == nil {
+			return errKeyDoesNotExist
+		}
+
+		if !matchesRevisions(e, options.matches) {
+			return errRevisionMismatch
+		}
+
+		v, found := e.find(number)
+
+		if !found || number == 0 {
+			return errVersionDoesNotExist
+		}
+
+		if e.Schema != nil {
+			value, err := kr.open(key, v.Value)
+
+			if err != nil {
+				return err
+			}
+
+			if err = validate(e.Schema, value, v.valueType()); err != nil {
+				return err
+			}
+		}
+
+		revision, err := kd.recordEvent(txn, EventUpdate, key, e.current().Number+1)
+
+		if err != nil {
+			return err
+		}
+
+		newVersion = e.add(v, options.actor, revision, kd.maxVersions)
+
+		return writeEntry(txn, key, e)
+	})
+
+	return newVersion, err
+}
+
+// HandleGetKeyVersions handles the GET request for the history of a key, listing every retained version without its value
+func (s *Server) HandleGetKeyVersions(c *gin.Context) {
+	versions, exists, err := s.keys.versions(keyParam(c))
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+
+		return
+	}
+
+	c.JSON(200, Response{false, versions})
+}
+
+// HandleRollbackKey handles the POST request for promoting an old version of a key to be its current version, like an update it only goes
+// ahead when the key is at the revision of the If-Match header or of the "cas" field if either is provided
+func (s *Server) HandleRollbackKey(c *gin.Context) {
+	var RollbackRequest RequestRollback
+
+	err := json.NewDecoder(c.Request.Body).Decode(&RollbackRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	matches, valid := parseRevisionMatch(c, RollbackRequest.CAS)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidIfMatch})
+
+		return
+	}
+
+	v, err := s.keys.rollback(keyParam(c), RollbackRequest.Version, writeOptions{actor: actor(c), matches: matches})
+
+	if failure, failed := err.(*schemaError); failed {
+		c.AbortWithStatusJSON(400, Response{true, failure.Error()})
+
+		return
+	}
+
+	switch err {
+	case nil:
+	case errRevisionMismatch:
+		c.AbortWithStatusJSON(412, Response{true, ErrorRevisionMismatch})
+
+		return
+	case errKeyDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorKeyDoesNotExist})
+
+		return
+	case errVersionDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorVersionDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.Writer.Header().Set("ETag", etag(v.Revision))
+	c.JSON(200, Response{false, gin.H{"revision": v.Revision, "version": v.Number}})
+}
+
+// parseVersion reads the "version" query parameter, zero meaning the current version
+func parseVersion(c *gin.Context) (int, bool) {
+	query := c.Query("version")
+
+	if query == "" {
+		return 0, true
+	}
+
+	number, err := strconv.Atoi(query)
+
+	return number, err == nil && number > 0
+}
@@ -0,0 +1,145 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// Need to test the following:
+// Every write of a key creates a new version, numbered from 1, which records who made the write
+// If a version is requested then its value is returned along with its number, and the current version is returned otherwise
+// If the version requested is not a positive whole number, or does not exist, then a HTTP/400 status is returned
+// If the key is rolled back then the old value becomes the current value as a new version, and the history is kept
+// If a key retains fewer versions than it has then the oldest versions are dropped, and can no longer be read or rolled back to
+func TestKeyVersions(t *testing.T) {
+	server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey, MaxVersions: 3}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	handler, bearer := server.Handler(), testToken(t, server, "tester")
+
+	serve := func(method, path string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+bearer)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	if code, _ := serve("POST", "/key", RequestSingle{Key: "TestKeyVersions", Value: "first"}); code != 201 {
+		t.Fatalf("POST /key = HTTP/%d, expected HTTP/201", code)
+	}
+
+	for _, value := range []string{"second", "third"} {
+		if code, _ := serve("PUT", "/key/TestKeyVersions", RequestSingle{Key: "TestKeyVersions", Value: value}); code != 200 {
+			t.Fatalf("PUT /key/TestKeyVersions = HTTP/%d, expected HTTP/200", code)
+		}
+	}
+
+	tests := []struct {
+		ExpectedStatusCode, ExpectedVersion int
+		ExpectedValue, Path                 string
+	}{
+		{
+			ExpectedStatusCode: 200,
+			ExpectedVersion:    3,
+			ExpectedValue:      "third",
+			Path:               "/key/TestKeyVersions",
+		},
+		{
+			ExpectedStatusCode: 200,
+			ExpectedVersion:    1,
+			ExpectedValue:      "first",
+			Path:               "/key/TestKeyVersions?version=1",
+		},
+		{
+			ExpectedStatusCode: 400,
+			ExpectedValue:      ErrorVersionDoesNotExist,
+			Path:               "/key/TestKeyVersions?version=4",
+		},
+		{
+			ExpectedStatusCode: 400,
+			ExpectedValue:      ErrorInvalidVersion,
+			Path:               "/key/TestKeyVersions?version=-1",
+		},
+		{
+			ExpectedStatusCode: 400,
+			ExpectedValue:      ErrorInvalidVersion,
+			Path:               "/key/TestKeyVersions?version=latest",
+		},
+	}
+
+	for _, test := range tests {
+		code, body := serve("GET", test.Path, nil)
+
+		var response ValueResponse
+
+		json.Unmarshal(body, &response)
+
+		if code != test.ExpectedStatusCode || response.Message != test.ExpectedValue || response.Version != test.ExpectedVersion {
+			t.Errorf(
+				`GET %s = HTTP/%d, "%v" at version %d; expected HTTP/%d, "%s" at version %d`,
+				test.Path,
+				code,
+				response.Message,
+				response.Version,
+				test.ExpectedStatusCode,
+				test.ExpectedValue,
+				test.ExpectedVersion,
+			)
+		}
+	}
+
+	if code, body := serve("POST", "/rollback/TestKeyVersions", RequestRollback{Version: 1}); code != 200 {
+		t.Fatalf("POST /rollback/TestKeyVersions = HTTP/%d %s, expected HTTP/200", code, body)
+	}
+
+	if value, v, _, _ := server.keys.read("TestKeyVersions", 0); value != "first" || v.Number != 4 || v.Actor != "tester" {
+		t.Errorf(`keys["TestKeyVersions"] after the rollback = "%s" at version %d by "%s", expected "first" at version 4 by "tester"`, value, v.Number, v.Actor)
+	}
+
+	code, body := serve("GET", "/versions/TestKeyVersions", nil)
+
+	var versionsResponse struct {
+		Message []VersionInfo `json:"msg"`
+	}
+
+	json.Unmarshal(body, &versionsResponse)
+
+	if code != 200 || len(versionsResponse.Message) != 3 || versionsResponse.Message[0].Version != 2 || !versionsResponse.Message[2].Current {
+		t.Errorf("GET /versions/TestKeyVersions = HTTP/%d %s, expected HTTP/200 with versions 2 to 4, the last being current", code, body)
+	}
+
+	if code, _ := serve("GET", "/key/TestKeyVersions?version=1", nil); code != 400 {
+		t.Errorf("GET /key/TestKeyVersions?version=1 of a version dropped by the retention = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code, _ := serve("POST", "/rollback/TestKeyVersions", RequestRollback{Version: 1}); code != 400 {
+		t.Errorf("POST /rollback/TestKeyVersions to a version dropped by the retention = HTTP/%d, expected HTTP/400", code)
+	}
+
+	if code, _ := serve("GET", "/versions/DoNotTestKeyVersions", nil); code != 400 {
+		t.Errorf("GET /versions/DoNotTestKeyVersions = HTTP/%d, expected HTTP/400", code)
+	}
+}
@@ -0,0 +1,361 @@
+package keymanaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errRevisionCompacted = errors.New(ErrorRevisionCompacted)
+
+// The types of change an event records, restoring a key from the trash creates it again
+const (
+	EventCreate = "create"
+	EventDelete = "delete"
+	EventUpdate = "update"
+)
+
+// HeartbeatInterval is how often a comment is sent to watchers while nothing changes, so that idle connections are not dropped
+const HeartbeatInterval = 15 * time.Second
+
+// eventPrefix is the prefix of the storage keys of the events, which are named by their zero padded revision so that they are listed in order;
+// compactedKey is the storage key of the last revision whose event has been compacted away
+const (
+	compactedKey = "sys/compacted"
+	eventPrefix  = "event/"
+)
+
+// Event is a change to a key, stamped with the revision it was made at; the value of the version written is only included for watchers
+// asking for it, and never for deletions
+type Event struct {
+	Key      string      `json:"key"`
+	Revision int64       `json:"revision"`
+	Time     time.Time   `json:"time"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value,omitempty"`
+	Version  int         `json:"version,omitempty"`
+}
+
+// changes wakes up everyone waiting for the storage to change, each wait returns a channel which is closed by the next change
+type changes struct {
+	changed chan struct{}
+	mutex   sync.Mutex
+}
+
+// notifyingStorage is the storage wrapped so that every transaction which commits wakes up whoever is waiting for a change
+type notifyingStorage struct {
+	storage.Storage
+	changes *changes
+}
+
+func newChanges() *changes {
+	return &changes{changed: make(chan struct{})}
+}
+
+// wait returns a channel which is closed by the next change, it has to be taken before reading what it is waiting on so that no change is missed
+func (c *changes) wait() <-chan struct{} {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	return c.changed
+}
+
+func (c *changes) notify() {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	close(c.changed)
+
+	c.changed = make(chan struct{})
+}
+
+func (ns *notifyingStorage) Transaction(run func(txn storage.Txn) error) error {
+	if err := ns.Storage.Transaction(run); err != nil {
+		return err
+	}
+
+	ns.changes.notify()
+
+	return nil
+}
+
+func eventKey(revision int64) string {
+	return fmt.Sprintf("%s%020d", eventPrefix, revision)
+}
+
+// readRevision reads the revision stored under the storage key, zero when none is
+func readRevision(txn storage.Txn, storageKey string) (int64, error) {
+	data, exists, err := txn.Get(storageKey)
+
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// recordEvent records the change to the key as an event at the next revision, which is returned, and queues its webhook deliveries
+func (kd *keyData) recordEvent(txn storage.Txn, eventType, key string, number int) (int64, error) {
+	revision, err := nextRevision(txn)
+
+	if err != nil {
+		return 0, err
+	}
+
+	event := Event{Key: key, Revision: revision, Time: time.Now().UTC(), Type: eventType, Version: number}
+
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = txn.Put(eventKey(revision), data); err != nil {
+		return 0, err
+	}
+
+	return revision, kd.enqueueDeliveries(txn, event)
+}
+
+// compactEvents removes the oldest events past the retention, returning how many were removed; watchers can no longer resume from
+// before the last event removed
+func (kd *keyData) compactEvents() (int, error) {
+	_, store, err := kd.state()
+
+	if err != nil || kd.eventRetention == 0 {
+		return 0, err
+	}
+
+	compacted := 0
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		storageKeys, err := txn.List(eventPrefix)
+
+		if err != nil || len(storageKeys) <= kd.eventRetention {
+			return err
+		}
+
+		compacted = len(storageKeys) - kd.eventRetention
+
+		for _, storageKey := range storageKeys[:compacted] {
+			if err = txn.Delete(storageKey); err != nil {
+				return err
+			}
+		}
+
+		return txn.Put(compactedKey, []byte(strings.TrimLeft(strings.TrimPrefix(storageKeys[compacted-1], eventPrefix), "0")))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return compacted, nil
+}
+
+// events lists the events after the revision for the keys under the prefix, with the value of each version written when values is set, a
+// negative revision listing none; the events for keys the access does not allow listing are left out, as are the values of the keys it
+// does not allow reading. The current revision is returned along with them, and errRevisionCompacted when the events after the revision
+// are no longer all retained
+func (kd *keyData) events(prefix string, after int64, values bool, access keyAccess) ([]Event, int64, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	current, err := readRevision(store, revisionKey)
+
+	if err != nil || after < 0 {
+		return nil, current, err
+	}
+
+	compacted, err := readRevision(store, compactedKey)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if after < compacted {
+		return nil, 0, errRevisionCompacted
+	}
+
+	storageKeys, err := store.List(eventPrefix)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events := make([]Event, 0)
+
+	for _, storageKey := range storageKeys {
+		if storageKey <= eventKey(after) {
+			continue
+		}
+
+		data, exists, err := store.Get(storageKey)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var event Event
+
+		if !exists {
+			continue
+		}
+
+		if err = json.Unmarshal(data, &event); err != nil {
+			return nil, 0, err
+		}
+
+		if !strings.HasPrefix(event.Key, prefix) || !access.allows(CapabilityList, event.Key) {
+			continue
+		}
+
+		if values && event.Type != EventDelete && access.allows(CapabilityRead, event.Key) {
+			event.Value = kd.eventValue(kr, store, event)
+		}
+
+		events = append(events, event)
+	}
+
+	return events, current, nil
+}
+
+// eventValue opens the value of the version written by the event, nil when the version is no longer retained
+func (kd *keyData) eventValue(kr *keyring, store storage.Txn, event Event) interface{} {
+	e, err := readEntry(store, event.Key)
+
+	if err != nil || e == nil {
+		return nil
+	}
+
+	v, found := e.find(event.Version)
+
+	if !found {
+		return nil
+	}
+
+	value, err := kr.open(event.Key, v.Value)
+
+	if err != nil {
+		return nil
+	}
+
+	return v.native(value)
+}
+
+// parseWatchRevision reads the revision to resume watching after from the "revision" query parameter, or else the Last-Event-ID header
+// sent by reconnecting clients; -1 is returned when neither is provided, watching then starting from the current revision
+func parseWatchRevision(c *gin.Context) (int64, bool) {
+	query := c.Query("revision")
+
+	if query == "" {
+		query = c.GetHeader("Last-Event-ID")
+	}
+
+	if query == "" {
+		return -1, true
+	}
+
+	revision, err := strconv.ParseInt(query, 10, 64)
+
+	return revision, err == nil && revision >= 0
+}
+
+// HandleWatch handles the GET request for the changes to the keys under the "prefix" query parameter, streamed as Server-Sent Events
+// named after the type of the change with the revision of the change as their ID; the changes after the "revision" query parameter or
+// the Last-Event-ID header are sent first, so a client reconnecting misses nothing, and values are only sent with "values=true"; every
+// event is checked against the policies of the token as they are when it is sent, leaving out the keys it is denied
+func (s *Server) HandleWatch(c *gin.Context) {
+	after, valid := parseWatchRevision(c)
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidRevision})
+
+		return
+	}
+
+	prefix, values := c.Query("prefix"), c.Query("values") == "true"
+
+	wait := s.keys.changes.wait()
+
+	access, err := s.keyAccess(c)
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	events, current, err := s.keys.events(prefix, after, values, access)
+
+	if err == errRevisionCompacted {
+		c.AbortWithStatusJSON(410, Response{true, ErrorRevisionCompacted})
+
+		return
+	}
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if after < 0 {
+		after = current
+	}
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+
+	defer heartbeat.Stop()
+
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Status(200)
+
+	for {
+		for _, event := range events {
+			c.Render(-1, sse.Event{Data: event, Event: event.Type, Id: strconv.FormatInt(event.Revision, 10)})
+
+			after = event.Revision
+		}
+
+		c.Writer.Flush()
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			events = nil
+
+			c.Writer.WriteString(": heartbeat\n\n")
+
+			continue
+		case <-wait:
+		}
+
+		wait = s.keys.changes.wait()
+
+		// The policies of the token are read again for every batch, so a rule changed while the client watches applies to what is sent next
+		if access, err = s.keyAccess(c); err != nil {
+			return
+		}
+
+		if events, _, err = s.keys.events(prefix, after, values, access); err != nil {
+			// The keymanager has been sealed or the events since the last one sent have been compacted, the client has to reconnect
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package keymanaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// Need to test the following:
+// If a key under the prefix is created, updated or deleted then an event named after the change is streamed with the revision as its ID
+// If a key outside of the prefix changes then no event is streamed for it
+// If a revision is provided then the events after it are streamed first, and values are only included when asked for
+// If the revision is not a whole number then a HTTP/400 status is returned
+// If the events after the revision have been compacted then a HTTP/410 status is returned
+func TestHandleWatch(t *testing.T) {
+	server := newTestServer(t)
+
+	testServer := httptest.NewServer(server.Handler())
+
+	defer testServer.Close()
+
+	server.keys.set("TestHandleWatch/password", "first", writeOptions{})
+
+	watch := func(query string) (int, <-chan Event, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		mockRequest, err := http.NewRequest("GET", testServer.URL+"/watch"+query, nil)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		response, err := http.DefaultClient.Do(mockRequest.WithContext(ctx))
+
+		if err != nil {
+			t.Fatal("could not watch:", err)
+		}
+
+		events := make(chan Event)
+
+		go func() {
+			defer response.Body.Close()
+			defer close(events)
+
+			scanner := bufio.NewScanner(response.Body)
+
+			for scanner.Scan() {
+				if !strings.HasPrefix(scanner.Text(), "data:") {
+					continue
+				}
+
+				var event Event
+
+				json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data:")), &event)
+
+				events <- event
+			}
+		}()
+
+		return response.StatusCode, events, cancel
+	}
+
+	next := func(events <-chan Event) Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+
+		return Event{}
+	}
+
+	code, events, cancel := watch("?prefix=TestHandleWatch/")
+
+	defer cancel()
+
+	if code != 200 {
+		t.Fatalf("GET /watch = HTTP/%d, expected HTTP/200", code)
+	}
+
+	server.keys.set("TestHandleWatchOther", "ignored", writeOptions{})
+	server.keys.set("TestHandleWatch/password", "second", writeOptions{})
+	server.keys.delete("TestHandleWatch/password", "tester", nil)
+
+	expectedEvents := []Event{
+		{Key: "TestHandleWatch/password", Revision: 3, Type: EventUpdate, Version: 2},
+		{Key: "TestHandleWatch/password", Revision: 4, Type: EventDelete},
+	}
+
+	for _, expectedEvent := range expectedEvents {
+		if event := next(events); event.Key != expectedEvent.Key || event.Revision != expectedEvent.Revision || event.Type != expectedEvent.Type || event.Version != expectedEvent.Version || event.Value != nil {
+			t.Errorf("GET /watch streamed %+v, expected %+v", event, expectedEvent)
+		}
+	}
+
+	server.keys.set("TestHandleWatch/token", "third", writeOptions{})
+
+	code, resumed, cancelResumed := watch("?prefix=TestHandleWatch/&revision=2&values=true")
+
+	defer cancelResumed()
+
+	if code != 200 {
+		t.Fatalf("GET /watch resuming = HTTP/%d, expected HTTP/200", code)
+	}
+
+	expectedEvents = []Event{
+		{Key: "TestHandleWatch/password", Revision: 3, Type: EventUpdate, Version: 2},
+		{Key: "TestHandleWatch/password", Revision: 4, Type: EventDelete},
+		{Key: "TestHandleWatch/token", Revision: 5, Type: EventCreate, Value: "third", Version: 1},
+	}
+
+	for _, expectedEvent := range expectedEvents {
+		if event := next(resumed); event.Key != expectedEvent.Key || event.Revision != expectedEvent.Revision || event.Type != expectedEvent.Type || event.Value != expectedEvent.Value {
+			t.Errorf("GET /watch resuming streamed %+v, expected %+v", event, expectedEvent)
+		}
+	}
+
+	if code, _, cancelInvalid := watch("?revision=latest"); code != 400 {
+		t.Errorf("GET /watch?revision=latest = HTTP/%d, expected HTTP/400", code)
+	} else {
+		cancelInvalid()
+	}
+
+	compactingServer, err := NewServer(storage.NewMemory(), Options{EventRetention: 1, MasterKey: testMasterKey, RootToken: testRootToken}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	compactingServer.keys.set("TestHandleWatch/first", "first", writeOptions{})
+	compactingServer.keys.set("TestHandleWatch/second", "second", writeOptions{})
+
+	if compacted, err := compactingServer.keys.compactEvents(); compacted != 1 || err != nil {
+		t.Fatalf("compactEvents() = %d, %v, expected 1 event compacted", compacted, err)
+	}
+
+	for query, expectedStatusCode := range map[string]int{"?revision=0": 410, "?revision=1": 200} {
+		mockRequest, _ := http.NewRequest("GET", "/watch"+query, nil)
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		if expectedStatusCode == 200 {
+			ctx, cancelCompacted := context.WithCancel(context.Background())
+
+			cancelCompacted()
+
+			mockRequest = mockRequest.WithContext(ctx)
+		}
+
+		compactingServer.Handler().ServeHTTP(mockResponseWriter, mockRequest)
+
+		if mockResponseWriter.Code != expectedStatusCode {
+			t.Errorf("GET /watch%s after compaction = HTTP/%d, expected HTTP/%d", query, mockResponseWriter.Code, expectedStatusCode)
+		}
+	}
+}
+
+// Need to test the following:
+// If a key under the prefix changes which the token is denied listing then no event is streamed for it, and when the token is denied
+//     reading it then its event is streamed without its value, both for the events resumed from a revision and the changes after them
+// If the policies of the token change while it watches then the events streamed after the change follow them
+func TestHandleWatchPolicies(t *testing.T) {
+	server := newTestServer(t)
+
+	testServer := httptest.NewServer(server.Handler())
+
+	defer testServer.Close()
+
+	writePolicy := func(document string) {
+		mockRequest, err := http.NewRequest("PUT", testServer.URL+"/sys/policies/watcher", strings.NewReader(`{"policy": `+strconv.Quote(document)+`}`))
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		response, err := http.DefaultClient.Do(mockRequest)
+
+		if err != nil || response.StatusCode != 200 {
+			t.Fatal("could not write the policy:", err)
+		}
+
+		response.Body.Close()
+	}
+
+	writePolicy(`
+path "TestHandleWatchPolicies/*" {
+  capabilities = ["list"]
+}
+
+path "TestHandleWatchPolicies/" {
+  capabilities = ["read"]
+}
+
+path "TestHandleWatchPolicies/password" {
+  capabilities = ["read"]
+}
+
+path "TestHandleWatchPolicies/secret" {
+  capabilities = ["deny"]
+}`)
+
+	info, err := server.keys.createToken(RequestToken{Name: "watcher", Policies: []string{"watcher"}}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the token:", err)
+	}
+
+	server.keys.set("TestHandleWatchPolicies/secret", "hidden", writeOptions{})
+	server.keys.set("TestHandleWatchPolicies/unreadable", "hidden", writeOptions{})
+	server.keys.set("TestHandleWatchPolicies/password", "first", writeOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	mockRequest, err := http.NewRequest("GET", testServer.URL+"/watch?prefix=TestHandleWatchPolicies/&revision=0&values=true", nil)
+
+	if err != nil {
+		t.Fatal("could not create the mock request")
+	}
+
+	mockRequest.Header.Set("Authorization", "Bearer "+info.Token)
+
+	response, err := http.DefaultClient.Do(mockRequest.WithContext(ctx))
+
+	if err != nil || response.StatusCode != 200 {
+		t.Fatal("could not watch:", err)
+	}
+
+	events := make(chan Event)
+
+	go func() {
+		defer response.Body.Close()
+		defer close(events)
+
+		scanner := bufio.NewScanner(response.Body)
+
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "data:") {
+				continue
+			}
+
+			var event Event
+
+			json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data:")), &event)
+
+			events <- event
+		}
+	}()
+
+	next := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+
+		return Event{}
+	}
+
+	expectedEvents := []Event{
+		{Key: "TestHandleWatchPolicies/unreadable", Revision: 2},
+		{Key: "TestHandleWatchPolicies/password", Revision: 3, Value: "first"},
+	}
+
+	server.keys.set("TestHandleWatchPolicies/secret", "changed", writeOptions{})
+	server.keys.set("TestHandleWatchPolicies/unreadable", "changed", writeOptions{})
+
+	expectedEvents = append(expectedEvents, Event{Key: "TestHandleWatchPolicies/unreadable", Revision: 5})
+
+	for _, expectedEvent := range expectedEvents {
+		if event := next(); event.Key != expectedEvent.Key || event.Revision != expectedEvent.Revision || event.Value != expectedEvent.Value {
+			t.Errorf("GET /watch streamed %+v, expected %+v", event, expectedEvent)
+		}
+	}
+
+	writePolicy(`
+path "TestHandleWatchPolicies/*" {
+  capabilities = ["read", "list"]
+}
+
+path "TestHandleWatchPolicies/password" {
+  capabilities = ["deny"]
+}`)
+
+	server.keys.set("TestHandleWatchPolicies/password", "second", writeOptions{})
+	server.keys.set("TestHandleWatchPolicies/secret", "readable", writeOptions{})
+
+	if event := next(); event.Key != "TestHandleWatchPolicies/secret" || event.Revision != 7 || event.Value != "readable" {
+		t.Errorf("GET /watch after the policy changed streamed %+v, expected the change to TestHandleWatchPolicies/secret with its value", event)
+	}
+}
@@ -0,0 +1,781 @@
+package keymanaging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var errWebhookDoesNotExist = errors.New(ErrorWebhookDoesNotExist)
+
+// The prefixes of the storage keys of the webhooks, of the log of their deliveries, and of the queue of the deliveries still to be made;
+// deliveries are named by the ID of their webhook and the zero padded revision of their event so that they are listed in order
+const (
+	deliveryPrefix = "delivery/"
+	queuePrefix    = "queue/"
+	webhookPrefix  = "webhook/"
+)
+
+// The states of a delivery, a delivery is failed once it has been attempted MaxDeliveryAttempts times without succeeding
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryPending   = "pending"
+)
+
+// The request headers of a delivery, the signature is the hex encoded HMAC-SHA256 of the body keyed with the secret of the webhook
+const (
+	HeaderDelivery  = "X-KeyMan-Delivery"
+	HeaderEvent     = "X-KeyMan-Event"
+	HeaderSignature = "X-KeyMan-Signature"
+)
+
+// The number of times a delivery is attempted before it is failed, the number of finished deliveries kept in the log of each webhook,
+// the longest wait between two attempts of a delivery, and how long the receiver has to respond to an attempt
+const (
+	DeliveryTimeout     = 10 * time.Second
+	MaxDeliveryAttempts = 8
+	MaxDeliveryBackoff  = time.Hour
+	MaxDeliveryLog      = 100
+)
+
+// DefaultWebhookBackoff is the wait before the first retry of a failed delivery when the server does not set its own
+const DefaultWebhookBackoff = time.Second
+
+// webhookCache holds the webhooks every change is checked against, so that a change does not read every webhook from the storage; it is
+// dropped whenever a webhook is created or deleted, or the storage is unsealed, and read again by the next change
+type webhookCache struct {
+	generation int
+	loaded     bool
+	mutex      sync.Mutex
+	webhooks   []*webhook
+}
+
+// get returns the cached webhooks, reading them within the transaction when they are not cached; webhooks read while the cache was
+// being dropped are returned but not cached, since they may already be out of date
+func (wc *webhookCache) get(txn storage.Txn) ([]*webhook, error) {
+	wc.mutex.Lock()
+
+	webhooks, loaded, generation := wc.webhooks, wc.loaded, wc.generation
+
+	wc.mutex.Unlock()
+
+	if loaded {
+		return webhooks, nil
+	}
+
+	webhooks, err := readWebhooks(txn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wc.mutex.Lock()
+
+	if generation == wc.generation {
+		wc.webhooks, wc.loaded = webhooks, true
+	}
+
+	wc.mutex.Unlock()
+
+	return webhooks, nil
+}
+
+// invalidate drops the cached webhooks, it is called both within the transaction changing the webhooks and once it is committed
+func (wc *webhookCache) invalidate() {
+	wc.mutex.Lock()
+
+	defer wc.mutex.Unlock()
+
+	wc.generation++
+	wc.webhooks, wc.loaded = nil, false
+}
+
+// webhook is a receiver notified of the changes to the keys under its prefix, its secret is sealed like a value
+type webhook struct {
+	CreatedAt time.Time   `json:"createdAt"`
+	Events    []string    `json:"events"`
+	ID        string      `json:"id"`
+	Prefix    string      `json:"prefix"`
+	Secret    sealedValue `json:"secret"`
+	URL       string      `json:"url"`
+}
+
+// RequestWebhook is the struct representing the format that requests to create a webhook will use, a webhook is notified of every type of
+// change when no events are provided, and a secret is generated for it when none is provided
+type RequestWebhook struct {
+	Events []string `json:"events,omitempty"`
+	Prefix string   `json:"prefix"`
+	Secret string   `json:"secret,omitempty"`
+	URL    string   `json:"url"`
+}
+
+// WebhookInfo describes a webhook without its secret, which is only returned once when the webhook is created
+type WebhookInfo struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Events    []string  `json:"events"`
+	ID        string    `json:"id"`
+	Prefix    string    `json:"prefix"`
+	Secret    string    `json:"secret,omitempty"`
+	URL       string    `json:"url"`
+}
+
+// Delivery is the notification of a webhook of an event, along with how its attempts went
+type Delivery struct {
+	Attempts    int        `json:"attempts"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	Event       Event      `json:"event"`
+	ID          string     `json:"id"`
+	LastError   string     `json:"lastError,omitempty"`
+	NextAttempt time.Time  `json:"nextAttempt"`
+	Status      string     `json:"status"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	WebhookID   string     `json:"webhook"`
+}
+
+// WebhookPayload is the body sent to a webhook, the time it was sent at lets the receiver refuse replayed deliveries
+type WebhookPayload struct {
+	Delivery string    `json:"delivery"`
+	Event    Event     `json:"event"`
+	SentAt   time.Time `json:"sentAt"`
+	Webhook  string    `json:"webhook"`
+}
+
+func deliveryKey(prefix, webhookID string, revision int64) string {
+	return fmt.Sprintf("%s%s/%020d", prefix, webhookID, revision)
+}
+
+func (w *webhook) info() WebhookInfo {
+	return WebhookInfo{CreatedAt: w.CreatedAt, Events: w.Events, ID: w.ID, Prefix: w.Prefix, URL: w.URL}
+}
+
+// notifiedOf reports whether the webhook is notified of the event
+func (w *webhook) notifiedOf(event Event) bool {
+	if !strings.HasPrefix(event.Key, w.Prefix) {
+		return false
+	}
+
+	for _, eventType := range w.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valid reports whether the URL is an absolute http or https URL and every event is a type of change, filling in every type of change
+// when none are provided
+func (rw *RequestWebhook) valid() bool {
+	parsed, err := url.Parse(rw.URL)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return false
+	}
+
+	if len(rw.Events) == 0 {
+		rw.Events = []string{EventCreate, EventDelete, EventUpdate}
+	}
+
+	for _, eventType := range rw.Events {
+		if eventType != EventCreate && eventType != EventDelete && eventType != EventUpdate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sign returns the signature of the body with the secret, as sent in the X-KeyMan-Signature header
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func readWebhook(txn storage.Txn, id string) (*webhook, error) {
+	data, exists, err := txn.Get(webhookPrefix + id)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var w webhook
+
+	return &w, json.Unmarshal(data, &w)
+}
+
+func readWebhooks(txn storage.Txn) ([]*webhook, error) {
+	storageKeys, err := txn.List(webhookPrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*webhook, 0, len(storageKeys))
+
+	for _, storageKey := range storageKeys {
+		w, err := readWebhook(txn, strings.TrimPrefix(storageKey, webhookPrefix))
+
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, nil
+}
+
+func readDelivery(txn storage.Txn, storageKey string) (*Delivery, error) {
+	data, exists, err := txn.Get(storageKey)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var d Delivery
+
+	return &d, json.Unmarshal(data, &d)
+}
+
+func writeDelivery(txn storage.Txn, d *Delivery) error {
+	data, err := json.Marshal(d)
+
+	if err != nil {
+		return err
+	}
+
+	return txn.Put(deliveryKey(deliveryPrefix, d.WebhookID, d.Event.Revision), data)
+}
+
+// enqueueDeliveries queues a delivery of the event for every webhook notified of it, within the transaction making the change so that
+// no change goes without its deliveries
+func (kd *keyData) enqueueDeliveries(txn storage.Txn, event Event) error {
+	webhooks, err := kd.webhookCache.get(txn)
+
+	if err != nil {
+		return err
+	}
+
+	for _, w := range webhooks {
+		if !w.notifiedOf(event) {
+			continue
+		}
+
+		d := &Delivery{
+			Event:       event,
+			ID:          fmt.Sprintf("%s-%d", w.ID, event.Revision),
+			NextAttempt: event.Time,
+			Status:      DeliveryPending,
+			WebhookID:   w.ID,
+		}
+
+		if err = writeDelivery(txn, d); err != nil {
+			return err
+		}
+
+		if err = txn.Put(deliveryKey(queuePrefix, w.ID, event.Revision), []byte(d.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrapWebhooks rewraps the secret of every webhook with the current key encryption key of the keyring
+func rewrapWebhooks(txn storage.Txn, kr *keyring) error {
+	webhooks, err := readWebhooks(txn)
+
+	if err != nil {
+		return err
+	}
+
+	for _, w := range webhooks {
+		if w.Secret, err = kr.rewrap(w.Secret); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(w)
+
+		if err != nil {
+			return err
+		}
+
+		if err = txn.Put(webhookPrefix+w.ID, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createWebhook creates a webhook for the request, returning it along with its secret
+func (kd *keyData) createWebhook(request RequestWebhook) (WebhookInfo, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return WebhookInfo{}, err
+	}
+
+	id := hex.EncodeToString(newRandomKey()[:8])
+
+	if request.Secret == "" {
+		request.Secret = hex.EncodeToString(newRandomKey())
+	}
+
+	w := &webhook{
+		CreatedAt: time.Now().UTC(),
+		Events:    request.Events,
+		ID:        id,
+		Prefix:    request.Prefix,
+		Secret:    kr.seal(webhookPrefix+id, request.Secret),
+		URL:       request.URL,
+	}
+
+	data, err := json.Marshal(w)
+
+	if err != nil {
+		return WebhookInfo{}, err
+	}
+
+	defer kd.webhookCache.invalidate()
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		kd.webhookCache.invalidate()
+
+		return txn.Put(webhookPrefix+id, data)
+	})
+
+	if err != nil {
+		return WebhookInfo{}, err
+	}
+
+	info := w.info()
+
+	info.Secret = request.Secret
+
+	return info, nil
+}
+
+// webhooks lists every webhook without its secret
+func (kd *keyData) webhooks() ([]WebhookInfo, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := readWebhooks(store)
+
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]WebhookInfo, 0, len(webhooks))
+
+	for _, w := range webhooks {
+		infos = append(infos, w.info())
+	}
+
+	return infos, nil
+}
+
+// deleteWebhook removes the webhook along with its queued deliveries and its delivery log
+func (kd *keyData) deleteWebhook(id string) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	defer kd.webhookCache.invalidate()
+
+	return store.Transaction(func(txn storage.Txn) error {
+		w, err := readWebhook(txn, id)
+
+		if err != nil {
+			return err
+		}
+
+		if w == nil {
+			return errWebhookDoesNotExist
+		}
+
+		kd.webhookCache.invalidate()
+
+		for _, prefix := range []string{deliveryPrefix, queuePrefix} {
+			storageKeys, err := txn.List(prefix + id + "/")
+
+			if err != nil {
+				return err
+			}
+
+			for _, storageKey := range storageKeys {
+				if err = txn.Delete(storageKey); err != nil {
+					return err
+				}
+			}
+		}
+
+		return txn.Delete(webhookPrefix + id)
+	})
+}
+
+// deliveries lists the delivery log of the webhook, oldest first, false is returned when the webhook does not exist
+func (kd *keyData) deliveries(id string) ([]Delivery, bool, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	w, err := readWebhook(store, id)
+
+	if err != nil || w == nil {
+		return nil, false, err
+	}
+
+	storageKeys, err := store.List(deliveryPrefix + id + "/")
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	deliveries := make([]Delivery, 0, len(storageKeys))
+
+	for _, storageKey := range storageKeys {
+		d, err := readDelivery(store, storageKey)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if d != nil {
+			deliveries = append(deliveries, *d)
+		}
+	}
+
+	return deliveries, true, nil
+}
+
+// dueDeliveries returns the next queued delivery of every webhook whose attempt is due, deliveries to a webhook being made in order
+// so that a delivery waiting to be retried holds back the ones after it
+func (kd *keyData) dueDeliveries(now time.Time) ([]*Delivery, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return nil, err
+	}
+
+	storageKeys, err := store.List(queuePrefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	due, seen := make([]*Delivery, 0), make(map[string]bool)
+
+	for _, storageKey := range storageKeys {
+		webhookID := strings.SplitN(strings.TrimPrefix(storageKey, queuePrefix), "/", 2)[0]
+
+		if seen[webhookID] {
+			continue
+		}
+
+		seen[webhookID] = true
+
+		d, err := readDelivery(store, deliveryPrefix+strings.TrimPrefix(storageKey, queuePrefix))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if d != nil && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+
+	return due, nil
+}
+
+// attempt makes an attempt of the delivery, returning the status code the receiver responded with
+func (kd *keyData) attempt(client *http.Client, d *Delivery) (int, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := readWebhook(store, d.WebhookID)
+
+	if err != nil || w == nil {
+		return 0, err
+	}
+
+	secret, err := kr.open(webhookPrefix+w.ID, w.Secret)
+
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(WebhookPayload{Delivery: d.ID, Event: d.Event, SentAt: time.Now().UTC(), Webhook: w.ID})
+
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", gin.MIMEJSON)
+	request.Header.Set(HeaderDelivery, d.ID)
+	request.Header.Set(HeaderEvent, d.Event.Type)
+	request.Header.Set(HeaderSignature, sign(secret, body))
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return 0, err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("the receiver responded with HTTP/%d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// finishAttempt records how the attempt of the delivery went, taking it off the queue once it is delivered or failed and dropping the
+// oldest finished deliveries past the length of the log; the next attempt of a delivery which is retried waits twice as long as the last
+func (kd *keyData) finishAttempt(d *Delivery, statusCode int, attemptErr error, backoff time.Duration) error {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return err
+	}
+
+	return store.Transaction(func(txn storage.Txn) error {
+		if w, err := readWebhook(txn, d.WebhookID); err != nil || w == nil {
+			// The webhook has been deleted along with its deliveries while the attempt was made
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		d.Attempts, d.LastError, d.StatusCode = d.Attempts+1, "", statusCode
+
+		switch {
+		case attemptErr == nil:
+			d.DeliveredAt, d.Status = &now, DeliveryDelivered
+		case d.Attempts >= MaxDeliveryAttempts:
+			d.LastError, d.Status = attemptErr.Error(), DeliveryFailed
+		default:
+			wait := backoff << uint(d.Attempts-1)
+
+			if wait > MaxDeliveryBackoff || wait <= 0 {
+				wait = MaxDeliveryBackoff
+			}
+
+			d.LastError, d.NextAttempt = attemptErr.Error(), now.Add(wait)
+		}
+
+		if err := writeDelivery(txn, d); err != nil || d.Status == DeliveryPending {
+			return err
+		}
+
+		if err := txn.Delete(deliveryKey(queuePrefix, d.WebhookID, d.Event.Revision)); err != nil {
+			return err
+		}
+
+		storageKeys, err := txn.List(deliveryPrefix + d.WebhookID + "/")
+
+		if err != nil || len(storageKeys) <= MaxDeliveryLog {
+			return err
+		}
+
+		for _, storageKey := range storageKeys[:len(storageKeys)-MaxDeliveryLog] {
+			old, err := readDelivery(txn, storageKey)
+
+			if err != nil {
+				return err
+			}
+
+			if old.Status == DeliveryPending {
+				continue
+			}
+
+			if err = txn.Delete(storageKey); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// deliverWebhooks attempts every delivery which is due once, the deliveries to different webhooks being attempted at the same time so that
+// a slow receiver does not hold back the others
+func (s *Server) deliverWebhooks(client *http.Client, backoff time.Duration) {
+	due, err := s.keys.dueDeliveries(time.Now())
+
+	if err != nil {
+		if err != ErrSealed {
+			s.logger.Printf("could not read the webhook deliveries: %v", err)
+		}
+
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, d := range due {
+		wg.Add(1)
+
+		go func(d *Delivery) {
+			defer wg.Done()
+
+			statusCode, attemptErr := s.keys.attempt(client, d)
+
+			if attemptErr != nil {
+				s.logger.Printf("could not deliver %s to webhook %s: %v", d.ID, d.WebhookID, attemptErr)
+			}
+
+			if err := s.keys.finishAttempt(d, statusCode, attemptErr, backoff); err != nil {
+				s.logger.Printf("could not record the delivery of %s to webhook %s: %v", d.ID, d.WebhookID, err)
+			}
+		}(d)
+	}
+
+	wg.Wait()
+}
+
+// startDispatcher delivers the webhooks in the background until the server is closed, whenever a change is made and for the retries
+func (s *Server) startDispatcher(backoff time.Duration) {
+	client := &http.Client{Timeout: DeliveryTimeout}
+
+	interval := time.Second
+
+	if backoff < interval {
+		interval = backoff
+	}
+
+	retries := time.NewTicker(interval)
+
+	go func() {
+		defer retries.Stop()
+
+		for {
+			changed := s.keys.changes.wait()
+
+			s.deliverWebhooks(client, backoff)
+
+			select {
+			case <-s.stopReaper:
+				return
+			case <-changed:
+			case <-retries.C:
+			}
+		}
+	}()
+}
+
+// HandleCreateWebhook handles the POST request for the creation of a webhook notified of the changes to the keys under its prefix,
+// the secret its deliveries are signed with is only returned by this request
+func (s *Server) HandleCreateWebhook(c *gin.Context) {
+	var WebhookRequest RequestWebhook
+
+	err := json.NewDecoder(c.Request.Body).Decode(&WebhookRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	if !WebhookRequest.valid() {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidWebhook})
+
+		return
+	}
+
+	info, err := s.keys.createWebhook(WebhookRequest)
+
+	if err != nil {
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(201, Response{false, info})
+}
+
+// HandleGetWebhooks handles the GET request for every webhook, without their secrets
+func (s *Server) HandleGetWebhooks(c *gin.Context) {
+	webhooks, err := s.keys.webhooks()
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, webhooks})
+}
+
+// HandleDeleteWebhook handles the DELETE request for a webhook, the deliveries still queued for it are dropped
+func (s *Server) HandleDeleteWebhook(c *gin.Context) {
+	err := s.keys.deleteWebhook(c.Param("id"))
+
+	switch err {
+	case nil:
+	case errWebhookDoesNotExist:
+		c.AbortWithStatusJSON(400, Response{true, ErrorWebhookDoesNotExist})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, ""})
+}
+
+// HandleGetWebhookDeliveries handles the GET request for the delivery log of a webhook, the deliveries still queued included
+func (s *Server) HandleGetWebhookDeliveries(c *gin.Context) {
+	deliveries, exists, err := s.keys.deliveries(c.Param("id"))
+
+	if err != nil {
+		s.abortWithError(c, err.Error(), err)
+
+		return
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(400, Response{true, ErrorWebhookDoesNotExist})
+
+		return
+	}
+
+	c.JSON(200, Response{false, deliveries})
+}
@@ -0,0 +1,269 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+// webhookReceiver is a local receiver of webhook deliveries which fails the first attempts it is sent
+type webhookReceiver struct {
+	failures int
+	mutex    sync.Mutex
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mutex.Lock()
+
+	defer wr.mutex.Unlock()
+
+	if wr.failures > 0 {
+		wr.failures--
+
+		w.WriteHeader(500)
+
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	wr.received, wr.bodies = append(wr.received, r), append(wr.bodies, body)
+}
+
+func (wr *webhookReceiver) setFailures(failures int) {
+	wr.mutex.Lock()
+
+	defer wr.mutex.Unlock()
+
+	wr.failures = failures
+}
+
+// delivered returns the requests and bodies received so far
+func (wr *webhookReceiver) delivered() ([]*http.Request, [][]byte) {
+	wr.mutex.Lock()
+
+	defer wr.mutex.Unlock()
+
+	return append([]*http.Request{}, wr.received...), append([][]byte{}, wr.bodies...)
+}
+
+// waitFor polls the condition until it holds, failing the test when it does not within a few seconds
+func waitFor(t *testing.T, description string, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+	}
+}
+
+// Need to test the following:
+// If a webhook is created then its secret is returned once, and it is listed without its secret afterwards
+// If the url is not an absolute http or https URL, or an event is not create, update or delete, then a HTTP/400 status is returned
+// If a key under the prefix of a webhook changes in a way it is notified of then a signed JSON payload is delivered to it, in order,
+//     and changes outside of the prefix or of other types are not delivered
+// If the receiver fails then the delivery is retried until it succeeds, and the delivery log records every attempt
+// If the server stops with deliveries still queued then they are delivered by the next server using the storage
+// If the webhook is deleted then a HTTP/200 status is returned, deleting it again returns a HTTP/400 status, and no delivery is queued
+//     for it afterwards
+func TestWebhooks(t *testing.T) {
+	store := storage.NewMemory()
+
+	server, err := NewServer(store, Options{MasterKey: testMasterKey, RootToken: testRootToken, WebhookBackoff: 10 * time.Millisecond}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	defer server.Close()
+
+	handler := server.Handler()
+
+	serve := func(method, path string, body interface{}) (int, []byte) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes()
+	}
+
+	receiver := &webhookReceiver{failures: 2}
+
+	receiverServer := httptest.NewServer(receiver)
+
+	defer receiverServer.Close()
+
+	for _, invalid := range []RequestWebhook{{URL: "ftp://example.com"}, {URL: "/relative"}, {URL: receiverServer.URL, Events: []string{"rename"}}} {
+		if code, _ := serve("POST", "/sys/webhooks", invalid); code != 400 {
+			t.Errorf("POST /sys/webhooks with %+v = HTTP/%d, expected HTTP/400", invalid, code)
+		}
+	}
+
+	code, body := serve("POST", "/sys/webhooks", RequestWebhook{Events: []string{EventCreate, EventDelete}, Prefix: "TestWebhooks/", URL: receiverServer.URL})
+
+	var created struct {
+		Message WebhookInfo `json:"msg"`
+	}
+
+	json.Unmarshal(body, &created)
+
+	if code != 201 || created.Message.ID == "" || created.Message.Secret == "" {
+		t.Fatalf("POST /sys/webhooks = HTTP/%d %s, expected HTTP/201 with the ID and secret of the webhook", code, body)
+	}
+
+	if code, body := serve("GET", "/sys/webhooks", nil); code != 200 || bytes.Contains(body, []byte(created.Message.Secret)) || !bytes.Contains(body, []byte(created.Message.ID)) {
+		t.Errorf("GET /sys/webhooks = HTTP/%d %s, expected HTTP/200 listing the webhook without its secret", code, body)
+	}
+
+	server.keys.set("TestWebhooks/password", "first", writeOptions{})
+	server.keys.set("TestWebhooks/password", "second", writeOptions{})
+	server.keys.set("TestWebhooksOther", "ignored", writeOptions{})
+	server.keys.delete("TestWebhooks/password", "tester", nil)
+
+	waitFor(t, "the deliveries", func() bool {
+		received, _ := receiver.delivered()
+
+		return len(received) >= 2
+	})
+
+	received, bodies := receiver.delivered()
+
+	if len(received) != 2 {
+		t.Fatalf("received %d deliveries, expected 2", len(received))
+	}
+
+	for index, expectedType := range []string{EventCreate, EventDelete} {
+		var payload WebhookPayload
+
+		json.Unmarshal(bodies[index], &payload)
+
+		if payload.Event.Key != "TestWebhooks/password" || payload.Event.Type != expectedType || payload.Webhook != created.Message.ID || received[index].Header.Get(HeaderEvent) != expectedType {
+			t.Errorf("delivery %d = %+v, expected the %s of TestWebhooks/password", index, payload, expectedType)
+		}
+
+		if signature := received[index].Header.Get(HeaderSignature); signature != sign(created.Message.Secret, bodies[index]) {
+			t.Errorf("delivery %d was signed %s, expected %s", index, signature, sign(created.Message.Secret, bodies[index]))
+		}
+	}
+
+	code, body = serve("GET", "/sys/webhooks/"+created.Message.ID+"/deliveries", nil)
+
+	var log struct {
+		Message []Delivery `json:"msg"`
+	}
+
+	json.Unmarshal(body, &log)
+
+	if code != 200 || len(log.Message) != 2 || log.Message[0].Attempts != 3 || log.Message[0].Status != DeliveryDelivered || log.Message[1].Attempts != 1 || log.Message[1].Status != DeliveryDelivered {
+		t.Errorf("GET /sys/webhooks/%s/deliveries = HTTP/%d %s, expected both deliveries delivered, the first after 3 attempts", created.Message.ID, code, body)
+	}
+
+	receiver.setFailures(1000)
+
+	server.keys.set("TestWebhooks/token", "queued", writeOptions{})
+
+	waitFor(t, "a failed attempt", func() bool {
+		deliveries, _, _ := server.keys.deliveries(created.Message.ID)
+
+		return len(deliveries) == 3 && deliveries[2].Attempts > 0
+	})
+
+	server.Close()
+
+	receiver.setFailures(0)
+
+	restarted, err := NewServer(store, Options{MasterKey: testMasterKey, RootToken: testRootToken, WebhookBackoff: 10 * time.Millisecond}, nil)
+
+	if err != nil {
+		t.Fatal("could not restart the server:", err)
+	}
+
+	defer restarted.Close()
+
+	waitFor(t, "the queued delivery after restarting", func() bool {
+		deliveries, _, _ := restarted.keys.deliveries(created.Message.ID)
+
+		return len(deliveries) == 3 && deliveries[2].Status == DeliveryDelivered
+	})
+
+	handler = restarted.Handler()
+
+	if code, _ := serve("DELETE", "/sys/webhooks/"+created.Message.ID, nil); code != 200 {
+		t.Errorf("DELETE /sys/webhooks/%s = HTTP/%d, expected HTTP/200", created.Message.ID, code)
+	}
+
+	if code, _ := serve("DELETE", "/sys/webhooks/"+created.Message.ID, nil); code != 400 {
+		t.Errorf("DELETE /sys/webhooks/%s again = HTTP/%d, expected HTTP/400", created.Message.ID, code)
+	}
+
+	restarted.keys.set("TestWebhooks/deleted", "unnoticed", writeOptions{})
+
+	if queued, _ := store.List(queuePrefix); len(queued) != 0 {
+		t.Errorf("%d deliveries are queued after the webhook was deleted, expected none", len(queued))
+	}
+}
+
+// Need to test the following:
+// If a receiver is slow to respond then the deliveries to the other webhooks are not held back by it
+func TestWebhooksConcurrently(t *testing.T) {
+	server, err := NewServer(storage.NewMemory(), Options{MasterKey: testMasterKey, WebhookBackoff: 10 * time.Millisecond}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the server:", err)
+	}
+
+	defer server.Close()
+
+	release := make(chan struct{})
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+
+	defer slowServer.Close()
+	defer close(release)
+
+	receiver := &webhookReceiver{}
+
+	receiverServer := httptest.NewServer(receiver)
+
+	defer receiverServer.Close()
+
+	for _, url := range []string{slowServer.URL, receiverServer.URL} {
+		request := RequestWebhook{URL: url}
+
+		request.valid()
+
+		if _, err := server.keys.createWebhook(request); err != nil {
+			t.Fatal("could not create the webhook:", err)
+		}
+	}
+
+	server.keys.set("TestWebhooksConcurrently", "delivered", writeOptions{})
+
+	waitFor(t, "the delivery to the receiver which is not slow", func() bool {
+		received, _ := receiver.delivered()
+
+		return len(received) == 1
+	})
+}
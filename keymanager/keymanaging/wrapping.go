@@ -0,0 +1,324 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
+)
+
+var (
+	errWrappingTokenExpired = errors.New(ErrorWrappingTokenExpired)
+	errWrappingTokenInvalid = errors.New(ErrorInvalidWrappingToken)
+	errWrappingTokenUsed    = errors.New(ErrorWrappingTokenUsed)
+)
+
+// HeaderWrapTTL is the request header asking for the response to be wrapped, it holds how long the wrapping token can be unwrapped for
+const HeaderWrapTTL = "X-Wrap-TTL"
+
+// wrapPrefix is the prefix of the storage keys of the wrapped responses, which are named by the SHA-256 hash of their wrapping token
+const wrapPrefix = "wrap/"
+
+// wrapping is a wrapped response, sealed like the values of the keys until it is unwrapped; once it has been unwrapped only the time it was unwrapped is kept,
+// so that unwrapping it again can be told apart from a wrapping token which never existed until it expires
+type wrapping struct {
+	ContentType string       `json:"contentType,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	ETag        string       `json:"etag,omitempty"`
+	ExpiresAt   time.Time    `json:"expiresAt"`
+	Response    *sealedValue `json:"response,omitempty"`
+	UnwrappedAt *time.Time   `json:"unwrappedAt,omitempty"`
+}
+
+// wrappedResponse is a response as it is wrapped and unwrapped, along with the headers it is returned with
+type wrappedResponse struct {
+	Body        []byte
+	ContentType string
+	ETag        string
+}
+
+// RequestUnwrap is the request for the response wrapped by a wrapping token
+type RequestUnwrap struct {
+	Token string `json:"token"`
+}
+
+// WrapInfo is what is returned in place of a wrapped response, the wrapping token is needed to unwrap the response exactly once
+type WrapInfo struct {
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Token     string    `json:"token"`
+}
+
+// wrappingWriter holds back the response written by the handlers, and the headers they set, so that it can be wrapped instead of sent
+type wrappingWriter struct {
+	gin.ResponseWriter
+	body   bytes.Buffer
+	header http.Header
+}
+
+func (ww *wrappingWriter) Header() http.Header {
+	return ww.header
+}
+
+func (ww *wrappingWriter) Write(data []byte) (int, error) {
+	return ww.body.Write(data)
+}
+
+func (ww *wrappingWriter) WriteString(data string) (int, error) {
+	return ww.body.WriteString(data)
+}
+
+// readWrapping reads the wrapped response stored under the hash, nil is returned when there is none
+func readWrapping(txn storage.Txn, hash string) (*wrapping, error) {
+	data, exists, err := txn.Get(wrapPrefix + hash)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	w := &wrapping{}
+
+	if err = json.Unmarshal(data, w); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// wrap seals the response and stores it, along with its Content-Type and ETag, until it expires, returning the wrapping token which is
+// not kept anywhere else
+func (kd *keyData) wrap(response wrappedResponse, expiresAt time.Time) (WrapInfo, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return WrapInfo{}, err
+	}
+
+	bearer := hex.EncodeToString(newRandomKey())
+
+	storageKey := wrapPrefix + hashToken(bearer)
+
+	sealed := kr.seal(storageKey, string(response.Body))
+
+	w := wrapping{ContentType: response.ContentType, CreatedAt: time.Now().UTC(), ETag: response.ETag, ExpiresAt: expiresAt, Response: &sealed}
+
+	data, err := json.Marshal(w)
+
+	if err != nil {
+		return WrapInfo{}, err
+	}
+
+	if err = store.Transaction(func(txn storage.Txn) error { return txn.Put(storageKey, data) }); err != nil {
+		return WrapInfo{}, err
+	}
+
+	return WrapInfo{CreatedAt: w.CreatedAt, ExpiresAt: w.ExpiresAt, Token: bearer}, nil
+}
+
+// unwrap returns the response wrapped by the wrapping token and drops it in the same transaction, so that it is only ever returned once;
+// errWrappingTokenUsed is returned when it has already been unwrapped, errWrappingTokenExpired when it has expired first and
+// errWrappingTokenInvalid when there is no such wrapping token
+func (kd *keyData) unwrap(bearer string) (wrappedResponse, error) {
+	kr, store, err := kd.state()
+
+	if err != nil {
+		return wrappedResponse{}, err
+	}
+
+	var response wrappedResponse
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		hash := hashToken(bearer)
+
+		w, err := readWrapping(txn, hash)
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		switch {
+		case w == nil:
+			return errWrappingTokenInvalid
+		case w.UnwrappedAt != nil:
+			return errWrappingTokenUsed
+		case !w.ExpiresAt.After(now):
+			return errWrappingTokenExpired
+		}
+
+		body, err := kr.open(wrapPrefix+hash, *w.Response)
+
+		if err != nil {
+			return err
+		}
+
+		response = wrappedResponse{Body: []byte(body), ContentType: w.ContentType, ETag: w.ETag}
+
+		unwrappedAt := now.UTC()
+
+		w.ContentType, w.ETag, w.Response, w.UnwrappedAt = "", "", nil, &unwrappedAt
+
+		data, err := json.Marshal(w)
+
+		if err != nil {
+			return err
+		}
+
+		return txn.Put(wrapPrefix+hash, data)
+	})
+
+	if err != nil {
+		return wrappedResponse{}, err
+	}
+
+	return response, nil
+}
+
+// purgeExpiredWrappings removes every wrapped response which has expired, unwrapped or not, returning how many were removed
+func (kd *keyData) purgeExpiredWrappings() (int, error) {
+	_, store, err := kd.state()
+
+	if err != nil {
+		return 0, err
+	}
+
+	now, purged := time.Now(), 0
+
+	err = store.Transaction(func(txn storage.Txn) error {
+		storageKeys, err := txn.List(wrapPrefix)
+
+		if err != nil {
+			return err
+		}
+
+		for _, storageKey := range storageKeys {
+			w, err := readWrapping(txn, strings.TrimPrefix(storageKey, wrapPrefix))
+
+			if err != nil {
+				return err
+			}
+
+			if w.ExpiresAt.After(now) {
+				continue
+			}
+
+			if err = txn.Delete(storageKey); err != nil {
+				return err
+			}
+
+			purged++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// WrapResponse is a middleware handler which, when the X-Wrap-TTL header is provided, returns a single use wrapping token in place of a
+// successful response; the response is only returned, with the Content-Type and ETag it was written with, by unwrapping the token through
+// /sys/unwrap before the TTL runs out, while failed responses are returned as they are with their headers
+func (s *Server) WrapResponse(c *gin.Context) {
+	ttl := c.GetHeader(HeaderWrapTTL)
+
+	if ttl == "" {
+		c.Next()
+
+		return
+	}
+
+	expiresAt, valid := parseExpiry(ttl, nil, time.Now())
+
+	if !valid {
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidWrapTTL})
+
+		return
+	}
+
+	writer := &wrappingWriter{ResponseWriter: c.Writer, header: http.Header{}}
+
+	c.Writer = writer
+
+	c.Next()
+
+	c.Writer = writer.ResponseWriter
+
+	if c.Writer.Status() != 200 {
+		for name, values := range writer.header {
+			c.Writer.Header()[name] = values
+		}
+
+		c.Writer.Write(writer.body.Bytes())
+
+		return
+	}
+
+	info, err := s.keys.wrap(wrappedResponse{Body: writer.body.Bytes(), ContentType: writer.header.Get("Content-Type"), ETag: writer.header.Get("ETag")}, *expiresAt)
+
+	if err != nil {
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	c.JSON(200, Response{false, info})
+}
+
+// HandleUnwrap handles the POST request for the response wrapped by a wrapping token, which is returned as it would have been without
+// wrapping it exactly once; unwrapping it again fails with HTTP/409 and is logged, since whoever did it first may not have been meant to
+func (s *Server) HandleUnwrap(c *gin.Context) {
+	var UnwrapRequest RequestUnwrap
+
+	err := json.NewDecoder(c.Request.Body).Decode(&UnwrapRequest)
+
+	if err != nil {
+		c.AbortWithStatusJSON(400, Response{true, "could not unmarshal JSON"})
+
+		return
+	}
+
+	response, err := s.keys.unwrap(UnwrapRequest.Token)
+
+	switch err {
+	case nil:
+	case errWrappingTokenInvalid:
+		c.AbortWithStatusJSON(400, Response{true, ErrorInvalidWrappingToken})
+
+		return
+	case errWrappingTokenUsed:
+		s.logger.Printf("a wrapping token which has already been unwrapped was unwrapped again from %s, the wrapped response may have been intercepted", s.sourceIP(c))
+
+		c.AbortWithStatusJSON(409, Response{true, ErrorWrappingTokenUsed})
+
+		return
+	case errWrappingTokenExpired:
+		c.AbortWithStatusJSON(410, Response{true, ErrorWrappingTokenExpired})
+
+		return
+	default:
+		s.abortWithError(c, ErrorPersistFailed, err)
+
+		return
+	}
+
+	if response.ETag != "" {
+		c.Writer.Header().Set("ETag", response.ETag)
+	}
+
+	if response.ContentType == "" {
+		response.ContentType = "application/json; charset=utf-8"
+	}
+
+	c.Data(200, response.ContentType, response.Body)
+}
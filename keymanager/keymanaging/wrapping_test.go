@@ -0,0 +1,133 @@
+package keymanaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// If a key is read with the X-Wrap-TTL header then a wrapping token is returned instead of the value, and the value is not in the storage
+//     as it is
+// If the wrapping token is unwrapped then the response is returned as it would have been without wrapping it, with the same Content-Type
+//     and ETag, including the raw value of a key read as application/octet-stream, and unwrapping it again returns a HTTP/409 status
+// If the wrapping token has expired then unwrapping it returns a HTTP/410 status, and it is removed by the reaper
+// If the wrapping token does not exist then a HTTP/400 status is returned
+// If the X-Wrap-TTL header is not a positive duration then a HTTP/400 status is returned, and failed requests are not wrapped but
+//     returned as they are with their headers
+func TestResponseWrapping(t *testing.T) {
+	server := newTestServer(t)
+
+	handler := server.Handler()
+
+	server.keys.set("TestResponseWrapping", "wrapped-secret", writeOptions{})
+
+	accept := ""
+
+	serve := func(method, path, wrapTTL string, body interface{}) (int, []byte, http.Header) {
+		var requestBody bytes.Buffer
+
+		if body != nil {
+			json.NewEncoder(&requestBody).Encode(body)
+		}
+
+		mockRequest, err := http.NewRequest(method, path, &requestBody)
+
+		if err != nil {
+			t.Fatal("could not create the mock request")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		if wrapTTL != "" {
+			mockRequest.Header.Set(HeaderWrapTTL, wrapTTL)
+		}
+
+		if accept != "" {
+			mockRequest.Header.Set("Accept", accept)
+		}
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		handler.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.Bytes(), mockResponseWriter.Header()
+	}
+
+	for _, invalid := range []string{"soon", "-5m", "0s"} {
+		if code, _, _ := serve("GET", "/key/TestResponseWrapping", invalid, nil); code != 400 {
+			t.Errorf("GET /key/TestResponseWrapping with X-Wrap-TTL %q = HTTP/%d, expected HTTP/400", invalid, code)
+		}
+	}
+
+	if code, body, header := serve("GET", "/key/TestResponseWrappingMissing", "5m", nil); code != 400 || bytes.Contains(body, []byte(`"token"`)) || !strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+		t.Errorf("GET /key/TestResponseWrappingMissing with X-Wrap-TTL = HTTP/%d %s %v, expected the HTTP/400 not to be wrapped", code, body, header)
+	}
+
+	_, unwrapped, unwrappedHeader := serve("GET", "/key/TestResponseWrapping", "", nil)
+
+	code, body, header := serve("GET", "/key/TestResponseWrapping", "5m", nil)
+
+	var wrapped struct {
+		Message WrapInfo `json:"msg"`
+	}
+
+	json.Unmarshal(body, &wrapped)
+
+	if code != 200 || wrapped.Message.Token == "" || bytes.Contains(body, []byte("wrapped-secret")) || header.Get("ETag") != "" {
+		t.Fatalf("GET /key/TestResponseWrapping with X-Wrap-TTL = HTTP/%d %s, expected HTTP/200 with only a wrapping token", code, body)
+	}
+
+	storageKeys, _ := server.keys.storage.List(wrapPrefix)
+
+	for _, storageKey := range storageKeys {
+		value, _, _ := server.keys.storage.Get(storageKey)
+
+		if bytes.Contains(value, []byte("wrapped-secret")) || bytes.Contains([]byte(storageKey), []byte(wrapped.Message.Token)) {
+			t.Errorf("the wrapped response is stored as it is under %s, expected it to be sealed under the hash of the wrapping token", storageKey)
+		}
+	}
+
+	if code, body, header := serve("POST", "/sys/unwrap", "", RequestUnwrap{Token: wrapped.Message.Token}); code != 200 || !bytes.Equal(body, unwrapped) || header.Get("ETag") != unwrappedHeader.Get("ETag") {
+		t.Errorf("POST /sys/unwrap = HTTP/%d %s %v, expected HTTP/200 %s %v", code, body, header, unwrapped, unwrappedHeader)
+	}
+
+	accept = MIMEOctetStream
+
+	_, _, rawHeader := serve("GET", "/key/TestResponseWrapping", "", nil)
+	_, body, _ = serve("GET", "/key/TestResponseWrapping", "5m", nil)
+
+	accept = ""
+
+	json.Unmarshal(body, &wrapped)
+
+	if code, body, header := serve("POST", "/sys/unwrap", "", RequestUnwrap{Token: wrapped.Message.Token}); code != 200 || string(body) != "wrapped-secret" || header.Get("Content-Type") != rawHeader.Get("Content-Type") {
+		t.Errorf("POST /sys/unwrap of a value read as %s = HTTP/%d %s %v, expected HTTP/200 with the raw value as %s", MIMEOctetStream, code, body, header, rawHeader.Get("Content-Type"))
+	}
+
+	if code, _, _ := serve("POST", "/sys/unwrap", "", RequestUnwrap{Token: wrapped.Message.Token}); code != 409 {
+		t.Errorf("POST /sys/unwrap again = HTTP/%d, expected HTTP/409", code)
+	}
+
+	if code, _, _ := serve("POST", "/sys/unwrap", "", RequestUnwrap{Token: "not a token"}); code != 400 {
+		t.Errorf("POST /sys/unwrap with a wrapping token which does not exist = HTTP/%d, expected HTTP/400", code)
+	}
+
+	expiring, err := server.keys.wrap(wrappedResponse{Body: unwrapped}, time.Now().Add(-time.Second))
+
+	if err != nil {
+		t.Fatal("could not wrap the expiring response:", err)
+	}
+
+	if code, _, _ := serve("POST", "/sys/unwrap", "", RequestUnwrap{Token: expiring.Token}); code != 410 {
+		t.Errorf("POST /sys/unwrap with an expired wrapping token = HTTP/%d, expected HTTP/410", code)
+	}
+
+	if purged, err := server.keys.purgeExpiredWrappings(); purged != 1 || err != nil {
+		t.Errorf("purgeExpiredWrappings() = %d, %v, expected the expired wrapped response to be removed", purged, err)
+	}
+}
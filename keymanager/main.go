@@ -1,52 +1,197 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/the-rileyj/KeyMan/keymanager/keymanaging"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
 )
 
+// defaultStoragePaths are where each storage backend keeps its data when no path is provided
+var defaultStoragePaths = map[string]string{
+	storage.BackendBolt:     "./creds/storage.db",
+	storage.BackendJSONFile: "./creds/storage.json",
+	storage.BackendSQLite:   "./creds/storage.sqlite",
+}
+
+// splitMasterKey prints the unseal shares for the provided master key, or for a newly generated one if none is provided
+func splitMasterKey(masterKey []byte, shares, threshold int) {
+	if len(masterKey) == 0 {
+		masterKey = make([]byte, 32)
+
+		if _, err := rand.Read(masterKey); err != nil {
+			panic(err)
+		}
+
+		fmt.Println("generated a new master key, it is only stored in the unseal shares below")
+	}
+
+	unsealShares, err := keymanaging.SplitMasterKey(masterKey, shares, threshold)
+
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("any %d of these %d unseal shares will unseal the keymanager:\n", threshold, shares)
+
+	for _, unsealShare := range unsealShares {
+		fmt.Println(unsealShare)
+	}
+}
+
+// verifyAuditLog checks the audit log for records which have been edited or removed, exiting with a failure when it has been tampered with
+func verifyAuditLog(path string, auditKey []byte) {
+	if len(auditKey) == 0 {
+		panic("the audit log can only be verified with the audit key")
+	}
+
+	head, err := keymanaging.VerifyAuditLog(path, auditKey)
+
+	if err != nil {
+		fmt.Println("the audit log has been tampered with:", err)
+
+		os.Exit(1)
+	}
+
+	fmt.Printf("the audit log is intact, it holds %d records and ends with %s\n", head.Sequence, head.Hash)
+}
+
+// writeRootToken writes a generated root token to a file only its owner can read, so that it is never printed where logs are collected
+func writeRootToken(path, rootToken string) error {
+	tokenFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if err = tokenFile.Chmod(0600); err == nil {
+		_, err = tokenFile.WriteString(rootToken + "\n")
+	}
+
+	if closeErr := tokenFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
 func main() {
-	keysFilePathFlag := flag.String("keyFile", "./creds/keys.json", "File path to the json file storing the keys")
+	keysFilePathFlag := flag.String("keyFile", "./creds/keys.json", "File path to a json keys file written by an older keymanager, it is imported into the storage and removed when the keymanager is unsealed")
+	masterKeyFlag := flag.String("masterKey", os.Getenv("KEYMAN_MASTER_KEY"), "Hex encoded 32 byte master key which protects the keyring, defaults to the KEYMAN_MASTER_KEY environment variable; when it is not provided the keymanager starts sealed")
+	splitFlag := flag.Bool("split", false, "Print unseal shares for the master key (or a newly generated master key if none is provided) and exit")
+	sharesFlag := flag.Int("shares", 5, "The number of unseal shares to split the master key into")
+	thresholdFlag := flag.Int("threshold", 3, "The number of unseal shares required to unseal the keymanager")
+	snapshotEveryFlag := flag.Int("snapshotEvery", 1000, "The number of changes the write-ahead log of the json storage can hold before they are compacted into the storage file")
+	maxVersionsFlag := flag.Int("maxVersions", 10, "The number of versions retained for each key which does not set its own, 0 retains every version")
+	trashRetentionFlag := flag.Duration("trashRetention", 7*24*time.Hour, "How long deleted keys are kept in the trash before they are purged, 0 keeps them until they are destroyed")
+	reapEveryFlag := flag.Duration("reapEvery", time.Minute, "How often expired keys, tokens and wrapped responses are removed, the trash is purged and the events are compacted")
+	eventRetentionFlag := flag.Int("eventRetention", 10000, "The number of the latest key changes kept for watchers to resume from, 0 keeps every change")
+	rootTokenFlag := flag.String("rootToken", os.Getenv("KEYMAN_ROOT_TOKEN"), "Token which is allowed every request and creates the other tokens, defaults to the KEYMAN_ROOT_TOKEN environment variable; when it is not provided one is generated and written to the root token file")
+	rootTokenFileFlag := flag.String("rootTokenFile", "./creds/root-token", "File path a generated root token is written to, readable only by the user the keymanager runs as")
+	auditLogFlag := flag.String("auditLog", "./creds/audit.log", "File path to the audit log every request for the keys is recorded in when an audit key is provided")
+	auditKeyFlag := flag.String("auditKey", os.Getenv("KEYMAN_AUDIT_KEY"), "Hex encoded key the records of the audit log and the key names in them are HMAC'd with, defaults to the KEYMAN_AUDIT_KEY environment variable; when it is not provided nothing is audited")
+	trustedProxiesFlag := flag.String("trustedProxies", os.Getenv("KEYMAN_TRUSTED_PROXIES"), "Comma separated IP addresses or CIDR ranges of the proxies, such as the gatekeeper, trusted to forward the IP of the client for the audit log, defaults to the KEYMAN_TRUSTED_PROXIES environment variable")
+	verifyAuditFlag := flag.Bool("verifyAudit", false, "Check that no record of the audit log has been edited or removed and exit")
+	storageFlag := flag.String("storage", storage.BackendJSONFile, "The storage backend to keep the keys in: json, bolt or sqlite")
+	storagePathFlag := flag.String("storagePath", "", "File path to the storage, defaults to ./creds/storage.json, ./creds/storage.db or ./creds/storage.sqlite depending on the backend")
 
 	flag.Parse()
 
-	if _, err := os.Stat(*keysFilePathFlag); os.IsNotExist(err) {
-		keysFile, err := os.Create(*keysFilePathFlag)
+	masterKey, err := hex.DecodeString(*masterKeyFlag)
 
-		if err != nil {
-			panic(err)
-		}
+	if err != nil {
+		panic("the master key must be hex encoded")
+	}
 
-		err = keymanaging.UnloadKeyDataKeys(keysFile)
+	auditKey, err := hex.DecodeString(*auditKeyFlag)
 
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		keysFile, err := os.Open(*keysFilePathFlag)
+	if err != nil {
+		panic("the audit key must be hex encoded")
+	}
+
+	if *verifyAuditFlag {
+		verifyAuditLog(*auditLogFlag, auditKey)
+
+		return
+	}
+
+	if *splitFlag {
+		splitMasterKey(masterKey, *sharesFlag, *thresholdFlag)
+
+		return
+	}
+
+	storagePath, supported := defaultStoragePaths[*storageFlag]
+
+	if !supported {
+		panic(fmt.Sprintf(`unknown storage backend "%s", it must be json, bolt or sqlite`, *storageFlag))
+	}
+
+	if *storagePathFlag != "" {
+		storagePath = *storagePathFlag
+	}
+
+	logger := log.New(os.Stdout, "keymanager: ", log.LstdFlags)
 
-		if err != nil {
+	if *rootTokenFlag == "" {
+		rootToken := make([]byte, 32)
+
+		if _, err := rand.Read(rootToken); err != nil {
 			panic(err)
 		}
 
-		err = keymanaging.LoadKeyDataKeys(keysFile)
+		*rootTokenFlag = hex.EncodeToString(rootToken)
 
-		if err != nil {
-			panic(err)
+		if err := writeRootToken(*rootTokenFileFlag, *rootTokenFlag); err != nil {
+			panic(fmt.Sprintf("could not write the generated root token to %s: %v", *rootTokenFileFlag, err))
 		}
+
+		logger.Printf("no root token was provided, generated one and wrote it to %s", *rootTokenFileFlag)
 	}
 
-	router := keymanaging.NewKeyManagingRouter()
+	if len(auditKey) == 0 {
+		*auditLogFlag = ""
 
-	router.Use(keymanaging.WriteToFileOnUpdate(*keysFilePathFlag))
+		logger.Println("no audit key was provided, requests are not audited")
+	}
 
-	router.DELETE("/key/:key", keymanaging.HandleDeleteKey)
-	router.GET("/key/:key", keymanaging.HandleGetKey)
-	router.POST("/key", keymanaging.HandlePostKey)
-	router.PUT("/key/:key", keymanaging.HandlePutKey)
-	router.Any("/", keymanaging.CreateInfoHandler(router))
+	var trustedProxies []string
+
+	if *trustedProxiesFlag != "" {
+		trustedProxies = strings.Split(*trustedProxiesFlag, ",")
+	}
+
+	server, err := keymanaging.NewServer(nil, keymanaging.Options{
+		AuditKey:       auditKey,
+		AuditLog:       *auditLogFlag,
+		EventRetention: *eventRetentionFlag,
+		LegacyKeysFile: *keysFilePathFlag,
+		MasterKey:      masterKey,
+		MaxVersions:    *maxVersionsFlag,
+		ReapInterval:   *reapEveryFlag,
+		RootToken:      *rootTokenFlag,
+		TrashRetention: *trashRetentionFlag,
+		TrustedProxies: trustedProxies,
+		OpenStorage: func(masterKey []byte) (storage.Storage, error) {
+			return storage.Open(*storageFlag, storagePath, storage.Options{MasterKey: masterKey, SnapshotInterval: *snapshotEveryFlag})
+		},
+	}, logger)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if server.IsSealed() {
+		logger.Println("no master key was provided, starting sealed")
+	}
 
-	router.Run(":9902")
+	logger.Fatal(http.ListenAndServe(":9902", server.Handler()))
 }
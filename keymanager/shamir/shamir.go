@@ -0,0 +1,155 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	ErrDuplicateShare   = errors.New("the same share was provided more than once")
+	ErrInvalidShares    = errors.New("the shares provided are malformed or of different lengths")
+	ErrInvalidThreshold = errors.New("the threshold must be at least 2 and no more than the number of shares, which can be at most 255")
+	ErrEmptySecret      = errors.New("the secret to split must not be empty")
+)
+
+// Arithmetic is done in GF(2^8) with the AES polynomial, exp and log tables are built once using 3 as the generator
+var expTable, logTable [256]byte
+
+func init() {
+	x := byte(1)
+
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+
+		// x *= 3
+		x ^= xtime(x)
+	}
+
+	expTable[255] = expTable[0]
+}
+
+func xtime(b byte) byte {
+	if b&0x80 != 0 {
+		return b<<1 ^ 0x1b
+	}
+
+	return b << 1
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// evaluate evaluates the polynomial with the given coefficients (constant term first) at x using Horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+
+	return result
+}
+
+// Split splits the secret into the given number of shares, any "threshold" of which can be combined to recover it;
+// each share is as long as the secret plus a trailing byte holding the share's x coordinate
+func Split(secret []byte, shares, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+
+	if threshold < 2 || threshold > shares || shares > 255 {
+		return nil, ErrInvalidThreshold
+	}
+
+	splitShares := make([][]byte, shares)
+
+	for i := range splitShares {
+		splitShares[i] = make([]byte, len(secret)+1)
+		splitShares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+
+	for byteIndex, secretByte := range secret {
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		coefficients[0] = secretByte
+
+		for _, share := range splitShares {
+			share[byteIndex] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+
+	return splitShares, nil
+}
+
+// Combine recovers the secret from shares produced by Split, when fewer shares than the threshold are provided
+// the result is not the secret, so callers need some other way of checking that the recovered secret is correct
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	shareLength := len(shares[0])
+
+	if shareLength < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+
+	for i, share := range shares {
+		if len(share) != shareLength || share[shareLength-1] == 0 {
+			return nil, ErrInvalidShares
+		}
+
+		xs[i] = share[shareLength-1]
+
+		if seen[xs[i]] {
+			return nil, ErrDuplicateShare
+		}
+
+		seen[xs[i]] = true
+	}
+
+	secret := make([]byte, shareLength-1)
+
+	for byteIndex := range secret {
+		// Lagrange interpolation at x = 0, in GF(2^8) subtraction is the same as addition (xor)
+		var result byte
+
+		for i, share := range shares {
+			basis := byte(1)
+
+			for j := range shares {
+				if i != j {
+					basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+				}
+			}
+
+			result ^= mul(share[byteIndex], basis)
+		}
+
+		secret[byteIndex] = result
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,68 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Need to test the following:
+// If the threshold is invalid then an error is returned
+// If at least the threshold number of shares are combined then the secret is recovered,
+//     no matter which of the shares are used
+// If fewer than the threshold number of shares are combined then the secret is not recovered
+// If the same share is provided twice then an error is returned
+func TestSplitAndCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, invalid := range [][2]int{{3, 1}, {3, 4}, {256, 3}} {
+		if _, err := Split(secret, invalid[0], invalid[1]); err != ErrInvalidThreshold {
+			t.Errorf("Split(secret, %d, %d) = %v, expected %v", invalid[0], invalid[1], err, ErrInvalidThreshold)
+		}
+	}
+
+	shares, err := Split(secret, 5, 3)
+
+	if err != nil {
+		t.Fatal("could not split the secret:", err)
+	}
+
+	tests := []struct {
+		expectSecret bool
+		shares       [][]byte
+	}{
+		{
+			expectSecret: true,
+			shares:       [][]byte{shares[0], shares[1], shares[2]},
+		},
+		{
+			expectSecret: true,
+			shares:       [][]byte{shares[4], shares[2], shares[0]},
+		},
+		{
+			expectSecret: true,
+			shares:       shares,
+		},
+		{
+			expectSecret: false,
+			shares:       [][]byte{shares[3], shares[1]},
+		},
+	}
+
+	for _, test := range tests {
+		combined, err := Combine(test.shares)
+
+		if err != nil {
+			t.Errorf("Combine(shares) = %v, expected no error", err)
+
+			continue
+		}
+
+		if bytes.Equal(combined, secret) != test.expectSecret {
+			t.Errorf(`Combine(%d shares) = "%x", expected the secret to be recovered: %v`, len(test.shares), combined, test.expectSecret)
+		}
+	}
+
+	if _, err := Combine([][]byte{shares[0], shares[0], shares[1]}); err != ErrDuplicateShare {
+		t.Errorf("Combine(duplicate shares) = %v, expected %v", err, ErrDuplicateShare)
+	}
+}
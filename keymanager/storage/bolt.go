@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("keymanager")
+
+// boltStorage keeps every value in a single bucket of an embedded bbolt database
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the bbolt backend at the given path, creating the database if it does not exist
+func OpenBolt(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (bs *boltStorage) Get(key string) (value []byte, exists bool, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		value, exists, err = boltTxn{tx.Bucket(boltBucket)}.Get(key)
+
+		return err
+	})
+
+	return value, exists, err
+}
+
+func (bs *boltStorage) List(prefix string) (keys []string, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		keys, err = boltTxn{tx.Bucket(boltBucket)}.List(prefix)
+
+		return err
+	})
+
+	return keys, err
+}
+
+func (bs *boltStorage) ListAfter(prefix, after string, limit int) (keys []string, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		keys, err = boltTxn{tx.Bucket(boltBucket)}.ListAfter(prefix, after, limit)
+
+		return err
+	})
+
+	return keys, err
+}
+
+func (bs *boltStorage) Put(key string, value []byte) error {
+	return bs.Transaction(func(txn Txn) error { return txn.Put(key, value) })
+}
+
+func (bs *boltStorage) Delete(key string) error {
+	return bs.Transaction(func(txn Txn) error { return txn.Delete(key) })
+}
+
+func (bs *boltStorage) Transaction(fn func(txn Txn) error) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+func (bs *boltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// boltTxn reads and writes the bucket inside of a bbolt transaction, values returned by bbolt are only valid
+// for the life of the transaction so they are copied
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+func (bt boltTxn) Get(key string) ([]byte, bool, error) {
+	value := bt.bucket.Get([]byte(key))
+
+	if value == nil {
+		return nil, false, nil
+	}
+
+	return copyBytes(value), true, nil
+}
+
+func (bt boltTxn) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := bt.bucket.Cursor()
+
+	for key, _ := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = cursor.Next() {
+		keys = append(keys, string(key))
+	}
+
+	return keys, nil
+}
+
+func (bt boltTxn) ListAfter(prefix, after string, limit int) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := bt.bucket.Cursor()
+
+	start := []byte(prefix)
+
+	// The smallest key after the cursor is the cursor followed by a zero byte
+	if after >= prefix {
+		start = []byte(after + "\x00")
+	}
+
+	for key, _ := cursor.Seek(start); key != nil && bytes.HasPrefix(key, []byte(prefix)) && len(keys) < limit; key, _ = cursor.Next() {
+		keys = append(keys, string(key))
+	}
+
+	return keys, nil
+}
+
+func (bt boltTxn) Put(key string, value []byte) error {
+	// bbolt treats a nil value as missing, so empty values are stored as an empty slice
+	return bt.bucket.Put([]byte(key), append([]byte{}, value...))
+}
+
+func (bt boltTxn) Delete(key string) error {
+	return bt.bucket.Delete([]byte(key))
+}
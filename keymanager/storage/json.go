@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// maxRecordSize is the largest write-ahead log record, a transaction which would need a larger one is refused; the length of a record
+// is read before the record, so a larger length can only be a torn or corrupt header and is treated like any other torn record
+const maxRecordSize = 256 << 20
+
+// jsonFileHeader prefixes the file and every write-ahead log record, it is also used as the additional
+// authenticated data so that the header cannot be swapped without detection
+const jsonFileHeader = "KEYMAN-STORAGE-AES-256-GCM-V1\n"
+
+var (
+	ErrCorruptRecord    = errors.New("a record of the write-ahead log does not match its checksum; the log is corrupt or has been tampered with")
+	ErrInvalidMasterKey = errors.New("the master key must be exactly 32 bytes long")
+	ErrMissingRecord    = errors.New("a record of the write-ahead log is missing; the log has been tampered with or belongs to another storage file")
+	ErrRecordTooLarge   = errors.New("the transaction is too large to be appended to the write-ahead log")
+	ErrTamperedData     = errors.New("the storage file could not be authenticated; it is corrupt, has been tampered with, or the master key is wrong")
+	ErrUnknownFormat    = errors.New("the storage file is not in the format of the JSON file backend")
+
+	errTornRecord = errors.New("the write-ahead log record was not written in full")
+)
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+// jsonFileSnapshot is the content of the file, "Sequence" is the last write-ahead log record it holds
+type jsonFileSnapshot struct {
+	Entries  map[string][]byte `json:"entries"`
+	Sequence uint64            `json:"sequence"`
+}
+
+// walRecord is a committed transaction as it is appended to the write-ahead log
+type walRecord struct {
+	Operations []operation `json:"ops"`
+	Sequence   uint64      `json:"sequence"`
+}
+
+// jsonFileStorage keeps every value in memory and persists them to a single JSON file encrypted with the master key;
+// each transaction is appended to a checksummed write-ahead log next to the file, and once the log holds "snapshotInterval"
+// transactions the file is atomically rewritten and the log compacted
+type jsonFileStorage struct {
+	*memoryStorage
+
+	aead             cipher.AEAD
+	log              *os.File
+	path             string
+	records          int
+	sequence         uint64
+	snapshotInterval int
+}
+
+// OpenJSONFile opens the JSON file backend at the given path, creating it if it does not exist, and replays its write-ahead log
+func OpenJSONFile(path string, masterKey []byte, snapshotInterval int) (Storage, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidMasterKey
+	}
+
+	block, err := aes.NewCipher(masterKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshotInterval < 1 {
+		snapshotInterval = 1000
+	}
+
+	js := &jsonFileStorage{aead: aead, path: path, snapshotInterval: snapshotInterval}
+
+	js.memoryStorage = newMemoryStorage(js.appendRecord)
+
+	if err = js.load(); err != nil {
+		return nil, err
+	}
+
+	js.log, err = os.OpenFile(js.walPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return js, nil
+}
+
+func (js *jsonFileStorage) walPath() string {
+	return js.path + ".wal"
+}
+
+func (js *jsonFileStorage) encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, js.aead.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return js.aead.Seal(append([]byte(jsonFileHeader), nonce...), nonce, plaintext, []byte(jsonFileHeader)), nil
+}
+
+func (js *jsonFileStorage) decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(jsonFileHeader)) {
+		return nil, ErrUnknownFormat
+	}
+
+	sealed := data[len(jsonFileHeader):]
+
+	if len(sealed) < js.aead.NonceSize() {
+		return nil, ErrTamperedData
+	}
+
+	plaintext, err := js.aead.Open(nil, sealed[:js.aead.NonceSize()], sealed[js.aead.NonceSize():], []byte(jsonFileHeader))
+
+	if err != nil {
+		return nil, ErrTamperedData
+	}
+
+	return plaintext, nil
+}
+
+// load reads the file and replays the records of the write-ahead log which are newer than it, each of which has to follow the one
+// before it; a truncated or corrupt record at the end of the log, left by a crash while appending, is cut off
+func (js *jsonFileStorage) load() error {
+	data, err := ioutil.ReadFile(js.path)
+
+	if os.IsNotExist(err) {
+		if err = js.snapshot(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		plaintext, err := js.decrypt(data)
+
+		if err != nil {
+			return err
+		}
+
+		var snapshot jsonFileSnapshot
+
+		if err = json.Unmarshal(plaintext, &snapshot); err != nil {
+			return ErrUnknownFormat
+		}
+
+		if snapshot.Entries != nil {
+			js.entries = snapshot.Entries
+		}
+
+		js.sequence = snapshot.Sequence
+	}
+
+	logFile, err := os.OpenFile(js.walPath(), os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer logFile.Close()
+
+	info, err := logFile.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(logFile)
+
+	var offset int64
+
+	for {
+		record, size, err := js.decodeRecord(reader, info.Size()-offset)
+
+		if err == io.EOF {
+			break
+		}
+
+		// Only the last record can have been torn by stopping part way through appending it, what comes before it is kept
+		if err == errTornRecord {
+			if err = logFile.Truncate(offset); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset += int64(size)
+
+		if record.Sequence > js.sequence+1 {
+			return ErrMissingRecord
+		}
+
+		if record.Sequence == js.sequence+1 {
+			applyOperations(js.entries, record.Operations)
+
+			js.records++
+			js.sequence = record.Sequence
+		}
+	}
+
+	return logFile.Sync()
+}
+
+// encodeRecord frames a record as its length, a CRC-32C checksum and the record, which is encrypted with the master key
+func (js *jsonFileStorage) encodeRecord(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err = js.encrypt(payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) > maxRecordSize {
+		return nil, ErrRecordTooLarge
+	}
+
+	frame := make([]byte, 8, 8+len(payload))
+
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crc32Table))
+
+	return append(frame, payload...), nil
+}
+
+// decodeRecord reads the next record of the write-ahead log, of which remaining bytes are left; errTornRecord is returned for a record
+// which is the last one of the log and was not written in full, and ErrCorruptRecord for a record which does not match its checksum
+// with more of the log after it
+func (js *jsonFileStorage) decodeRecord(r io.Reader, remaining int64) (walRecord, int, error) {
+	var record walRecord
+
+	header := make([]byte, 8)
+
+	if remaining == 0 {
+		return record, 0, io.EOF
+	}
+
+	if remaining < int64(len(header)) {
+		return record, 0, errTornRecord
+	}
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return record, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+
+	if int64(length) > remaining-int64(len(header)) {
+		return record, 0, errTornRecord
+	}
+
+	if length > maxRecordSize {
+		return record, 0, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return record, 0, err
+	}
+
+	if crc32.Checksum(payload, crc32Table) != binary.BigEndian.Uint32(header[4:8]) {
+		if int64(length) == remaining-int64(len(header)) {
+			return record, 0, errTornRecord
+		}
+
+		return record, 0, ErrCorruptRecord
+	}
+
+	size := len(header) + len(payload)
+
+	payload, err := js.decrypt(payload)
+
+	if err != nil {
+		return record, 0, err
+	}
+
+	if err = json.Unmarshal(payload, &record); err != nil {
+		return record, 0, ErrCorruptRecord
+	}
+
+	return record, size, nil
+}
+
+// appendRecord appends the operations of a transaction to the write-ahead log as a single record and syncs it,
+// it is called with the write lock held before the operations are applied; a partially written record is cut off again
+func (js *jsonFileStorage) appendRecord(operations []operation) error {
+	if js.log == nil {
+		return ErrClosed
+	}
+
+	frame, err := js.encodeRecord(walRecord{Operations: operations, Sequence: js.sequence + 1})
+
+	if err != nil {
+		return err
+	}
+
+	info, err := js.log.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = js.log.Write(frame); err == nil {
+		err = js.log.Sync()
+	}
+
+	if err != nil {
+		js.log.Truncate(info.Size())
+
+		return err
+	}
+
+	js.records++
+	js.sequence++
+
+	return nil
+}
+
+// syncDir flushes the directory entry of a renamed file to disk
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// snapshot atomically replaces the file with the entries in memory; they are written to a temporary file in the same directory
+// which is synced and renamed over the file, so a crash leaves either the old or the new file, never a partial one
+func (js *jsonFileStorage) snapshot() error {
+	plaintext, err := json.Marshal(jsonFileSnapshot{Entries: js.entries, Sequence: js.sequence})
+
+	if err != nil {
+		return err
+	}
+
+	data, err := js.encrypt(plaintext)
+
+	if err != nil {
+		return err
+	}
+
+	dirPath := filepath.Dir(js.path)
+
+	tmpFile, err := ioutil.TempFile(dirPath, "."+filepath.Base(js.path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, js.path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+
+		return err
+	}
+
+	return syncDir(dirPath)
+}
+
+// compact rewrites the file and empties the write-ahead log once the log holds enough records; the records are already durable,
+// so a failure only means compacting is tried again after the next transaction, and records older than the file are skipped on load
+func (js *jsonFileStorage) compact() {
+	if js.records < js.snapshotInterval || js.snapshot() != nil {
+		return
+	}
+
+	if js.log.Truncate(0) == nil && js.log.Sync() == nil {
+		js.records = 0
+	}
+}
+
+func (js *jsonFileStorage) Put(key string, value []byte) error {
+	return js.Transaction(func(txn Txn) error { return txn.Put(key, value) })
+}
+
+func (js *jsonFileStorage) Delete(key string) error {
+	return js.Transaction(func(txn Txn) error { return txn.Delete(key) })
+}
+
+func (js *jsonFileStorage) Transaction(fn func(txn Txn) error) error {
+	if err := js.memoryStorage.Transaction(fn); err != nil {
+		return err
+	}
+
+	js.mutex.Lock()
+
+	if js.log != nil {
+		js.compact()
+	}
+
+	js.mutex.Unlock()
+
+	return nil
+}
+
+func (js *jsonFileStorage) Close() error {
+	js.mutex.Lock()
+
+	defer js.mutex.Unlock()
+
+	js.entries = nil
+
+	if js.log == nil {
+		return nil
+	}
+
+	err := js.log.Close()
+
+	js.log = nil
+
+	return err
+}
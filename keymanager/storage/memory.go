@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// operation is a single write made in a transaction
+type operation struct {
+	Delete bool   `json:"delete,omitempty"`
+	Key    string `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// memoryStorage keeps every value in a map, it is also the base of the JSON file backend which persists
+// the operations of each transaction through "commit" before they are applied to the map
+type memoryStorage struct {
+	commit  func(operations []operation) error
+	entries map[string][]byte
+	mutex   *sync.RWMutex
+}
+
+// NewMemory creates a storage which only lives in memory, everything stored in it is lost when the process exits
+func NewMemory() Storage {
+	return newMemoryStorage(nil)
+}
+
+func newMemoryStorage(commit func(operations []operation) error) *memoryStorage {
+	return &memoryStorage{
+		commit:  commit,
+		entries: make(map[string][]byte),
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+func copyBytes(value []byte) []byte {
+	return append([]byte{}, value...)
+}
+
+// listEntries returns the keys of the map starting with the prefix in ascending order
+func listEntries(entries map[string][]byte, prefix string) []string {
+	keys := make([]string, 0)
+
+	for key := range entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// firstKeys sorts the keys and returns the first limit of them
+func firstKeys(keys []string, limit int) []string {
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys
+}
+
+func (ms *memoryStorage) Get(key string) ([]byte, bool, error) {
+	ms.mutex.RLock()
+
+	defer ms.mutex.RUnlock()
+
+	if ms.entries == nil {
+		return nil, false, ErrClosed
+	}
+
+	value, exists := ms.entries[key]
+
+	return copyBytes(value), exists, nil
+}
+
+func (ms *memoryStorage) List(prefix string) ([]string, error) {
+	ms.mutex.RLock()
+
+	defer ms.mutex.RUnlock()
+
+	if ms.entries == nil {
+		return nil, ErrClosed
+	}
+
+	return listEntries(ms.entries, prefix), nil
+}
+
+func (ms *memoryStorage) ListAfter(prefix, after string, limit int) ([]string, error) {
+	ms.mutex.RLock()
+
+	defer ms.mutex.RUnlock()
+
+	if ms.entries == nil {
+		return nil, ErrClosed
+	}
+
+	keys := make([]string, 0)
+
+	for key := range ms.entries {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+
+	return firstKeys(keys, limit), nil
+}
+
+func (ms *memoryStorage) Put(key string, value []byte) error {
+	return ms.Transaction(func(txn Txn) error { return txn.Put(key, value) })
+}
+
+func (ms *memoryStorage) Delete(key string) error {
+	return ms.Transaction(func(txn Txn) error { return txn.Delete(key) })
+}
+
+// Transaction holds the write lock while the function runs, so transactions are applied one at a time
+func (ms *memoryStorage) Transaction(fn func(txn Txn) error) error {
+	ms.mutex.Lock()
+
+	defer ms.mutex.Unlock()
+
+	if ms.entries == nil {
+		return ErrClosed
+	}
+
+	txn := &memoryTxn{entries: ms.entries, writes: make(map[string][]byte)}
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	if len(txn.operations) == 0 {
+		return nil
+	}
+
+	if ms.commit != nil {
+		if err := ms.commit(txn.operations); err != nil {
+			return err
+		}
+	}
+
+	applyOperations(ms.entries, txn.operations)
+
+	return nil
+}
+
+func applyOperations(entries map[string][]byte, operations []operation) {
+	for _, op := range operations {
+		if op.Delete {
+			delete(entries, op.Key)
+		} else {
+			entries[op.Key] = op.Value
+		}
+	}
+}
+
+func (ms *memoryStorage) Close() error {
+	ms.mutex.Lock()
+
+	ms.entries = nil
+
+	ms.mutex.Unlock()
+
+	return nil
+}
+
+// memoryTxn buffers the writes of a transaction on top of the committed entries
+type memoryTxn struct {
+	entries    map[string][]byte
+	operations []operation
+	writes     map[string][]byte
+}
+
+func (mt *memoryTxn) Get(key string) ([]byte, bool, error) {
+	if value, written := mt.writes[key]; written {
+		return copyBytes(value), value != nil, nil
+	}
+
+	value, exists := mt.entries[key]
+
+	return copyBytes(value), exists, nil
+}
+
+func (mt *memoryTxn) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	for key := range mt.entries {
+		if _, written := mt.writes[key]; !written && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	for key, value := range mt.writes {
+		if value != nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// ListAfter goes through the committed entries in place rather than copying them to apply the writes of the transaction on top
+func (mt *memoryTxn) ListAfter(prefix, after string, limit int) ([]string, error) {
+	keys := make([]string, 0)
+
+	for key := range mt.entries {
+		if _, written := mt.writes[key]; !written && strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+
+	for key, value := range mt.writes {
+		if value != nil && strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+
+	return firstKeys(keys, limit), nil
+}
+
+func (mt *memoryTxn) Put(key string, value []byte) error {
+	value = copyBytes(value)
+
+	mt.writes[key] = value
+	mt.operations = append(mt.operations, operation{Key: key, Value: value})
+
+	return nil
+}
+
+func (mt *memoryTxn) Delete(key string) error {
+	mt.writes[key] = nil
+	mt.operations = append(mt.operations, operation{Delete: true, Key: key})
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlExecutor is what *sql.DB and *sql.Tx have in common, so the same queries can run inside and outside of a transaction
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteStorage keeps every value as a row of a single table in a SQLite database
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the SQLite backend at the given path, creating the database and its table if they do not exist
+func OpenSQLite(path string) (Storage, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A single connection serializes the transactions, which is what the other backends do as well
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS entries (key TEXT PRIMARY KEY, value BLOB NOT NULL)`)
+
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &sqliteStorage{db: db}, nil
+}
+
+func (ss *sqliteStorage) Get(key string) ([]byte, bool, error) {
+	return sqliteTxn{ss.db}.Get(key)
+}
+
+func (ss *sqliteStorage) List(prefix string) ([]string, error) {
+	return sqliteTxn{ss.db}.List(prefix)
+}
+
+func (ss *sqliteStorage) ListAfter(prefix, after string, limit int) ([]string, error) {
+	return sqliteTxn{ss.db}.ListAfter(prefix, after, limit)
+}
+
+func (ss *sqliteStorage) Put(key string, value []byte) error {
+	return sqliteTxn{ss.db}.Put(key, value)
+}
+
+func (ss *sqliteStorage) Delete(key string) error {
+	return sqliteTxn{ss.db}.Delete(key)
+}
+
+func (ss *sqliteStorage) Transaction(fn func(txn Txn) error) error {
+	tx, err := ss.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err = fn(sqliteTxn{tx}); err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ss *sqliteStorage) Close() error {
+	return ss.db.Close()
+}
+
+type sqliteTxn struct {
+	executor sqlExecutor
+}
+
+func (st sqliteTxn) Get(key string) ([]byte, bool, error) {
+	var value []byte
+
+	err := st.executor.QueryRow(`SELECT value FROM entries WHERE key = ?`, key).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (st sqliteTxn) List(prefix string) ([]string, error) {
+	rows, err := st.executor.Query(`SELECT key FROM entries WHERE key >= ? ORDER BY key`, prefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := make([]string, 0)
+
+	for rows.Next() {
+		var key string
+
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		// The keys are ordered, so the first key without the prefix ends the keys with it
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (st sqliteTxn) ListAfter(prefix, after string, limit int) ([]string, error) {
+	rows, err := st.executor.Query(`SELECT key FROM entries WHERE key >= ? AND key > ? ORDER BY key LIMIT ?`, prefix, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := make([]string, 0)
+
+	for rows.Next() {
+		var key string
+
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (st sqliteTxn) Put(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err := st.executor.Exec(`INSERT INTO entries (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+
+	return err
+}
+
+func (st sqliteTxn) Delete(key string) error {
+	_, err := st.executor.Exec(`DELETE FROM entries WHERE key = ?`, key)
+
+	return err
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The backends which can be passed to Open
+const (
+	BackendBolt     = "bolt"
+	BackendJSONFile = "json"
+	BackendMemory   = "memory"
+	BackendSQLite   = "sqlite"
+)
+
+var ErrClosed = errors.New("the storage has been closed")
+
+// Txn is a view of the storage inside of a transaction, the writes made through it are only visible to
+// other readers once the transaction commits
+type Txn interface {
+	// Get returns the value stored for the key and whether it exists
+	Get(key string) ([]byte, bool, error)
+	// Put stores the value for the key, replacing any value already stored for it
+	Put(key string, value []byte) error
+	// Delete removes the key, deleting a key which does not exist is not an error
+	Delete(key string) error
+	// List returns every stored key starting with the prefix in ascending order
+	List(prefix string) ([]string, error)
+	// ListAfter returns up to limit of the stored keys starting with the prefix which come after the cursor, in ascending order
+	ListAfter(prefix, after string, limit int) ([]string, error)
+}
+
+// Storage is where the keymanager keeps its data; every backend stores opaque values under string keys,
+// anything secret is sealed by the keymanager before it reaches the storage
+type Storage interface {
+	Txn
+
+	// Transaction runs the function in a transaction which commits when it returns nil and is discarded
+	// when it returns an error, the error is then returned by Transaction
+	Transaction(func(txn Txn) error) error
+	// Close releases the resources of the storage, it cannot be used afterwards
+	Close() error
+}
+
+// Options are the settings used by Open
+type Options struct {
+	// MasterKey is the 32 byte key the JSON file backend encrypts its file with
+	MasterKey []byte
+	// SnapshotInterval is the number of transactions the JSON file backend appends to its write-ahead log before it rewrites the file
+	SnapshotInterval int
+}
+
+// Open opens the storage of the backend at the given path
+func Open(backend, path string, options Options) (Storage, error) {
+	switch backend {
+	case BackendBolt:
+		return OpenBolt(path)
+	case BackendJSONFile:
+		return OpenJSONFile(path, options.MasterKey, options.SnapshotInterval)
+	case BackendMemory:
+		return NewMemory(), nil
+	case BackendSQLite:
+		return OpenSQLite(path)
+	}
+
+	return nil, fmt.Errorf(`unknown storage backend "%s"`, backend)
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+// backends opens each backend in the directory, "reopen" is false for backends which do not persist anything
+var backends = []struct {
+	name   string
+	open   func(dir string) (Storage, error)
+	reopen bool
+}{
+	{BackendBolt, func(dir string) (Storage, error) { return OpenBolt(filepath.Join(dir, "storage.db")) }, true},
+	{BackendJSONFile, func(dir string) (Storage, error) {
+		return OpenJSONFile(filepath.Join(dir, "storage.json"), testMasterKey, 3)
+	}, true},
+	{BackendMemory, func(string) (Storage, error) { return NewMemory(), nil }, false},
+	{BackendSQLite, func(dir string) (Storage, error) { return OpenSQLite(filepath.Join(dir, "storage.sqlite")) }, true},
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "keymanager-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// TestConformance runs the same cases against every backend
+func TestConformance(t *testing.T) {
+	// Need to test the following:
+	// Getting a missing key
+	// Putting, overwriting and getting a key, including an empty value
+	// Deleting a key, and a missing key
+	// Listing keys by prefix in order, and a page of them after a cursor
+	// Committing a transaction, its reads see its own writes
+	// Discarding a transaction which returns an error
+	// Reopening a persistent backend keeps what was committed
+	// Using a closed storage fails
+	errAbort := errors.New("abort")
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := tempDir(t)
+
+			defer os.RemoveAll(dir)
+
+			s, err := backend.open(dir)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, exists, err := s.Get("missing"); exists || err != nil {
+				t.Fatalf("Expected a missing key to not exist, got exists %t and error %v", exists, err)
+			}
+
+			for _, value := range []string{"first", "second", ""} {
+				if err = s.Put("a", []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+
+				got, exists, err := s.Get("a")
+
+				if err != nil || !exists || string(got) != value {
+					t.Fatalf(`Expected "%s" to be stored, got "%s", exists %t and error %v`, value, got, exists, err)
+				}
+			}
+
+			if err = s.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = s.Delete("a"); err != nil {
+				t.Fatalf("Expected deleting a missing key to succeed, got %v", err)
+			}
+
+			if _, exists, _ := s.Get("a"); exists {
+				t.Fatal("Expected the deleted key to not exist")
+			}
+
+			for _, key := range []string{"key/b", "key/a", "other/a", "key/c/d"} {
+				if err = s.Put(key, []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if keys, err := s.List("key/"); err != nil || !reflect.DeepEqual(keys, []string{"key/a", "key/b", "key/c/d"}) {
+				t.Fatalf("Expected the keys with the prefix in order, got %v and error %v", keys, err)
+			}
+
+			if keys, err := s.List("none/"); err != nil || len(keys) != 0 {
+				t.Fatalf("Expected no keys, got %v and error %v", keys, err)
+			}
+
+			if keys, err := s.ListAfter("key/", "key/a", 1); err != nil || !reflect.DeepEqual(keys, []string{"key/b"}) {
+				t.Fatalf("Expected the first key with the prefix after the cursor, got %v and error %v", keys, err)
+			}
+
+			if keys, err := s.ListAfter("key/", "", 10); err != nil || !reflect.DeepEqual(keys, []string{"key/a", "key/b", "key/c/d"}) {
+				t.Fatalf("Expected every key with the prefix, got %v and error %v", keys, err)
+			}
+
+			err = s.Transaction(func(txn Txn) error {
+				if err := txn.Put("txn/a", []byte("1")); err != nil {
+					return err
+				}
+
+				if err := txn.Delete("key/a"); err != nil {
+					return err
+				}
+
+				if value, exists, err := txn.Get("txn/a"); err != nil || !exists || string(value) != "1" {
+					t.Errorf(`Expected the transaction to read its own write, got "%s", exists %t and error %v`, value, exists, err)
+				}
+
+				if keys, err := txn.List("key/"); err != nil || !reflect.DeepEqual(keys, []string{"key/b", "key/c/d"}) {
+					t.Errorf("Expected the transaction to list its own writes, got %v and error %v", keys, err)
+				}
+
+				if keys, err := txn.ListAfter("", "key/b", 2); err != nil || !reflect.DeepEqual(keys, []string{"key/c/d", "other/a"}) {
+					t.Errorf("Expected the transaction to list its own writes after the cursor, got %v and error %v", keys, err)
+				}
+
+				if keys, err := txn.ListAfter("txn/", "", 10); err != nil || !reflect.DeepEqual(keys, []string{"txn/a"}) {
+					t.Errorf("Expected the transaction to list its own writes after the cursor, got %v and error %v", keys, err)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Transaction(func(txn Txn) error {
+				txn.Put("txn/b", []byte("2"))
+				txn.Delete("key/b")
+
+				return errAbort
+			})
+
+			if err != errAbort {
+				t.Fatalf("Expected the error of the transaction to be returned, got %v", err)
+			}
+
+			expected := map[string]string{"key/b": "key/b", "key/c/d": "key/c/d", "other/a": "other/a", "txn/a": "1"}
+
+			check := func(s Storage) {
+				keys, err := s.List("")
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := make(map[string]string)
+
+				for _, key := range keys {
+					value, _, err := s.Get(key)
+
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					got[key] = string(value)
+				}
+
+				if !reflect.DeepEqual(got, expected) {
+					t.Fatalf("Expected %v to be stored, got %v", expected, got)
+				}
+			}
+
+			check(s)
+
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if backend.reopen {
+				if s, err = backend.open(dir); err != nil {
+					t.Fatal(err)
+				}
+
+				check(s)
+
+				s.Close()
+			} else if _, _, err = s.Get("key/b"); err == nil {
+				t.Fatal("Expected a closed storage to fail")
+			}
+		})
+	}
+}
+
+// TestJSONFile tests what is particular to the JSON file backend: encryption, the write-ahead log and snapshots
+func TestJSONFile(t *testing.T) {
+	// Need to test the following:
+	// Nothing stored is readable in the file or the log
+	// A wrong master key fails to open the file
+	// A torn record at the end of the log is cut off, what came before it is kept, including a torn record whose length is too large
+	// A record removed from the middle of the log fails to open
+	// A record in the middle of the log which does not match its checksum fails to open, and nothing after it is cut off
+	// A tampered file fails to open
+	dir := tempDir(t)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "storage.json")
+
+	s, err := OpenJSONFile(path, testMasterKey, 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Five transactions with an interval of three leave a snapshot with three and a log with two
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err = s.Put(key, []byte("secret-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Close()
+
+	for _, filePath := range []string{path, path + ".wal"} {
+		data, err := ioutil.ReadFile(filePath)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) == 0 {
+			t.Fatalf("Expected %s to not be empty", filePath)
+		}
+
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			if bytes.Contains(data, []byte("secret-"+key)) {
+				t.Fatalf("Expected %s to not contain a plaintext value", filePath)
+			}
+		}
+	}
+
+	if _, err = OpenJSONFile(path, []byte("fedcba9876543210fedcba9876543210"), 3); err != ErrTamperedData {
+		t.Fatalf("Expected a wrong master key to fail with %v, got %v", ErrTamperedData, err)
+	}
+
+	logFile, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logFile.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	logFile.Close()
+
+	if s, err = OpenJSONFile(path, testMasterKey, 3); err != nil {
+		t.Fatalf("Expected a torn record to be cut off, got %v", err)
+	}
+
+	s.Close()
+
+	logFile, err = os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logFile.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	logFile.Close()
+
+	if s, err = OpenJSONFile(path, testMasterKey, 3); err != nil {
+		t.Fatalf("Expected a torn record with a length which is too large to be cut off, got %v", err)
+	}
+
+	if keys, _ := s.List(""); !reflect.DeepEqual(keys, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("Expected every committed key to be kept, got %v", keys)
+	}
+
+	if err = s.Put("f", []byte("secret-f")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+
+	if s, err = OpenJSONFile(path, testMasterKey, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _, _ := s.Get("f"); string(value) != "secret-f" {
+		t.Fatalf(`Expected the record appended after the cut to be replayed, got "%s"`, value)
+	}
+
+	s.Close()
+
+	gapPath := filepath.Join(dir, "gap.json")
+
+	if s, err = OpenJSONFile(gapPath, testMasterKey, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err = s.Put(key, []byte("secret-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Close()
+
+	log, _ := ioutil.ReadFile(gapPath + ".wal")
+
+	first := 8 + int(binary.BigEndian.Uint32(log[0:4]))
+	second := first + 8 + int(binary.BigEndian.Uint32(log[first:first+4]))
+
+	ioutil.WriteFile(gapPath+".wal", append(append([]byte{}, log[:first]...), log[second:]...), 0600)
+
+	if _, err = OpenJSONFile(gapPath, testMasterKey, 100); err != ErrMissingRecord {
+		t.Fatalf("Expected a log with a record removed from the middle to fail with %v, got %v", ErrMissingRecord, err)
+	}
+
+	corrupted := append([]byte{}, log...)
+
+	corrupted[first+8] ^= 0xff
+
+	ioutil.WriteFile(gapPath+".wal", corrupted, 0600)
+
+	if _, err = OpenJSONFile(gapPath, testMasterKey, 100); err != ErrCorruptRecord {
+		t.Fatalf("Expected a log with a corrupt record in the middle to fail with %v, got %v", ErrCorruptRecord, err)
+	}
+
+	if kept, _ := ioutil.ReadFile(gapPath + ".wal"); !bytes.Equal(kept, corrupted) {
+		t.Fatalf("Expected a log with a corrupt record in the middle to be left as it is, got %d bytes of %d", len(kept), len(corrupted))
+	}
+
+	data, _ := ioutil.ReadFile(path)
+
+	data[len(data)-1] ^= 0xff
+
+	ioutil.WriteFile(path, data, 0600)
+
+	if _, err = OpenJSONFile(path, testMasterKey, 3); err != ErrTamperedData {
+		t.Fatalf("Expected a tampered file to fail with %v, got %v", ErrTamperedData, err)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/the-rileyj/KeyMan/keymanager/keymanaging"
@@ -16,6 +19,46 @@ const (
 	KeyManURL = "https://keys.therileyjohnson.com"
 )
 
+// Token is the token the requests to the keymanager are made with, it defaults to the KEYMAN_TOKEN environment variable
+var Token = os.Getenv("KEYMAN_TOKEN")
+
+// authorize sets the token in the Authorization header of the request
+func authorize(request *http.Request) {
+	request.Header.Set("Authorization", "Bearer "+Token)
+}
+
+// ManyOptions are the options for reading many keys at once
+type ManyOptions struct {
+	// FailOnMissing fails the whole read unless every key exists and could be read
+	FailOnMissing bool
+}
+
+// KeyValues are the values of the keys which were found when reading many keys at once, the keys which do not exist,
+// and why each of the other keys could not be read
+type KeyValues struct {
+	Errors  map[string]string
+	Missing []string
+	Values  map[string]string
+}
+
+// MissingKeysError is returned when every key had to be read but some of them do not exist or could not be read
+type MissingKeysError struct {
+	Errors  map[string]string
+	Missing []string
+}
+
+func (mke *MissingKeysError) Error() string {
+	keys := append([]string{}, mke.Missing...)
+
+	for key := range mke.Errors {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return fmt.Sprintf("%s: %s", keymanaging.ErrorKeysMissing, strings.Join(keys, ", "))
+}
+
 // GetKeyValue gets the values for the provided key given that it exists in the API
 func GetKeyValue(key string) (string, error) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
@@ -38,6 +81,8 @@ func GetKeyValueWithContextAndClient(ctx context.Context, client *http.Client, k
 		return "", err
 	}
 
+	authorize(keyRequest)
+
 	keyRequest = keyRequest.WithContext(ctx)
 
 	keyResponse, err := client.Do(keyRequest)
@@ -76,42 +121,93 @@ func GetManyKeyValuesWithContext(ctx context.Context, keys ...string) (map[strin
 	return GetManyKeyValuesWithContextAndClient(ctx, http.DefaultClient, keys...)
 }
 
-// GetManyKeyValuesWithContextAndClient gets the values for the provided keys given that they exist in the API with a request that uses the given context and HTTP client
+// GetManyKeyValuesWithContextAndClient gets the values for the provided keys given that they exist in the API with a request that uses the given context and HTTP client,
+// the keys which do not exist or could not be read are left out of the returned map
 func GetManyKeyValuesWithContextAndClient(ctx context.Context, client *http.Client, keys ...string) (map[string]string, error) {
+	keyValues, err := GetKeyValuesWithOptions(ctx, client, ManyOptions{}, keys...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keyValues.Values, nil
+}
+
+// GetRequiredKeyValues gets the values for the provided keys, failing with a *MissingKeysError unless every one of them exists and could be read
+func GetRequiredKeyValues(keys ...string) (map[string]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+
+	defer cancel()
+
+	keyValues, err := GetKeyValuesWithOptions(ctx, http.DefaultClient, ManyOptions{FailOnMissing: true}, keys...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keyValues.Values, nil
+}
+
+// GetKeyValuesWithOptions gets the values for the provided keys with a request that uses the given context and HTTP client, along with the keys which
+// do not exist and why the others could not be read; with "options.FailOnMissing" a *MissingKeysError is returned unless every key was read
+func GetKeyValuesWithOptions(ctx context.Context, client *http.Client, options ManyOptions, keys ...string) (KeyValues, error) {
 	reader, writer := io.Pipe()
 	keysRequest, err := http.NewRequest("POST", fmt.Sprintf("%s/keys", KeyManURL), reader)
 
 	if err != nil {
-		return nil, err
+		return KeyValues{}, err
 	}
 
-	go func() { json.NewEncoder(writer).Encode(keymanaging.RequestMany{Keys: keys}) }()
+	go func() {
+		writer.CloseWithError(json.NewEncoder(writer).Encode(keymanaging.RequestMany{FailOnMissing: options.FailOnMissing, Keys: keys}))
+	}()
+
+	authorize(keysRequest)
 
 	keysRequest = keysRequest.WithContext(ctx)
 
 	keyResponse, err := client.Do(keysRequest)
 
 	if err != nil {
-		return nil, err
+		return KeyValues{}, err
 	}
 
-	keyResponseData := keymanaging.Response{Message: make(map[string]string, 0)}
+	defer keyResponse.Body.Close()
+
+	var keyResponseData struct {
+		keymanaging.ManyResponse
+		Message json.RawMessage `json:"msg"`
+	}
 
 	err = json.NewDecoder(keyResponse.Body).Decode(&keyResponseData)
 
 	if err != nil {
-		return nil, err
+		return KeyValues{}, err
 	}
 
 	if keyResponseData.Error {
-		return nil, errors.New(keyResponseData.Message.(string))
+		var message string
+
+		if err = json.Unmarshal(keyResponseData.Message, &message); err != nil {
+			return KeyValues{}, err
+		}
+
+		if message == keymanaging.ErrorKeysMissing {
+			return KeyValues{}, &MissingKeysError{Errors: keyResponseData.Errors, Missing: keyResponseData.Missing}
+		}
+
+		return KeyValues{}, errors.New(message)
 	}
 
-	returnMap := make(map[string]string)
+	keyValues := KeyValues{Errors: keyResponseData.Errors, Missing: keyResponseData.Missing}
+
+	if err = json.Unmarshal(keyResponseData.Message, &keyValues.Values); err != nil {
+		return KeyValues{}, err
+	}
 
-	for key, value := range keyResponseData.Message.(map[string]interface{}) {
-		returnMap[key] = value.(string)
+	if keyValues.Values == nil {
+		keyValues.Values = make(map[string]string)
 	}
 
-	return returnMap, nil
+	return keyValues, nil
 }
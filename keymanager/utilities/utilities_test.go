@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/the-rileyj/KeyMan/keymanager/keymanaging"
+	"github.com/the-rileyj/KeyMan/keymanager/storage"
 	"github.com/the-rileyj/KeyMan/keymanager/utilities"
 
 	"github.com/gin-gonic/gin"
@@ -26,6 +27,21 @@ func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+const testRootToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newKeyManagingServer creates an unsealed keymanaging server keeping its keys in memory, the requests of the utilities are made with its root token
+func newKeyManagingServer(t *testing.T) *keymanaging.Server {
+	utilities.Token = testRootToken
+
+	server, err := keymanaging.NewServer(storage.NewMemory(), keymanaging.Options{MasterKey: []byte("0123456789abcdef0123456789abcdef"), RootToken: testRootToken}, nil)
+
+	if err != nil {
+		t.Fatal("could not create the keymanaging server for the tests")
+	}
+
+	return server
+}
+
 func AreStringSlicesEqual(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -45,8 +61,10 @@ func AreStringSlicesEqual(a, b []string) bool {
 // If a key does not exist then the correct error is returned
 func TestGetKeyValue(t *testing.T) {
 	// This is setup for the tests
+	server := newKeyManagingServer(t)
+
 	testRouter, tmpRouter := gin.New(), gin.New()
-	testRouter.GET("/key/:key", keymanaging.HandleGetKey)
+	testRouter.GET("/key/*path", server.HandleGetKey)
 
 	setupReader, setupWriter := io.Pipe()
 	mockRequest, err := http.NewRequest("POST", "/key", setupReader)
@@ -57,7 +75,8 @@ func TestGetKeyValue(t *testing.T) {
 
 	go func() { json.NewEncoder(setupWriter).Encode(keymanaging.RequestSingle{Key: "test", Value: "test"}) }()
 
-	tmpRouter.POST("/key", keymanaging.HandlePostKey)
+	tmpRouter.POST("/key", server.HandlePostKey)
+	tmpRouter.DELETE("/key/*path", server.HandleDeleteKey)
 	tmpRouter.ServeHTTP(httptest.NewRecorder(), mockRequest)
 
 	serveCorrectResponseClient := &http.Client{
@@ -136,7 +155,6 @@ func TestGetKeyValue(t *testing.T) {
 		t.Fatal("could not create the mock request for tearing down the test")
 	}
 
-	tmpRouter.DELETE("/key/:key", keymanaging.HandleDeleteKey)
 	tmpRouter.ServeHTTP(httptest.NewRecorder(), mockRequest)
 }
 
@@ -145,10 +163,13 @@ func TestGetKeyValue(t *testing.T) {
 // If a key does not exist then the correct error is returned
 func TestGetKeyValues(t *testing.T) {
 	// This is setup for the tests
+	server := newKeyManagingServer(t)
+
 	testRouter, tmpRouter := gin.New(), gin.New()
 
-	testRouter.POST("/keys", keymanaging.HandleGetManyKeys)
-	tmpRouter.POST("/key", keymanaging.HandlePostKey)
+	testRouter.POST("/keys", server.HandleGetManyKeys)
+	tmpRouter.POST("/key", server.HandlePostKey)
+	tmpRouter.DELETE("/key/*path", server.HandleDeleteKey)
 
 	testKeyValues := map[string]string{
 		"test":       "test",
@@ -320,8 +341,6 @@ func TestGetKeyValues(t *testing.T) {
 	}
 
 	// Perform tear down operations for the test
-	tmpRouter.DELETE("/key/:key", keymanaging.HandleDeleteKey)
-
 	for key, _ := range testKeyValues {
 		mockRequest, err := http.NewRequest("DELETE", fmt.Sprintf("/key/%s", key), nil)
 
@@ -332,3 +351,82 @@ func TestGetKeyValues(t *testing.T) {
 		tmpRouter.ServeHTTP(httptest.NewRecorder(), mockRequest)
 	}
 }
+
+// Need to test the following:
+// If some of the keys do not exist then the values of the others are returned along with the keys which are missing
+// If every key has to be read and some of them are missing then a *utilities.MissingKeysError listing them is returned
+// If every key has to be read and all of them exist then their values are returned
+func TestGetKeyValuesWithOptions(t *testing.T) {
+	// This is setup for the tests
+	handler := newKeyManagingServer(t).Handler()
+
+	serveCorrectResponseClient := &http.Client{
+		Transport: roundTripRequestHandler(func(request *http.Request) *http.Response {
+			responseRecorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(responseRecorder, request)
+
+			return responseRecorder.Result()
+		}),
+	}
+
+	for _, key := range []string{"test", "iexist"} {
+		mockRequest, err := http.NewRequest("POST", "/key", strings.NewReader(fmt.Sprintf(`{"key": "%s", "value": "yes"}`, key)))
+
+		if err != nil {
+			t.Fatal("could not create one of the mock requests for the tests")
+		}
+
+		mockRequest.Header.Set("Authorization", "Bearer "+testRootToken)
+
+		handler.ServeHTTP(httptest.NewRecorder(), mockRequest)
+	}
+
+	tests := []struct {
+		ExpectedMissingKeysError bool
+		ExpectedMissing          []string
+		ExpectedValues           map[string]string
+		TestOptions              utilities.ManyOptions
+		TestKeys                 []string
+	}{
+		{
+			ExpectedMissingKeysError: false,
+			ExpectedMissing:          []string{"idontexist"},
+			ExpectedValues:           map[string]string{"test": "yes", "iexist": "yes"},
+			TestOptions:              utilities.ManyOptions{},
+			TestKeys:                 []string{"test", "iexist", "idontexist"},
+		},
+		{
+			ExpectedMissingKeysError: true,
+			ExpectedMissing:          []string{"idontexist"},
+			ExpectedValues:           nil,
+			TestOptions:              utilities.ManyOptions{FailOnMissing: true},
+			TestKeys:                 []string{"test", "iexist", "idontexist"},
+		},
+		{
+			ExpectedMissingKeysError: false,
+			ExpectedMissing:          []string{},
+			ExpectedValues:           map[string]string{"test": "yes", "iexist": "yes"},
+			TestOptions:              utilities.ManyOptions{FailOnMissing: true},
+			TestKeys:                 []string{"test", "iexist"},
+		},
+	}
+
+	for _, test := range tests {
+		keyValues, err := utilities.GetKeyValuesWithOptions(context.Background(), serveCorrectResponseClient, test.TestOptions, test.TestKeys...)
+
+		missingKeysError, isMissingKeysError := err.(*utilities.MissingKeysError)
+
+		if test.ExpectedMissingKeysError {
+			if !isMissingKeysError || !AreStringSlicesEqual(missingKeysError.Missing, test.ExpectedMissing) {
+				t.Errorf(`utilities.GetKeyValuesWithOptions(%v, %v) = err{%v}, expected a *MissingKeysError listing %v`, test.TestOptions, test.TestKeys, err, test.ExpectedMissing)
+			}
+
+			continue
+		}
+
+		if err != nil || !AreStringSlicesEqual(keyValues.Missing, test.ExpectedMissing) || fmt.Sprint(keyValues.Values) != fmt.Sprint(test.ExpectedValues) {
+			t.Errorf(`utilities.GetKeyValuesWithOptions(%v, %v) = %v, err{%v}, expected %v missing %v`, test.TestOptions, test.TestKeys, keyValues.Values, err, test.ExpectedValues, test.ExpectedMissing)
+		}
+	}
+}